@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"zedex/zed"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var changesCmdConfig = struct {
+	outputDir string
+	since     string
+	json      bool
+}{}
+
+var changesCmd = &cobra.Command{
+	Use:    "changes",
+	Short:  "List extensions and releases added, updated or removed in the local mirror",
+	Args:   cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		since, err := zed.ParseSince(changesCmdConfig.since)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		zc := zed.NewZedClient(1)
+		zc.WithExtensionsLocalDir(changesCmdConfig.outputDir)
+		changes, err := zc.ChangeJournal().Since(since)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if changesCmdConfig.json {
+			changesJson, err := json.MarshalIndent(changes, "", "\t")
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println(string(changesJson))
+			return
+		}
+		for _, ch := range changes {
+			fmt.Printf("%s  %s\n", ch.Timestamp.Local().Format(time.DateTime), ch.Title())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(changesCmd)
+	changesCmd.Flags().StringVar(&changesCmdConfig.outputDir, "output-dir", ".zedex-cache", "the directory of the local mirror")
+	changesCmd.Flags().StringVar(&changesCmdConfig.since, "since", "", "only list changes after this time, as a duration (24h), an RFC3339 timestamp or a date (2006-01-02)")
+	changesCmd.Flags().BoolVar(&changesCmdConfig.json, "json", false, "print the changes as JSON")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"zedex/zed"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var compatCmdConfig = struct {
+	outputDir        string
+	zedVersion       string
+	json             bool
+	incompatibleOnly bool
+}{}
+
+var compatCmd = &cobra.Command{
+	Use:   "compat",
+	Short: "Report which mirrored extensions a Zed version can load",
+	Long: `Report which mirrored extensions a Zed version can load, based on their schema and
+wasm API versions. Exits with status 2 if any extension is incompatible.`,
+	Args:   cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		zc := zed.NewZedClient(1)
+		zc.WithExtensionsLocalDir(compatCmdConfig.outputDir)
+		report, err := zc.CompatReport(compatCmdConfig.zedVersion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if compatCmdConfig.incompatibleOnly {
+			report = report.IncompatibleOnly()
+		}
+
+		if compatCmdConfig.json {
+			reportJson, err := json.MarshalIndent(report, "", "\t")
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println(string(reportJson))
+		} else {
+			for _, e := range report.Extensions {
+				if e.Compatible {
+					fmt.Printf("ok  %s %s\n", e.ID, e.Version)
+				} else {
+					fmt.Printf("!!  %s %s: %s\n", e.ID, e.Version, e.Reason)
+				}
+			}
+			fmt.Printf("zed %s (schema <= %d, wasm API %s - %s): %d compatible, %d incompatible\n",
+				report.ZedVersion, report.MaxSchemaVersion, report.MinWasmAPIVersion, report.MaxWasmAPIVersion,
+				report.Compatible, report.Incompatible)
+		}
+
+		if report.Incompatible > 0 {
+			os.Exit(2)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(compatCmd)
+	compatCmd.Flags().StringVar(&compatCmdConfig.outputDir, "output-dir", ".zedex-cache", "the directory of the local mirror")
+	compatCmd.Flags().StringVar(&compatCmdConfig.zedVersion, "zed-version", "", "the Zed version to check, defaults to the mirrored 'latest_release.json'")
+	compatCmd.Flags().BoolVar(&compatCmdConfig.json, "json", false, "print the report as JSON")
+	compatCmd.Flags().BoolVar(&compatCmdConfig.incompatibleOnly, "incompatible-only", false, "only list incompatible extensions")
+}
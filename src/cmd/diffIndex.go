@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"zedex/zed"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var diffIndexCmdConfig = struct {
+	outputDir              string
+	json                   bool
+	failOnRepositoryChange bool
+}{}
+
+var diffIndexCmd = &cobra.Command{
+	Use:   "diff-index [old.json] [new.json]",
+	Short: "Show added, removed and updated extensions between two extension indexes",
+	Long: `Show added, removed and updated extensions between two extension indexes.
+
+With two arguments both files are compared. With one argument, the file is compared to
+the upstream index, and without arguments the local index in --output-dir is compared
+to the upstream index. Extensions whose repository changed are flagged with "!!".`,
+	Args:   cobra.MaximumNArgs(2),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		zc := zed.NewZedClient(1)
+		oldFile := path.Join(diffIndexCmdConfig.outputDir, "extensions.json")
+		if len(args) > 0 {
+			oldFile = args[0]
+		}
+		before, err := zc.LoadExtensionIndex(oldFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var after zed.Extensions
+		if len(args) == 2 {
+			after, err = zc.LoadExtensionIndex(args[1])
+		} else {
+			after, err = zc.GetExtensionsIndex()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		diff := zed.DiffExtensionIndex(before, after)
+		if diffIndexCmdConfig.json {
+			diffJson, err := json.MarshalIndent(diff, "", "\t")
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println(string(diffJson))
+		} else {
+			fmt.Print(diff.String())
+		}
+
+		repositoryChanges := diff.RepositoryChanges()
+		for _, u := range repositoryChanges {
+			log.Warnf("(extension=%v) repository changed, verify the new owner before syncing", u.ID)
+		}
+		if diffIndexCmdConfig.failOnRepositoryChange && len(repositoryChanges) > 0 {
+			os.Exit(2)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffIndexCmd)
+	diffIndexCmd.Flags().StringVar(&diffIndexCmdConfig.outputDir, "output-dir", ".zedex-cache", "the directory of the local 'extensions.json', used when no old index is given")
+	diffIndexCmd.Flags().BoolVar(&diffIndexCmdConfig.json, "json", false, "print the diff as JSON")
+	diffIndexCmd.Flags().BoolVar(&diffIndexCmdConfig.failOnRepositoryChange, "fail-on-repository-change", false, "exit with status 2 if the repository of an existing extension changed")
+}
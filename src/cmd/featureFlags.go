@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"zedex/zed"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var featureFlagsCmdConfig = struct {
+	stateDir    string
+	user        string
+	json        bool
+	description string
+	everyone    bool
+	users       []string
+	groups      []string
+	percentage  int
+}{}
+
+var featureFlagsCmd = &cobra.Command{
+	Use:   "flags",
+	Short: "Manage the feature flags served to Zed, changes apply to a running server",
+}
+
+func flagStore() *zed.FlagStore {
+	flags, err := zed.NewFlagStore(path.Join(featureFlagsCmdConfig.stateDir, "flags.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return flags
+}
+
+var featureFlagsListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List the feature flags, or with --user the flags enabled for a user",
+	Args:   cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := flagStore()
+		if featureFlagsCmdConfig.user != "" {
+			users, err := zed.NewUserStore(path.Join(featureFlagsCmdConfig.stateDir, "users.json"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			user, ok := users.Lookup(featureFlagsCmdConfig.user)
+			if !ok {
+				log.Fatalf("unknown user %q", featureFlagsCmdConfig.user)
+			}
+			for _, name := range flags.FlagsFor(user) {
+				fmt.Println(name)
+			}
+			return
+		}
+
+		all, err := flags.Flags()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if featureFlagsCmdConfig.json {
+			flagsJson, err := json.MarshalIndent(all, "", "\t")
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println(string(flagsJson))
+			return
+		}
+		for _, f := range all {
+			rules := []string{}
+			if f.Everyone {
+				rules = append(rules, "everyone")
+			}
+			if len(f.Users) > 0 {
+				rules = append(rules, "users="+strings.Join(f.Users, ","))
+			}
+			if len(f.Groups) > 0 {
+				rules = append(rules, "groups="+strings.Join(f.Groups, ","))
+			}
+			if f.Percentage > 0 {
+				rules = append(rules, fmt.Sprintf("%d%%", f.Percentage))
+			}
+			if len(rules) == 0 {
+				rules = append(rules, "disabled")
+			}
+			fmt.Printf("%-30s %s\n", f.Name, strings.Join(rules, " "))
+		}
+	},
+}
+
+var featureFlagsSetCmd = &cobra.Command{
+	Use:    "set <flag>",
+	Short:  "Create or replace a feature flag",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		flag := zed.FeatureFlag{
+			Name:        args[0],
+			Description: featureFlagsCmdConfig.description,
+			Everyone:    featureFlagsCmdConfig.everyone,
+			Users:       featureFlagsCmdConfig.users,
+			Groups:      featureFlagsCmdConfig.groups,
+			Percentage:  featureFlagsCmdConfig.percentage,
+		}
+		if err := flagStore().Set(flag); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("set flag %v", flag.Name)
+	},
+}
+
+var featureFlagsDeleteCmd = &cobra.Command{
+	Use:    "delete <flag>",
+	Short:  "Delete a feature flag, disabling it for everyone",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := flagStore().Delete(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("deleted flag %v", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(featureFlagsCmd)
+	featureFlagsCmd.PersistentFlags().StringVar(&featureFlagsCmdConfig.stateDir, "state-dir", ".zedex-state", "the directory where zedex keeps its state (users, ...)")
+
+	featureFlagsCmd.AddCommand(featureFlagsListCmd)
+	featureFlagsListCmd.Flags().StringVar(&featureFlagsCmdConfig.user, "user", "", "list the flags enabled for this user (ID or login)")
+	featureFlagsListCmd.Flags().BoolVar(&featureFlagsCmdConfig.json, "json", false, "print the flags as JSON")
+
+	featureFlagsCmd.AddCommand(featureFlagsSetCmd)
+	featureFlagsSetCmd.Flags().StringVar(&featureFlagsCmdConfig.description, "description", "", "what the flag is used for")
+	featureFlagsSetCmd.Flags().BoolVar(&featureFlagsCmdConfig.everyone, "everyone", false, "enable the flag for all users")
+	featureFlagsSetCmd.Flags().StringSliceVar(&featureFlagsCmdConfig.users, "user", []string{}, "enable the flag for these users (IDs or logins)")
+	featureFlagsSetCmd.Flags().StringSliceVar(&featureFlagsCmdConfig.groups, "group", []string{}, "enable the flag for members of these groups")
+	featureFlagsSetCmd.Flags().IntVar(&featureFlagsCmdConfig.percentage, "percentage", 0, "enable the flag for this share (0-100) of all users")
+
+	featureFlagsCmd.AddCommand(featureFlagsDeleteCmd)
+}
@@ -1,10 +1,6 @@
 package cmd
 
 import (
-	"os"
-	"path"
-
-	"zedex/utils"
 	"zedex/zed"
 
 	"github.com/remeh/sizedwaitgroup"
@@ -21,22 +17,22 @@ var getExtensionCmd = &cobra.Command{
 	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
 	Run: func(cmd *cobra.Command, args []string) {
 		zc := zed.NewZedClient(1)
+		zc.WithExtensionsLocalDir(getExtensionCmdConfig.outputDir)
 		swg := sizedwaitgroup.New(20)
 		for _, id := range args {
 			swg.Add()
 			go func() {
 				defer swg.Done()
 				log.Infof("(extension=%v) downloading", id)
-				bytes, err := zc.DownloadExtensionArchiveDefault(zed.Extension{ID: id})
+				extension := zed.Extension{ID: id}
+				bytes, err := zc.DownloadExtensionArchiveDefault(extension)
 				if err != nil {
-					log.Errorf("(extension=%v) %v", err.Error())
+					log.Errorf("(extension=%v) %v", id, err.Error())
 					return
 				}
 
-				utils.CreateDirIfNotExists(getExtensionCmdConfig.outputDir)
-				err = os.WriteFile(path.Join(getExtensionCmdConfig.outputDir, id+".tar.gz"), bytes, 0o644)
-				if err != nil {
-					log.Errorf("(extension=%v) %v", err.Error())
+				if err := zc.StoreExtensionArchive(extension, bytes); err != nil {
+					log.Errorf("(extension=%v) %v", id, err.Error())
 					return
 				}
 				log.Infof("(extension=%v) wrote %v bytes", id, len(bytes))
@@ -3,9 +3,7 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 
-	"zedex/utils"
 	"zedex/zed"
 
 	log "github.com/sirupsen/logrus"
@@ -26,20 +24,18 @@ var getExtensionIndexCmd = &cobra.Command{
 			log.Panic(err)
 		}
 
-		wrapped := extensions.AsWrapped()
-		extensionsJson, err := json.MarshalIndent(wrapped, "", "\t")
-		if err != nil {
-			log.Panic(err)
-		}
 		if getExtensionIndexCmdConfig.outputDir == "" {
-			fmt.Println(string(extensionsJson))
-		} else {
-			utils.CreateDirIfNotExists(getExtensionIndexCmdConfig.outputDir)
-			extensionsFilePath := getExtensionIndexCmdConfig.outputDir + "/extensions.json"
-			err := os.WriteFile(extensionsFilePath, extensionsJson, 0o644)
+			extensionsJson, err := json.MarshalIndent(extensions.AsWrapped(), "", "\t")
 			if err != nil {
 				log.Panic(err)
 			}
+			fmt.Println(string(extensionsJson))
+			return
+		}
+
+		zc.WithExtensionsLocalDir(getExtensionIndexCmdConfig.outputDir)
+		if err := zc.StoreExtensionIndex(extensions); err != nil {
+			log.Panic(err)
 		}
 	},
 }
@@ -3,9 +3,7 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 
-	"zedex/utils"
 	"zedex/zed"
 
 	log "github.com/sirupsen/logrus"
@@ -32,28 +30,17 @@ var getLatestReleaseCmd = &cobra.Command{
 			log.Panic(err)
 		}
 
-		latestReleaseJson, err := json.MarshalIndent(latestRelease, "", "\t")
-		if err != nil {
-			log.Panic(err)
-		}
-
-		latestReleaseNotesJson, err := json.MarshalIndent(latestReleaseNotes, "", "\t")
-		if err != nil {
-			log.Panic(err)
-		}
-
 		if getLatestReleaseCmdConfig.outputDir == "" {
+			latestReleaseJson, err := json.MarshalIndent(latestRelease, "", "\t")
+			if err != nil {
+				log.Panic(err)
+			}
 			fmt.Println(string(latestReleaseJson))
 			return
 		}
-		utils.CreateDirIfNotExists(getLatestReleaseCmdConfig.outputDir)
-		latestReleasePath := getLatestReleaseCmdConfig.outputDir + "/latest_release.json"
-		if err := os.WriteFile(latestReleasePath, latestReleaseJson, 0o644); err != nil {
-			log.Panic(err)
-		}
 
-		latestReleaseNotePath := getLatestReleaseCmdConfig.outputDir + "/latest_release_notes.json"
-		if err := os.WriteFile(latestReleaseNotePath, latestReleaseNotesJson, 0o644); err != nil {
+		zc.WithExtensionsLocalDir(getLatestReleaseCmdConfig.outputDir)
+		if err := zc.StoreLatestRelease(latestRelease, latestReleaseNotes); err != nil {
 			log.Panic(err)
 		}
 	},
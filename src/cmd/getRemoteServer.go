@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"zedex/zed"
+
+	"github.com/remeh/sizedwaitgroup"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var getRemoteServerCmdConfig = struct {
+	outputDir string
+	versions  []string
+	platforms []string
+}{}
+
+var getRemoteServerCmd = &cobra.Command{
+	Use:    "remote-server",
+	Short:  "Get zed-remote-server binaries (used for SSH remoting) from zed.dev",
+	Args:   cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		platforms := zed.RemoteServerPlatforms
+		if len(getRemoteServerCmdConfig.platforms) > 0 {
+			platforms = []zed.Platform{}
+			for _, s := range getRemoteServerCmdConfig.platforms {
+				p, err := zed.ParsePlatform(s)
+				if err != nil {
+					log.Fatal(err)
+				}
+				platforms = append(platforms, p)
+			}
+		}
+
+		versions := getRemoteServerCmdConfig.versions
+		if len(versions) == 0 {
+			versions = []string{""}
+		}
+
+		zc := zed.NewZedClient(1)
+		zc.WithExtensionsLocalDir(getRemoteServerCmdConfig.outputDir)
+		swg := sizedwaitgroup.New(4)
+		for _, version := range versions {
+			for _, p := range platforms {
+				swg.Add()
+				go func() {
+					defer swg.Done()
+					log.Infof("(remote-server=%v, version=%v) downloading", p, version)
+					bytes, v, err := zc.DownloadRemoteServer(version, p)
+					if err != nil {
+						log.Errorf("(remote-server=%v, version=%v) %v", p, version, err)
+						return
+					}
+					if err := zc.StoreRemoteServer(v.Version, p, bytes); err != nil {
+						log.Errorf("(remote-server=%v, version=%v) %v", p, v.Version, err)
+						return
+					}
+					log.Infof("(remote-server=%v, version=%v) wrote %v bytes", p, v.Version, len(bytes))
+				}()
+			}
+		}
+		swg.Wait()
+	},
+}
+
+func init() {
+	getCmd.AddCommand(getRemoteServerCmd)
+	getRemoteServerCmd.Flags().StringVar(&getRemoteServerCmdConfig.outputDir, "output-dir", ".zedex-cache", "output directory, binaries are written to <output-dir>/remote_server/<version>/")
+	getRemoteServerCmd.Flags().StringSliceVar(&getRemoteServerCmdConfig.versions, "version", []string{}, "Zed versions to mirror the remote server for, defaults to the latest release")
+	getRemoteServerCmd.Flags().StringSliceVar(&getRemoteServerCmdConfig.platforms, "platform", []string{}, "platforms to mirror as <os>-<arch>, defaults to all platforms published by zed.dev")
+}
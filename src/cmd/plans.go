@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"zedex/zed"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var plansCmdConfig = struct {
+	stateDir            string
+	json                bool
+	description         string
+	zedPlan             string
+	editPredictionLimit int
+	model               string
+}{}
+
+var plansCmd = &cobra.Command{
+	Use:   "plans",
+	Short: "Manage the plans admins assign to users, changes apply to a running server",
+}
+
+func planStore(stateDir string) *zed.PlanStore {
+	// The default limits are set by `zedex serve`, they don't matter for managing plans.
+	plans, err := zed.NewPlanStore(path.Join(stateDir, "plans.json"), zed.UsageLimits{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return plans
+}
+
+var plansListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List the plans",
+	Args:   cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		plans, err := planStore(plansCmdConfig.stateDir).Plans()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if plansCmdConfig.json {
+			plansJson, err := json.MarshalIndent(plans, "", "\t")
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Println(string(plansJson))
+			return
+		}
+		for _, p := range plans {
+			model := p.Model
+			if model == "" {
+				model = "default"
+			}
+			fmt.Printf("%-20s %-12s edit_predictions=%s model=%s\n", p.Name, p.ZedPlan,
+				zed.UsageLimitHeader(p.Limits.EditPredictions), model)
+		}
+	},
+}
+
+var plansSetCmd = &cobra.Command{
+	Use:    "set <plan>",
+	Short:  "Create or replace a plan",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		plan := zed.PlanDefinition{
+			Name:        args[0],
+			Description: plansCmdConfig.description,
+			ZedPlan:     plansCmdConfig.zedPlan,
+			Limits: zed.UsageLimits{
+				EditPredictions: plansCmdConfig.editPredictionLimit,
+			},
+			Model: plansCmdConfig.model,
+		}
+		if err := planStore(plansCmdConfig.stateDir).Set(plan); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("set plan %v", plan.Name)
+	},
+}
+
+var plansDeleteCmd = &cobra.Command{
+	Use:    "delete <plan>",
+	Short:  "Delete a plan, its users get the default plan",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := planStore(plansCmdConfig.stateDir).Delete(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("deleted plan %v", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(plansCmd)
+	plansCmd.PersistentFlags().StringVar(&plansCmdConfig.stateDir, "state-dir", ".zedex-state", "the directory where zedex keeps its state (users, ...)")
+
+	plansCmd.AddCommand(plansListCmd)
+	plansListCmd.Flags().BoolVar(&plansCmdConfig.json, "json", false, "print the plans as JSON")
+
+	plansCmd.AddCommand(plansSetCmd)
+	plansSetCmd.Flags().StringVar(&plansCmdConfig.description, "description", "", "who the plan is for")
+	plansSetCmd.Flags().StringVar(&plansCmdConfig.zedPlan, "zed-plan", "Free", "the plan Zed shows (Free, ZedPro or ZedProTrial)")
+	plansSetCmd.Flags().IntVar(&plansCmdConfig.editPredictionLimit, "edit-prediction-limit", 0, "edit predictions per user and month, unlimited if 0")
+	plansSetCmd.Flags().StringVar(&plansCmdConfig.model, "model", "", "the edit prediction model of the plan, the configured model if empty")
+
+	plansCmd.AddCommand(plansDeleteCmd)
+}
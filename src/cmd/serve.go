@@ -1,7 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
 
 	"zedex/zed"
 
@@ -11,12 +17,18 @@ import (
 
 var serveCmdConfig = struct {
 	outputDir            string
+	stateDir             string
 	port                 int
 	enableEditPrediction bool
 	enableLogin          bool
 	enableExtensionStore bool
 	enableReleases       bool
 	enableReleaseNotes   bool
+	syncInterval         time.Duration
+	syncConcurrency      int
+	syncRemoteServer     []string
+	loginProvider        string
+	editPredictionLimit  int
 }{}
 
 var serveCmd = &cobra.Command{
@@ -24,15 +36,43 @@ var serveCmd = &cobra.Command{
 	Args:   cobra.ExactArgs(0),
 	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
 	Run: func(cmd *cobra.Command, args []string) {
-		if !serveCmdConfig.enableLogin {
-			log.Fatalf("zedex does not support login forwarding yet")
+		if !serveCmdConfig.enableLogin && cmd.Flags().Changed("enable-edit-prediction") && serveCmdConfig.enableEditPrediction {
+			log.Fatalf("--enable-login=false forwards edit predictions too, as Zed gets its LLM tokens from the login server")
+		}
+		if !serveCmdConfig.enableLogin && cmd.Flags().Changed("login-provider") {
+			log.Fatalf("--enable-login=false forwards sign-in to ZED_HOST, --login-provider only applies to zedex's own login")
 		}
-		if !serveCmdConfig.enableEditPrediction {
-			log.Fatalf("zedex does not support edit prediction forwarding yet")
+		if serveCmdConfig.enableLogin && !serveCmdConfig.enableEditPrediction {
+			log.Fatalf("zedex does not support edit prediction forwarding with --enable-login yet")
 		}
 
 		zc := zed.NewZedClient(1)
 		zc.WithExtensionsLocalDir(serveCmdConfig.outputDir)
+		users, err := zed.NewUserStore(path.Join(serveCmdConfig.stateDir, "users.json"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		flags, err := zed.NewFlagStore(path.Join(serveCmdConfig.stateDir, "flags.json"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret := []byte(os.Getenv("ZEDEX_LLM_TOKEN_SECRET"))
+		if len(secret) == 0 {
+			secret, err = zed.LoadOrCreateSecret(path.Join(serveCmdConfig.stateDir, "llm_token.secret"))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		usage, err := zed.NewUsageStore(path.Join(serveCmdConfig.stateDir, "usage.json"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		plans, err := zed.NewPlanStore(path.Join(serveCmdConfig.stateDir, "plans.json"), zed.UsageLimits{
+			EditPredictions: serveCmdConfig.editPredictionLimit,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
 		api := zed.NewAPI(
 			serveCmdConfig.enableExtensionStore,
 			serveCmdConfig.enableLogin,
@@ -40,8 +80,91 @@ var serveCmd = &cobra.Command{
 			serveCmdConfig.enableReleases,
 			serveCmdConfig.enableReleaseNotes,
 			zc,
+			users,
+			flags,
+			zed.NewLLMTokens(secret),
+			usage,
+			plans,
 			serveCmdConfig.port)
 
+		repo, err := zed.OpenBoltRepository(path.Join(serveCmdConfig.stateDir, "collab.db"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer repo.Close()
+		channels, err := zed.NewChannelStore(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.WithChannels(channels)
+		contacts, err := zed.NewContactStore(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.WithContacts(contacts)
+		notifications, err := zed.NewNotificationStore(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.WithNotifications(notifications)
+		if liveKit := zed.LiveKitConfigFromEnv(); liveKit.URL != "" {
+			if liveKit.APIKey == "" || liveKit.APISecret == "" {
+				log.Fatalf("LIVEKIT_URL needs LIVEKIT_API_KEY and LIVEKIT_API_SECRET")
+			}
+			api.WithLiveKit(zed.NewLiveKitTokens(liveKit))
+		}
+
+		if !serveCmdConfig.enableLogin {
+			forwarder, err := zed.NewLoginForwarder(zc)
+			if err != nil {
+				log.Fatal(err)
+			}
+			api.WithLoginForwarder(forwarder)
+		} else {
+			switch serveCmdConfig.loginProvider {
+			case "anonymous":
+			case "oidc":
+				provider, err := zed.NewOIDCProvider(context.Background(), zed.OIDCConfigFromEnv())
+				if err != nil {
+					log.Fatalf("failed to set up OpenID Connect: %v", err)
+				}
+				api.WithOIDC(provider)
+			case "password":
+				passwords := zed.NewPasswordFile(path.Join(serveCmdConfig.stateDir, "users.htpasswd"))
+				users.WithIdentityCheck(passwords.CheckIdentity)
+				api.WithPasswords(passwords)
+			default:
+				log.Fatalf("unknown login provider %q", serveCmdConfig.loginProvider)
+			}
+		}
+
+		if serveCmdConfig.syncInterval > 0 {
+			platforms := []zed.Platform{}
+			for _, s := range serveCmdConfig.syncRemoteServer {
+				p, err := zed.ParsePlatform(s)
+				if err != nil {
+					log.Fatal(err)
+				}
+				platforms = append(platforms, p)
+			}
+			syncer := zed.NewSyncer(zc, serveCmdConfig.syncInterval).
+				WithConcurrency(serveCmdConfig.syncConcurrency).
+				WithRemoteServerPlatforms(platforms)
+			api.WithSyncer(syncer)
+			go syncer.Run(context.Background())
+		}
+
+		// Usage is saved in batches, save what is pending before exiting.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			if err := usage.Flush(); err != nil {
+				log.Errorf("failed to save usage: %v", err)
+			}
+			os.Exit(0)
+		}()
+
 		log.Infof("serving on %v", serveCmdConfig.port)
 		api.Router().Run(fmt.Sprintf(":%v", serveCmdConfig.port))
 	},
@@ -49,11 +172,17 @@ var serveCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(serveCmd)
-	serveCmd.Flags().BoolVar(&serveCmdConfig.enableLogin, "enable-login", true, "enable login requests, letting zedex manage them")
+	serveCmd.Flags().BoolVar(&serveCmdConfig.enableLogin, "enable-login", true, "enable login requests, letting zedex manage them, or forward them to ZED_HOST and ZED_API_HOST")
 	serveCmd.Flags().BoolVar(&serveCmdConfig.enableEditPrediction, "enable-edit-prediction", true, "enable edit prediction requests, letting zedex manage them")
 	serveCmd.Flags().BoolVar(&serveCmdConfig.enableExtensionStore, "enable-extension-store", true, "enable extension store requests, letting zedex manage them")
 	serveCmd.Flags().BoolVar(&serveCmdConfig.enableReleases, "enable-releases", true, "enable release update requests, letting zedex manage them")
 	serveCmd.Flags().BoolVar(&serveCmdConfig.enableReleaseNotes, "enable-release-notes", true, "enable release note requests, letting zedex manage them")
 	serveCmd.Flags().StringVar(&serveCmdConfig.outputDir, "output-dir", ".zedex-cache", "the directory where local artifacts (index and extensions) are located, ignored if local-mode=false")
+	serveCmd.Flags().StringVar(&serveCmdConfig.stateDir, "state-dir", ".zedex-state", "the directory where zedex keeps its state (users, ...)")
+	serveCmd.Flags().StringVar(&serveCmdConfig.loginProvider, "login-provider", "anonymous", "how users sign in: anonymous, password (accounts managed with `zedex users`) or oidc (configured through OIDC_* environment variables)")
+	serveCmd.Flags().IntVar(&serveCmdConfig.editPredictionLimit, "edit-prediction-limit", 0, "edit predictions per user and month, unlimited if 0")
 	serveCmd.Flags().IntVar(&serveCmdConfig.port, "port", 8080, "port to serve proxy on")
+	serveCmd.Flags().DurationVar(&serveCmdConfig.syncInterval, "sync-interval", 0, "refresh the extension index, extensions, latest release and release notes in the background at this interval (e.g. 6h), disabled if 0")
+	serveCmd.Flags().IntVar(&serveCmdConfig.syncConcurrency, "sync-concurrency", 20, "number of extensions to download concurrently during a sync")
+	serveCmd.Flags().StringSliceVar(&serveCmdConfig.syncRemoteServer, "sync-remote-server-platform", []string{}, "also sync the remote server binaries of the latest release for these platforms (<os>-<arch>)")
 }
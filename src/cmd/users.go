@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"zedex/zed"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var usersCmdConfig = struct {
+	stateDir string
+	plan     string
+	staff    bool
+}{}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Manage users, and the accounts of --login-provider=password",
+}
+
+func passwordFile() *zed.PasswordFile {
+	return zed.NewPasswordFile(path.Join(usersCmdConfig.stateDir, "users.htpasswd"))
+}
+
+// readPassword prompts for a password twice on a terminal, or reads a single line
+// when the password is piped in.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password), nil
+}
+
+var usersAddCmd = &cobra.Command{
+	Use:    "add <login>",
+	Short:  "Add an account, reading its password from stdin",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		passwords := passwordFile()
+		exists, err := passwords.Exists(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exists {
+			log.Fatalf("user %q already exists, use `zedex users passwd` to change its password", args[0])
+		}
+		password, err := readPassword()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := passwords.Set(args[0], password); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("added user %v", args[0])
+	},
+}
+
+var usersPasswdCmd = &cobra.Command{
+	Use:    "passwd <login>",
+	Short:  "Change the password of an account, reading it from stdin",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		passwords := passwordFile()
+		exists, err := passwords.Exists(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !exists {
+			log.Fatalf("unknown user %q", args[0])
+		}
+		password, err := readPassword()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := passwords.Set(args[0], password); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("changed the password of %v", args[0])
+	},
+}
+
+var usersRemoveCmd = &cobra.Command{
+	Use:    "remove <login>",
+	Short:  "Remove an account, signing it out of Zed",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := passwordFile().Remove(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("removed user %v", args[0])
+	},
+}
+
+var usersListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List the users that signed in",
+	Args:   cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, u := range userStore().Users() {
+			plan := u.Plan
+			if plan == "" {
+				plan = "default"
+			}
+			staff := ""
+			if u.Staff {
+				staff = "staff"
+			}
+			fmt.Printf("%-6d %-30s %-20s %s\n", u.ID, u.Login, plan, staff)
+		}
+	},
+}
+
+var usersSetCmd = &cobra.Command{
+	Use:    "set <user>",
+	Short:  "Change the plan or staff status of a user (ID or login)",
+	Args:   cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) { manageDefaultFlags() },
+	Run: func(cmd *cobra.Command, args []string) {
+		users := userStore()
+		user, ok := users.Lookup(args[0])
+		if !ok {
+			log.Fatalf("unknown user %q", args[0])
+		}
+		setPlan := cmd.Flags().Changed("plan")
+		if setPlan {
+			if _, ok := planStore(usersCmdConfig.stateDir).Get(usersCmdConfig.plan); !ok {
+				log.Fatalf("unknown plan %q", usersCmdConfig.plan)
+			}
+		}
+		setStaff := cmd.Flags().Changed("staff")
+		_, err := users.Update(user.ID, func(u *zed.UserRecord) {
+			if setPlan {
+				u.Plan = usersCmdConfig.plan
+			}
+			if setStaff {
+				u.Staff = usersCmdConfig.staff
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("updated user %v", user.Login)
+	},
+}
+
+func userStore() *zed.UserStore {
+	users, err := zed.NewUserStore(path.Join(usersCmdConfig.stateDir, "users.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return users
+}
+
+func init() {
+	rootCmd.AddCommand(usersCmd)
+	usersCmd.PersistentFlags().StringVar(&usersCmdConfig.stateDir, "state-dir", ".zedex-state", "the directory where zedex keeps its state (users, ...)")
+	usersCmd.AddCommand(usersAddCmd)
+	usersCmd.AddCommand(usersPasswdCmd)
+	usersCmd.AddCommand(usersRemoveCmd)
+	usersCmd.AddCommand(usersListCmd)
+	usersCmd.AddCommand(usersSetCmd)
+	usersSetCmd.Flags().StringVar(&usersCmdConfig.plan, "plan", "", "assign this plan, the default plan if empty")
+	usersSetCmd.Flags().BoolVar(&usersCmdConfig.staff, "staff", false, "mark the user as staff")
+}
@@ -0,0 +1,32 @@
+package zed
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth guards the admin API with the bearer token in ZEDEX_ADMIN_TOKEN. Without a
+// token configured, the admin API is disabled.
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error":   "Forbidden",
+				"message": "the admin API is disabled, set ZEDEX_ADMIN_TOKEN to enable it",
+			})
+			return
+		}
+
+		bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(401, gin.H{
+				"error":   "Unauthorized",
+				"message": "invalid admin token",
+			})
+			return
+		}
+		c.Next()
+	}
+}
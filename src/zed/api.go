@@ -2,6 +2,9 @@ package zed
 
 import (
 	"strings"
+	"time"
+
+	"zedex/utils"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,7 +16,21 @@ type API struct {
 	enableReleases       bool
 	enableReleaseNotes   bool
 	zedClient            Client
+	users                *UserStore
+	flags                *FlagStore
+	llmTokens            *LLMTokens
+	usage                *UsageStore
+	plans                *PlanStore
 	port                 int
+	syncer               *Syncer
+	oidc                 *OIDCProvider
+	passwords            *PasswordFile
+	loginForwarder       *LoginForwarder
+	channels             *ChannelStore
+	contacts             *ContactStore
+	notifications        *NotificationStore
+	liveKit              *LiveKitTokens
+	reconnectTimeout     time.Duration
 }
 
 func NewAPI(
@@ -23,10 +40,20 @@ func NewAPI(
 	enableReleases bool,
 	enableReleaseNotes bool,
 	zedClient Client,
+	users *UserStore,
+	flags *FlagStore,
+	llmTokens *LLMTokens,
+	usage *UsageStore,
+	plans *PlanStore,
 	port int,
 ) API {
 	return API{
 		zedClient:            zedClient,
+		users:                users,
+		flags:                flags,
+		llmTokens:            llmTokens,
+		usage:                usage,
+		plans:                plans,
 		port:                 port,
 		enableExtensionStore: enableExtensionStore,
 		enableLogin:          enableLogin,
@@ -36,6 +63,63 @@ func NewAPI(
 	}
 }
 
+// WithSyncer exposes the status of a background sync on /zedex/sync.
+func (api *API) WithSyncer(syncer *Syncer) *API {
+	api.syncer = syncer
+	return api
+}
+
+// WithOIDC signs users in through an OpenID Connect provider instead of anonymously.
+func (api *API) WithOIDC(provider *OIDCProvider) *API {
+	api.oidc = provider
+	return api
+}
+
+// WithPasswords signs users in with a login form backed by a password file instead of
+// anonymously.
+func (api *API) WithPasswords(passwords *PasswordFile) *API {
+	api.passwords = passwords
+	return api
+}
+
+// WithLoginForwarder passes sign-in, the user endpoints, edit predictions and the collab
+// connection through to zed.dev, for --enable-login=false.
+func (api *API) WithLoginForwarder(forwarder *LoginForwarder) *API {
+	api.loginForwarder = forwarder
+	return api
+}
+
+// WithChannels keeps channels, their members and chat in store instead of in memory.
+func (api *API) WithChannels(store *ChannelStore) *API {
+	api.channels = store
+	return api
+}
+
+// WithContacts keeps contacts and contact requests in store instead of in memory.
+func (api *API) WithContacts(store *ContactStore) *API {
+	api.contacts = store
+	return api
+}
+
+// WithNotifications keeps notifications in store instead of in memory.
+func (api *API) WithNotifications(store *NotificationStore) *API {
+	api.notifications = store
+	return api
+}
+
+// WithLiveKit gives calls audio and screen sharing through a LiveKit server.
+func (api *API) WithLiveKit(tokens *LiveKitTokens) *API {
+	api.liveKit = tokens
+	return api
+}
+
+// WithReconnectTimeout sets how long users who lost their connection stay in their room,
+// RECONNECT_TIMEOUT by default.
+func (api *API) WithReconnectTimeout(timeout time.Duration) *API {
+	api.reconnectTimeout = timeout
+	return api
+}
+
 func (api *API) Router() *gin.Engine {
 	router := gin.Default()
 	controller := NewController(
@@ -45,19 +129,44 @@ func (api *API) Router() *gin.Engine {
 		api.enableReleases,
 		api.enableReleaseNotes,
 		api.zedClient,
+		api.users,
+		api.flags,
+		api.llmTokens,
+		api.usage,
+		api.plans,
 		api.port,
 	)
+	controller.syncer = api.syncer
+	controller.oidc = api.oidc
+	controller.passwords = api.passwords
+	if api.channels != nil {
+		controller.rpcHandler.channels = api.channels
+	}
+	if api.contacts != nil {
+		controller.rpcHandler.contacts = api.contacts
+	}
+	if api.notifications != nil {
+		controller.rpcHandler.notifications = api.notifications
+	}
+	controller.rpcHandler.liveKit = api.liveKit
+	if api.reconnectTimeout > 0 {
+		controller.rpcHandler.reconnectTimeout = api.reconnectTimeout
+	}
 	router.GET("/extensions", controller.Extensions)
 	router.GET("/extensions/:id/download", controller.DownloadExtension)
 	router.GET("/extensions/:id/:version/download", controller.DownloadExtension)
 
-	router.GET("/releases/stable/latest/asset", controller.LatestVersion)
+	router.GET("/releases/:channel/:version/asset", controller.LatestVersion)
 
 	router.GET("/api/*path", func(c *gin.Context) {
 		if c.Request.URL.Path == "/api/releases/latest" && api.enableReleases {
 			controller.LatestVersion(c)
 			return
 		}
+		if strings.HasPrefix(c.Request.URL.Path, "/api/releases/stable/") && api.enableReleases {
+			controller.DownloadRemoteServer(c)
+			return
+		}
 		if strings.HasPrefix(c.Request.URL.Path, "/api/release_notes/v2/stable/") && api.enableReleaseNotes {
 			controller.LatestReleaseNotes(c)
 			return
@@ -66,23 +175,49 @@ func (api *API) Router() *gin.Engine {
 		// Redirect to zed.host if not /api/releases
 		c.Redirect(301, controller.zed.host+c.Request.URL.RequestURI())
 	})
-	router.GET("/native_app_signin", controller.NativeAppSignin)
-	router.GET("/native_app_signin_succeeded", controller.NativeAppSigninSucceeded)
-	router.GET("/rpc", controller.HandleRpcRequest)
-	router.GET("/handle-rpc", controller.HandleWebSocketRequest)
+	if fwd := api.loginForwarder; fwd != nil {
+		router.GET("/native_app_signin", fwd.Host)
+		router.GET("/native_app_signin_succeeded", fwd.Host)
+		router.GET("/rpc", fwd.Rpc(controller.baseURL()))
+		router.GET("/handle-rpc", fwd.HandleWebSocketRequest)
+		// Zed gets its LLM tokens from upstream, so only upstream can check them.
+		router.POST("/predict_edits/v2", fwd.API)
+		router.POST("/client/llm_tokens", fwd.API)
+		router.GET("/client/users/me", fwd.API)
+		router.POST("/client/terms_of_service/accept", fwd.API)
+	} else {
+		router.GET("/native_app_signin", controller.NativeAppSignin)
+		router.POST("/native_app_signin", controller.PasswordSignin)
+		router.GET("/native_app_signin/oidc/callback", controller.OIDCCallback)
+		router.GET("/native_app_signin_succeeded", controller.NativeAppSigninSucceeded)
+		router.GET("/rpc", controller.HandleRpcRequest)
+		router.GET("/handle-rpc", controller.HandleWebSocketRequest)
+
+		router.POST("/predict_edits/v2", controller.HandleEditPredictRequest)
+
+		router.POST("/client/llm_tokens", controller.CreateLLMToken)
+		router.GET("/client/users/me", controller.AuthenticatedUser)
+		router.POST("/client/terms_of_service/accept", controller.AcceptTermsOfService)
+	}
 	router.GET("/favicon.ico", func(c *gin.Context) {
 		c.String(200, "plain/text", "")
 	})
 
-	router.POST("/predict_edits/v2", controller.HandleEditPredictRequest)
+	router.GET("/account", controller.Account)
 
-	router.POST("/client/llm_tokens", func(c *gin.Context) {
-		c.JSON(200, NewLLMToken())
-	})
-	router.GET("/client/users/me", func(c *gin.Context) {
-		c.JSON(200, NewGetAuthenticatedUsersResponse())
-	})
+	router.GET("/zedex/sync", controller.SyncStatus)
+	router.GET("/zedex/changes.atom", controller.ChangesAtom)
+	router.GET("/zedex/changes.json", controller.ChangesJSON)
 
-	router.GET("/account", controller.Account)
+	admin := router.Group("/zedex/admin", adminAuth(utils.EnvWithFallback("ZEDEX_ADMIN_TOKEN", "")))
+	admin.GET("/compat", controller.Compat)
+	admin.GET("/flags", controller.FeatureFlags)
+	admin.PUT("/flags/:name", controller.SetFeatureFlag)
+	admin.DELETE("/flags/:name", controller.DeleteFeatureFlag)
+	admin.GET("/plans", controller.Plans)
+	admin.PUT("/plans/:name", controller.SetPlan)
+	admin.DELETE("/plans/:name", controller.DeletePlan)
+	admin.GET("/users", controller.Users)
+	admin.PATCH("/users/:user", controller.UpdateUser)
 	return router
 }
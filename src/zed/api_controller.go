@@ -6,9 +6,10 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"math"
-	mrand "math/rand"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
@@ -18,11 +19,22 @@ import (
 	"zedex/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	DEVICE_COOKIE  = "zedex_device"
+	SESSION_COOKIE = "zedex_session"
+)
+
 type Controller struct {
 	zed                  Client
+	users                *UserStore
+	flags                *FlagStore
+	llmTokens            *LLMTokens
+	usage                *UsageStore
+	plans                *PlanStore
 	llm                  *llm.OpenAIHost
 	port                 int
 	enableExtensionStore bool
@@ -32,7 +44,12 @@ type Controller struct {
 	enableReleaseNotes   bool
 
 	editPredictClient EditPredictClient
-	rpcHandler        RpcHandler
+	// modelEditPredictClients are the clients of plans with their own model.
+	modelEditPredictClients utils.ConcurrentMap[string, *EditPredictClient]
+	rpcHandler              RpcHandler
+	syncer                  *Syncer
+	oidc                    *OIDCProvider
+	passwords               *PasswordFile
 }
 
 func NewController(
@@ -42,6 +59,11 @@ func NewController(
 	enableReleases bool,
 	enableReleaseNotes bool,
 	zedClient Client,
+	users *UserStore,
+	flags *FlagStore,
+	llmTokens *LLMTokens,
+	usage *UsageStore,
+	plans *PlanStore,
 	port int,
 ) Controller {
 	_, envExists := os.LookupEnv("OPENAI_COMPATIBLE_API_KEY")
@@ -59,15 +81,21 @@ RULES:
 * YOU MAY ALTER ALL CODE CONTAINED WITHIN "<|editable_region_start|>" AND "<|editable_region_end|>".
 * ALWAYS AUTO COMPLETE AS LITTLE AS POSSIBLE`))
 	return Controller{
-		zed:                  zedClient,
-		enableExtensionStore: enableExtensionStore,
-		enableLogin:          enableLogin,
-		enableEditPrediction: enableEditPrediction,
-		enableReleases:       enableReleases,
-		enableReleaseNotes:   enableReleaseNotes,
-		port:                 port,
-		editPredictClient:    NewEditPredictClient(*oai),
-		rpcHandler:           NewRpcHandler(),
+		zed:                     zedClient,
+		users:                   users,
+		flags:                   flags,
+		llmTokens:               llmTokens,
+		usage:                   usage,
+		plans:                   plans,
+		enableExtensionStore:    enableExtensionStore,
+		enableLogin:             enableLogin,
+		enableEditPrediction:    enableEditPrediction,
+		enableReleases:          enableReleases,
+		enableReleaseNotes:      enableReleaseNotes,
+		port:                    port,
+		editPredictClient:       NewEditPredictClient(*oai),
+		modelEditPredictClients: utils.NewConcurrentMap[string, *EditPredictClient](),
+		rpcHandler:              NewRpcHandler(users, flags, llmTokens, usage, plans),
 	}
 }
 
@@ -158,7 +186,40 @@ func (co *Controller) DownloadExtension(c *gin.Context) {
 	c.Data(200, "application/octet-stream", bytes)
 }
 
+func (co *Controller) baseURL() string {
+	return utils.EnvWithFallback("BASE_URL", fmt.Sprintf("http://127.0.0.1:%v", co.port))
+}
+
+// releaseParams returns the release channel and version a request asks for, the latest
+// stable release for /api/releases/latest.
+func releaseParams(c *gin.Context) (channel, version string) {
+	channel, version = c.Param("channel"), c.Param("version")
+	if channel == "" {
+		channel = "stable"
+	}
+	if version == "" {
+		version = "latest"
+	}
+	return channel, version
+}
+
 func (co *Controller) LatestVersion(c *gin.Context) {
+	if c.Query("asset") == REMOTE_SERVER_ASSET {
+		co.RemoteServerRelease(c)
+		return
+	}
+
+	// Only the latest stable release is known, older clients and other channels must
+	// not be told to install it.
+	channel, version := releaseParams(c)
+	if channel != "stable" {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("no %v releases are served", channel),
+		})
+		return
+	}
+
 	var v Version
 	var err error
 	if co.enableReleases {
@@ -176,10 +237,135 @@ func (co *Controller) LatestVersion(c *gin.Context) {
 		})
 		return
 	}
+	if version != "latest" && version != v.Version {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("release %v is not served", version),
+		})
+		return
+	}
 
 	c.JSON(200, v)
 }
 
+// RemoteServerRelease resolves a remote server release for the requested platform.
+// Mirrored releases point back at zedex, so SSH remoting works without zed.dev.
+func (co *Controller) RemoteServerRelease(c *gin.Context) {
+	p := Platform{OS: c.Query("os"), Arch: c.Query("arch")}
+	channel, version := releaseParams(c)
+	if channel != "stable" && channel != "preview" {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("unknown release channel %q", channel),
+		})
+		return
+	}
+
+	if !co.enableReleases {
+		var v Version
+		var err error
+		if version == "latest" && channel == "stable" {
+			v, err = co.zed.GetLatestRelease(REMOTE_SERVER_ASSET, p)
+		} else if version == "latest" {
+			c.JSON(404, gin.H{
+				"error":   "Not Found",
+				"message": fmt.Sprintf("no latest %v remote server is known", channel),
+			})
+			return
+		} else {
+			// The remote server must match the version of the client.
+			v, err = co.zed.RemoteServerRelease(channel, version, p)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(404, gin.H{
+				"error":   "Not Found",
+				"message": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			logrus.Error(err)
+			c.JSON(500, gin.H{
+				"error":   "Internal Server Error",
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, v)
+		return
+	}
+
+	// Only stable releases are mirrored.
+	if channel != "stable" {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("no %v remote server mirrored for %v", channel, p),
+		})
+		return
+	}
+	var err error
+	if version == "latest" {
+		version, err = co.zed.LatestLocalRemoteServerVersion(p)
+	} else {
+		_, err = co.zed.RemoteServerFile(version, p)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("no remote server mirrored for %v", p),
+		})
+		return
+	}
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, Version{
+		Version: version,
+		URL:     fmt.Sprintf("%s/api/releases/stable/%s/%s", co.baseURL(), version, RemoteServerFileName(p)),
+	})
+}
+
+// DownloadRemoteServer serves /api/releases/stable/<version>/zed-remote-server-<os>-<arch>.gz
+// from the local mirror.
+func (co *Controller) DownloadRemoteServer(c *gin.Context) {
+	version, fileName := path.Split(strings.TrimPrefix(c.Request.URL.Path, "/api/releases/stable/"))
+	version = strings.TrimSuffix(version, "/")
+	p, ok := ParseRemoteServerFileName(fileName)
+	if !ok {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("unknown release asset %q", fileName),
+		})
+		return
+	}
+
+	filePath, err := co.zed.RemoteServerFile(version, p)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("remote server %v is not mirrored for %v", version, p),
+		})
+		return
+	}
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Type", "application/gzip")
+	c.File(filePath)
+}
+
 func (co *Controller) LatestReleaseNotes(c *gin.Context) {
 	var v ReleaseNotes
 	var err error
@@ -202,6 +388,272 @@ func (co *Controller) LatestReleaseNotes(c *gin.Context) {
 	c.JSON(200, v)
 }
 
+func (co *Controller) SyncStatus(c *gin.Context) {
+	if co.syncer == nil {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": "sync is disabled, start zedex with --sync-interval to enable it",
+		})
+		return
+	}
+
+	c.JSON(200, co.syncer.Status())
+}
+
+// changes reads the change journal, filtered by the "since" and "limit" query parameters.
+func (co *Controller) changes(c *gin.Context) ([]Change, bool) {
+	since, err := ParseSince(c.Query("since"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return nil, false
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": "limit must be a positive integer",
+		})
+		return nil, false
+	}
+
+	changes, err := co.zed.ChangeJournal().Since(since)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return nil, false
+	}
+	return changes[:min(limit, len(changes))], true
+}
+
+func (co *Controller) ChangesAtom(c *gin.Context) {
+	changes, ok := co.changes(c)
+	if !ok {
+		return
+	}
+	feed, err := xml.MarshalIndent(NewAtomFeed(co.baseURL()+c.Request.URL.Path, changes), "", "\t")
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.Data(200, "application/atom+xml; charset=utf-8", append([]byte(xml.Header), feed...))
+}
+
+func (co *Controller) ChangesJSON(c *gin.Context) {
+	changes, ok := co.changes(c)
+	if !ok {
+		return
+	}
+	c.JSON(200, NewJSONFeed(co.baseURL()+c.Request.URL.Path, changes))
+}
+
+// Compat reports which mirrored extensions the Zed version in ?zed_version= (default:
+// the mirrored latest release) can load.
+func (co *Controller) Compat(c *gin.Context) {
+	report, err := co.zed.CompatReport(c.Query("zed_version"))
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if c.Query("incompatible_only") == "true" {
+		report = report.IncompatibleOnly()
+	}
+	c.JSON(200, report)
+}
+
+// FeatureFlags lists the feature flags, or with ?user=<id or login> the flags enabled
+// for a user.
+func (co *Controller) FeatureFlags(c *gin.Context) {
+	if q := c.Query("user"); q != "" {
+		user, ok := co.users.Lookup(q)
+		if !ok {
+			c.JSON(404, gin.H{
+				"error":   "Not Found",
+				"message": fmt.Sprintf("unknown user %q", q),
+			})
+			return
+		}
+		c.JSON(200, gin.H{"user_id": user.ID, "login": user.Login, "flags": co.flags.FlagsFor(user)})
+		return
+	}
+
+	flags, err := co.flags.Flags()
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, flags)
+}
+
+func (co *Controller) SetFeatureFlag(c *gin.Context) {
+	var flag FeatureFlag
+	if err := c.ShouldBindJSON(&flag); err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return
+	}
+	flag.Name = c.Param("name")
+	if err := co.flags.Set(flag); err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, flag)
+}
+
+func (co *Controller) DeleteFeatureFlag(c *gin.Context) {
+	if err := co.flags.Delete(c.Param("name")); err != nil {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.Status(204)
+}
+
+func (co *Controller) Plans(c *gin.Context) {
+	plans, err := co.plans.Plans()
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, plans)
+}
+
+func (co *Controller) SetPlan(c *gin.Context) {
+	var plan PlanDefinition
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return
+	}
+	plan.Name = c.Param("name")
+	if err := co.plans.Set(plan); err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return
+	}
+	plan, _ = co.plans.Get(plan.Name)
+	c.JSON(200, plan)
+}
+
+func (co *Controller) DeletePlan(c *gin.Context) {
+	if err := co.plans.Delete(c.Param("name")); err != nil {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.Status(204)
+}
+
+// adminUser is a user as shown to admins, without access tokens.
+type adminUser struct {
+	UserRecord
+	AccessTokens []AccessToken `json:"access_tokens,omitempty"`
+}
+
+func newAdminUser(user UserRecord) adminUser {
+	return adminUser{UserRecord: user}
+}
+
+func (co *Controller) Users(c *gin.Context) {
+	users := []adminUser{}
+	for _, user := range co.users.Users() {
+		users = append(users, newAdminUser(user))
+	}
+	c.JSON(200, users)
+}
+
+// UpdateUserRequest changes the plan or staff status of a user, nil fields are unchanged.
+type UpdateUserRequest struct {
+	Plan  *string `json:"plan"`
+	Staff *bool   `json:"staff"`
+}
+
+func (co *Controller) UpdateUser(c *gin.Context) {
+	user, ok := co.users.Lookup(c.Param("user"))
+	if !ok {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": fmt.Sprintf("unknown user %q", c.Param("user")),
+		})
+		return
+	}
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": err.Error(),
+		})
+		return
+	}
+	if req.Plan != nil {
+		if _, ok := co.plans.Get(*req.Plan); !ok {
+			c.JSON(400, gin.H{
+				"error":   "Bad Request",
+				"message": fmt.Sprintf("unknown plan %q", *req.Plan),
+			})
+			return
+		}
+	}
+
+	updated, err := co.users.Update(user.ID, func(u *UserRecord) {
+		if req.Plan != nil {
+			u.Plan = *req.Plan
+		}
+		if req.Staff != nil {
+			u.Staff = *req.Staff
+		}
+	})
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if updated.Plan != user.Plan {
+		if err := co.rpcHandler.UserPlanChanged(updated); err != nil {
+			logrus.Errorf("failed to send the new plan of user %v: %v", updated.ID, err)
+		}
+	}
+	c.JSON(200, newAdminUser(updated))
+}
+
 // v1 is a reference to rusts rsa crate
 func encryptStringV1(base64PublicKey, plaintext string) (string, error) {
 	pubKeyBytes, err := base64.URLEncoding.DecodeString(base64PublicKey)
@@ -239,7 +691,164 @@ func (co *Controller) NativeAppSignin(c *gin.Context) {
 	portStr := c.Query("native_app_port")
 	pubKey := c.Query("native_app_public_key")
 
-	enc, err := encryptStringV1(pubKey, "a")
+	if co.oidc != nil {
+		url, err := co.oidc.AuthCodeURL(co.baseURL()+"/native_app_signin/oidc/callback", portStr, pubKey)
+		if err != nil {
+			logrus.Error(err)
+			c.JSON(500, gin.H{
+				"error":   "Internal Server Error",
+				"message": err.Error(),
+			})
+			return
+		}
+		c.Redirect(302, url)
+		return
+	}
+	if co.passwords != nil {
+		renderPage(c, 200, pageData{Page: "login", NativeAppPort: portStr, NativeAppPublicKey: pubKey})
+		return
+	}
+
+	// Anonymous users are tied to the browser they sign in with, so signing in again
+	// from the same browser keeps the same user.
+	deviceID, err := c.Cookie(DEVICE_COOKIE)
+	if err != nil || deviceID == "" {
+		deviceID = uuid.New().String()
+	}
+	co.setCookie(c, DEVICE_COOKIE, deviceID, 10*365*24*60*60)
+
+	user, err := co.users.Resolve("device:"+deviceID, UserProfile{})
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	co.completeNativeAppSignin(c, user, portStr, pubKey)
+}
+
+// PasswordSignin handles the login form shown by NativeAppSignin.
+func (co *Controller) PasswordSignin(c *gin.Context) {
+	if co.passwords == nil {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": "password login is not enabled",
+		})
+		return
+	}
+	login := c.PostForm("login")
+	data := pageData{
+		Page:               "login",
+		Login:              login,
+		NativeAppPort:      c.PostForm("native_app_port"),
+		NativeAppPublicKey: c.PostForm("native_app_public_key"),
+	}
+
+	ok, err := co.passwords.Verify(login, c.PostForm("password"))
+	if err != nil {
+		logrus.Error(err)
+		data.Error = "Sign in failed, try again later."
+		renderPage(c, 500, data)
+		return
+	}
+	if !ok {
+		logrus.Warnf("failed sign in for %q from %v", login, c.ClientIP())
+		data.Error = "Invalid username or password."
+		renderPage(c, 401, data)
+		return
+	}
+
+	user, err := co.users.Resolve(PASSWORD_IDENTITY_PREFIX+login, UserProfile{Login: login})
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	co.completeNativeAppSignin(c, user, data.NativeAppPort, data.NativeAppPublicKey)
+}
+
+// OIDCCallback completes a sign in through the OpenID Connect provider, which redirects
+// here after the user authenticated.
+func (co *Controller) OIDCCallback(c *gin.Context) {
+	if co.oidc == nil {
+		c.JSON(404, gin.H{
+			"error":   "Not Found",
+			"message": "OpenID Connect is not enabled",
+		})
+		return
+	}
+	if errMsg := c.Query("error"); errMsg != "" {
+		c.JSON(403, gin.H{
+			"error":   "Forbidden",
+			"message": fmt.Sprintf("%v: %v", errMsg, c.Query("error_description")),
+		})
+		return
+	}
+
+	identity, login, err := co.oidc.Exchange(c.Request.Context(), co.baseURL()+"/native_app_signin/oidc/callback", c.Query("state"), c.Query("code"))
+	if err != nil {
+		logrus.Warnf("oidc sign in failed: %v", err)
+		c.JSON(403, gin.H{
+			"error":   "Forbidden",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	user, err := co.users.Resolve(identity.Identity, identity.Profile)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	co.completeNativeAppSignin(c, user, login.nativeAppPort, login.nativeAppPublicKey)
+}
+
+// completeNativeAppSignin issues an access token for the user, encrypted with the
+// public key of the Zed instance, and redirects to the local server Zed listens on.
+func (co *Controller) completeNativeAppSignin(c *gin.Context, user UserRecord, portStr, pubKey string) {
+	if _, err := strconv.Atoi(portStr); err != nil {
+		c.JSON(400, gin.H{
+			"error":   "Bad Request",
+			"message": "native_app_port must be an integer",
+		})
+		return
+	}
+
+	token, err := co.users.IssueAccessToken(user.ID)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	enc, err := encryptStringV1(pubKey, token)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// The browser gets a token of its own for the account pages, a cookie that leaks
+	// doesn't open the API.
+	session, err := co.users.IssueSessionToken(user.ID)
 	if err != nil {
 		logrus.Error(err)
 		c.JSON(500, gin.H{
@@ -248,41 +857,133 @@ func (co *Controller) NativeAppSignin(c *gin.Context) {
 		})
 		return
 	}
+	co.setCookie(c, SESSION_COOKIE, fmt.Sprintf("%d %s", user.ID, session), 30*24*60*60)
 
 	// user_id must be numeric, possibly a reference to github id
 	// https://api.github.com/users/<user>
-	uid := mrand.Intn(math.MaxInt)
-	host := fmt.Sprintf("http://127.0.0.1:%s/native_app_signin?user_id=%v&access_token=%s", portStr, uid, enc)
+	host := fmt.Sprintf("http://127.0.0.1:%s/native_app_signin?user_id=%v&access_token=%s", portStr, user.ID, enc)
 	c.Redirect(302, host)
 }
 
+// setCookie sets an HTTP-only cookie for the whole site, only sent over HTTPS if zedex
+// is served over it, and not with requests from other sites but links to zedex.
+func (co *Controller) setCookie(c *gin.Context, name, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, "/", "", strings.HasPrefix(co.baseURL(), "https://"), true)
+}
+
+// sessionUser returns the user signed in from this browser, if any.
+func (co *Controller) sessionUser(c *gin.Context) *UserRecord {
+	session, err := c.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+	user, err := co.users.AuthenticateSession(session)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
 func (co *Controller) NativeAppSigninSucceeded(c *gin.Context) {
-	c.Data(200,
-		"text/html; charset=utf-8",
-		[]byte(`<html>
-		<body style="background-color: #1e1e2e; color: #ffffff; text-align: center; display: flex; justify-content: center; align-items: center">
-			<p>You should now be signed into Zed. You can close this tab.</p>
-		</body>
-		</html>`,
-		),
-	)
+	renderPage(c, 200, pageData{Page: "signed_in", User: co.sessionUser(c)})
 }
 
 func (co *Controller) Account(c *gin.Context) {
-	c.Data(200,
-		"text/html; charset=utf-8",
-		[]byte(`<html>
-		<body style="background-color: #1e1e2e; color: #ffffff; text-align: center; display: flex; justify-content: center; align-items: center">
-			<p>You are logged in anonymously with Zedex.</p>
-		</body>
-		</html>`,
-		),
-	)
+	renderPage(c, 200, pageData{Page: "account", User: co.sessionUser(c)})
+}
+
+// AuthenticatedUser returns the signed in user to Zed.
+func (co *Controller) AuthenticatedUser(c *gin.Context) {
+	user, ok := co.authenticate(c)
+	if !ok {
+		return
+	}
+	usage, period := co.usage.Usage(user.ID)
+	c.JSON(200, NewGetAuthenticatedUsersResponse(user, co.plans.For(user), co.flags.FlagsFor(user), usage, period))
+}
+
+func (co *Controller) AcceptTermsOfService(c *gin.Context) {
+	user, ok := co.authenticate(c)
+	if !ok {
+		return
+	}
+	user, err := co.users.AcceptTermsOfService(user.ID)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, AcceptTermsOfServiceResponse{User: user.AuthenticatedUser()})
+}
+
+// CreateLLMToken issues a token for the LLM endpoints to the signed in user.
+func (co *Controller) CreateLLMToken(c *gin.Context) {
+	user, ok := co.authenticate(c)
+	if !ok {
+		return
+	}
+	token, err := co.llmTokens.Issue(user)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(500, gin.H{
+			"error":   "Internal Server Error",
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, NewLLMToken(token))
+}
+
+// authenticateLLM verifies the LLM token Zed sends to the LLM endpoints, and aborts with
+// 401 if it is invalid. Expired tokens are flagged, so Zed fetches a new one and retries.
+func (co *Controller) authenticateLLM(c *gin.Context) (UserRecord, bool) {
+	claims, err := co.llmTokens.VerifyHeader(c.GetHeader("Authorization"))
+	if errors.Is(err, ErrLLMTokenExpired) {
+		c.Header(EXPIRED_LLM_TOKEN_HEADER, "true")
+	}
+	var user UserRecord
+	if err == nil {
+		id, _ := claims.UserID()
+		var ok bool
+		if user, ok = co.users.Get(id); !ok {
+			err = fmt.Errorf("unknown user %v", claims.Subject)
+		}
+	}
+	if err != nil {
+		logrus.Debug(err)
+		c.AbortWithStatusJSON(401, gin.H{
+			"error":   "Unauthorized",
+			"message": "invalid llm token",
+		})
+		return UserRecord{}, false
+	}
+	return user, true
+}
+
+// authenticate verifies the "<user id> <access token>" Authorization header Zed sends,
+// and aborts with 401 if it is invalid.
+func (co *Controller) authenticate(c *gin.Context) (UserRecord, bool) {
+	user, err := co.users.Authenticate(c.GetHeader("Authorization"))
+	if err != nil {
+		logrus.Debug(err)
+		c.AbortWithStatusJSON(401, gin.H{
+			"error":   "Unauthorized",
+			"message": "invalid credentials, sign in again",
+		})
+		return UserRecord{}, false
+	}
+	return user, true
 }
 
 func (co *Controller) HandleRpcRequest(c *gin.Context) {
-	baseURL := utils.EnvWithFallback("BASE_URL", fmt.Sprintf("http://127.0.0.1:%v", co.port))
-	location := fmt.Sprintf("%s/handle-rpc", baseURL)
+	if _, ok := co.authenticate(c); !ok {
+		return
+	}
+	location := fmt.Sprintf("%s/handle-rpc", co.baseURL())
 	c.Redirect(301, location)
 }
 
@@ -292,6 +993,11 @@ func (co *Controller) HandleWebSocketRequest(c *gin.Context) {
 }
 
 func (co *Controller) HandleEditPredictRequest(c *gin.Context) {
+	user, ok := co.authenticateLLM(c)
+	if !ok {
+		return
+	}
+
 	epr := EditPredictRequest{}
 	if err := c.ShouldBindJSON(&epr); err != nil {
 		logrus.Error(err)
@@ -299,12 +1005,56 @@ func (co *Controller) HandleEditPredictRequest(c *gin.Context) {
 		return
 	}
 
-	resp, err := co.editPredictClient.HandleRequest(epr)
+	// The prediction is counted before it is made, so concurrent requests can't exceed
+	// the limit, and refunded if it fails.
+	plan := co.plans.For(user)
+	limit := plan.Limits.EditPredictions
+	usage, err := co.usage.Consume(user.ID, USAGE_EDIT_PREDICTIONS, limit)
+	c.Header(EDIT_PREDICTIONS_USAGE_LIMIT_HEADER, UsageLimitHeader(limit))
+	if errors.Is(err, ErrUsageLimitReached) {
+		c.Header(EDIT_PREDICTIONS_USAGE_AMOUNT_HEADER, strconv.Itoa(usage.EditPredictions))
+		c.Header(SUBSCRIPTION_LIMIT_RESOURCE_HEADER, USAGE_EDIT_PREDICTIONS)
+		c.JSON(403, gin.H{"error": "edit prediction limit reached"})
+		return
+	}
 	if err != nil {
 		logrus.Error(err)
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
+	resp, err := co.editPredictClientFor(plan.Model).HandleRequest(epr)
+	if err != nil {
+		logrus.Error(err)
+		if _, err := co.usage.Refund(user.ID, USAGE_EDIT_PREDICTIONS); err != nil {
+			logrus.Error(err)
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := co.rpcHandler.UsageChanged(user); err != nil {
+		logrus.Error(err)
+	}
+	c.Header(EDIT_PREDICTIONS_USAGE_AMOUNT_HEADER, strconv.Itoa(usage.EditPredictions))
 	c.JSON(200, resp)
 }
+
+// editPredictClientFor returns the client of a model, the configured model if empty.
+// Each model has its own client, so cached predictions aren't shared between models.
+func (co *Controller) editPredictClientFor(model string) *EditPredictClient {
+	if model == "" || model == co.editPredictClient.OpenAIHost.Model {
+		return &co.editPredictClient
+	}
+	var client *EditPredictClient
+	co.modelEditPredictClients.Transaction(func(m map[string]*EditPredictClient) map[string]*EditPredictClient {
+		if _, ok := m[model]; !ok {
+			oai := co.editPredictClient.OpenAIHost
+			epc := NewEditPredictClient(*oai.WithModel(model))
+			m[model] = &epc
+		}
+		client = m[model]
+		return m
+	})
+	return client
+}
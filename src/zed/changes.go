@@ -0,0 +1,167 @@
+package zed
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CHANGE_KIND_EXTENSION = "extension"
+	CHANGE_KIND_RELEASE   = "release"
+
+	CHANGE_ADDED   = "added"
+	CHANGE_UPDATED = "updated"
+	CHANGE_REMOVED = "removed"
+)
+
+// Change is a single entry of the change journal.
+type Change struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Kind       string    `json:"kind"`
+	Action     string    `json:"action"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	OldVersion string    `json:"old_version,omitempty"`
+	NewVersion string    `json:"new_version,omitempty"`
+}
+
+func (ch Change) Title() string {
+	kind := strings.ToUpper(ch.Kind[:1]) + ch.Kind[1:]
+	switch ch.Action {
+	case CHANGE_ADDED:
+		return fmt.Sprintf("%s %s %s added", kind, ch.Name, ch.NewVersion)
+	case CHANGE_REMOVED:
+		return fmt.Sprintf("%s %s %s removed", kind, ch.Name, ch.OldVersion)
+	default:
+		return fmt.Sprintf("%s %s updated from %s to %s", kind, ch.Name, ch.OldVersion, ch.NewVersion)
+	}
+}
+
+// DiffExtensions lists the extensions added, updated (new version) and removed between
+// two index snapshots, ordered by extension ID.
+func DiffExtensions(before, after Extensions) []Change {
+	diff := DiffExtensionIndex(before, after)
+	changes := []Change{}
+	for _, ext := range diff.Added {
+		changes = append(changes, Change{Kind: CHANGE_KIND_EXTENSION, Action: CHANGE_ADDED, ID: ext.ID, Name: ext.Name, NewVersion: ext.Version})
+	}
+	for _, ext := range diff.Removed {
+		changes = append(changes, Change{Kind: CHANGE_KIND_EXTENSION, Action: CHANGE_REMOVED, ID: ext.ID, Name: ext.Name, OldVersion: ext.Version})
+	}
+	for _, u := range diff.Updated {
+		for _, fc := range u.Changes {
+			if fc.Field == "version" {
+				changes = append(changes, Change{Kind: CHANGE_KIND_EXTENSION, Action: CHANGE_UPDATED, ID: u.ID, Name: u.Name, OldVersion: fc.Old, NewVersion: fc.New})
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+	return changes
+}
+
+// DiffVersions returns a change if the latest Zed release differs between two snapshots.
+func DiffVersions(before, after Version) []Change {
+	if before.Version == after.Version {
+		return []Change{}
+	}
+	return []Change{{Kind: CHANGE_KIND_RELEASE, Action: CHANGE_UPDATED, ID: "zed", Name: "Zed", OldVersion: before.Version, NewVersion: after.Version}}
+}
+
+// ChangeJournal is an append-only JSON lines file of changes to the mirror.
+type ChangeJournal struct {
+	path string
+}
+
+func NewChangeJournal(path string) ChangeJournal {
+	return ChangeJournal{path: path}
+}
+
+// ChangeJournal returns the journal kept in the local directory.
+func (c *Client) ChangeJournal() ChangeJournal {
+	return NewChangeJournal(path.Join(c.extensionsLocalDir, "changes.jsonl"))
+}
+
+// Append timestamps and appends changes to the journal in a single write.
+func (j ChangeJournal) Append(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	var sb strings.Builder
+	for _, ch := range changes {
+		ch.Timestamp = now
+		b, err := json.Marshal(ch)
+		if err != nil {
+			return err
+		}
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(sb.String())
+	return err
+}
+
+// Since returns the changes recorded after t, newest first. A missing journal has no
+// changes.
+func (j ChangeJournal) Since(t time.Time) ([]Change, error) {
+	changes := []Change{}
+	file, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return changes, nil
+	}
+	if err != nil {
+		return changes, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ch Change
+		if err := json.Unmarshal(scanner.Bytes(), &ch); err != nil {
+			return []Change{}, err
+		}
+		if ch.Timestamp.After(t) {
+			changes = append(changes, ch)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return []Change{}, err
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Timestamp.After(changes[j].Timestamp) })
+	return changes, nil
+}
+
+// ParseSince parses a point in time given either as a duration back from now ("24h"),
+// an RFC3339 timestamp or a date ("2006-01-02"). An empty string means the beginning of
+// time.
+func ParseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration, an RFC3339 timestamp or a date", s)
+}
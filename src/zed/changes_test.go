@@ -0,0 +1,57 @@
+package zed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffExtensions(t *testing.T) {
+	before := Extensions{
+		{ID: "html", Name: "HTML", Version: "0.1.0"},
+		{ID: "toml", Name: "TOML", Version: "0.1.0"},
+		{ID: "gone", Name: "Gone", Version: "1.0.0"},
+	}
+	after := Extensions{
+		{ID: "html", Name: "HTML", Version: "0.2.0"},
+		{ID: "toml", Name: "TOML", Version: "0.1.0"},
+		{ID: "astro", Name: "Astro", Version: "0.0.1"},
+	}
+
+	changes := DiffExtensions(before, after)
+	assert.Equal(t, []Change{
+		{Kind: CHANGE_KIND_EXTENSION, Action: CHANGE_ADDED, ID: "astro", Name: "Astro", NewVersion: "0.0.1"},
+		{Kind: CHANGE_KIND_EXTENSION, Action: CHANGE_REMOVED, ID: "gone", Name: "Gone", OldVersion: "1.0.0"},
+		{Kind: CHANGE_KIND_EXTENSION, Action: CHANGE_UPDATED, ID: "html", Name: "HTML", OldVersion: "0.1.0", NewVersion: "0.2.0"},
+	}, changes)
+	assert.Equal(t, "Extension HTML updated from 0.1.0 to 0.2.0", changes[2].Title())
+}
+
+func TestChangeJournal(t *testing.T) {
+	zc := NewZedClient(1)
+	zc.WithExtensionsLocalDir(t.TempDir())
+
+	// The initial import is not journaled.
+	assert.Nil(t, zc.StoreExtensionIndex(Extensions{{ID: "html", Name: "HTML", Version: "0.1.0"}}))
+	assert.Nil(t, zc.StoreLatestRelease(Version{Version: "0.190.0"}, ReleaseNotes{}))
+	changes, err := zc.ChangeJournal().Since(time.Time{})
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+
+	assert.Nil(t, zc.StoreExtensionIndex(Extensions{{ID: "html", Name: "HTML", Version: "0.2.0"}}))
+	assert.Nil(t, zc.StoreLatestRelease(Version{Version: "0.191.0"}, ReleaseNotes{}))
+	changes, err = zc.ChangeJournal().Since(time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, CHANGE_KIND_RELEASE, changes[0].Kind)
+	assert.Equal(t, "0.191.0", changes[0].NewVersion)
+	assert.Equal(t, "html", changes[1].ID)
+
+	changes, err = zc.ChangeJournal().Since(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+
+	feed := NewAtomFeed("http://localhost/zedex/changes.atom", changes)
+	assert.Empty(t, feed.Entries)
+}
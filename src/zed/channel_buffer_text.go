@@ -0,0 +1,275 @@
+package zed
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"zedex/zed/pb"
+)
+
+// bufferTimestamp is the lamport timestamp of an operation on notes, ordered by value
+// and then by replica like in Zed.
+type bufferTimestamp struct {
+	replicaId uint32
+	value     uint32
+}
+
+func (t bufferTimestamp) less(other bufferTimestamp) bool {
+	if t.value != other.value {
+		return t.value < other.value
+	}
+	return t.replicaId < other.replicaId
+}
+
+// baseTextTimestamp is the timestamp Zed gives the base text of a buffer.
+var baseTextTimestamp = bufferTimestamp{replicaId: 0, value: 1}
+
+// observed returns whether a version includes the operation at a timestamp.
+func observed(version map[uint32]uint32, t bufferTimestamp) bool {
+	return version[t.replicaId] >= t.value
+}
+
+// bufferFragment is a piece of the text an edit inserted, Zed's text CRDT splits
+// fragments where later edits start and end, and marks the deleted ones.
+type bufferFragment struct {
+	insertion bufferTimestamp
+	// offset is where the fragment starts in the text of its insertion.
+	offset    int
+	len       int
+	deletions []bufferTimestamp
+}
+
+type bufferUndo struct {
+	undo  bufferTimestamp
+	count uint32
+}
+
+// bufferText replays the edits and undos of notes on their base text like Zed's text
+// buffer, so zedex can snapshot notes without keeping their operations forever.
+//
+// The ranges of an edit are offsets into the text at the version of the edit, counting
+// deleted text but not text inserted concurrently. Concurrent insertions at the same
+// offset are ordered by descending timestamp.
+type bufferText struct {
+	fragments []bufferFragment
+	// insertions are the texts inserted by each edit.
+	insertions map[bufferTimestamp]string
+	version    map[uint32]uint32
+	// undos are the undo counts of each edit, by the undo setting them.
+	undos map[bufferTimestamp][]bufferUndo
+}
+
+func newBufferText(baseText string) *bufferText {
+	t := &bufferText{
+		insertions: map[bufferTimestamp]string{},
+		version:    map[uint32]uint32{},
+		undos:      map[bufferTimestamp][]bufferUndo{},
+	}
+	if baseText != "" {
+		t.fragments = []bufferFragment{{insertion: baseTextTimestamp, len: len(baseText)}}
+		t.insertions[baseTextTimestamp] = baseText
+		t.version[baseTextTimestamp.replicaId] = baseTextTimestamp.value
+	}
+	return t
+}
+
+// undone returns whether an edit is undone, as of version or of all undos if nil.
+func (t *bufferText) undone(edit bufferTimestamp, version map[uint32]uint32) bool {
+	count := uint32(0)
+	for _, u := range t.undos[edit] {
+		if version == nil || observed(version, u.undo) {
+			count = max(count, u.count)
+		}
+	}
+	return count%2 == 1
+}
+
+func (t *bufferText) visible(f bufferFragment) bool {
+	if t.undone(f.insertion, nil) {
+		return false
+	}
+	for _, d := range f.deletions {
+		if !t.undone(d, nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// wasVisible returns whether a fragment was visible at a version.
+func (t *bufferText) wasVisible(f bufferFragment, version map[uint32]uint32) bool {
+	if !observed(version, f.insertion) || t.undone(f.insertion, version) {
+		return false
+	}
+	for _, d := range f.deletions {
+		if observed(version, d) && !t.undone(d, version) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply applies an edit or undo, ignoring operations applied already and others, e.g.
+// selections.
+func (t *bufferText) apply(o *pb.Operation) error {
+	switch {
+	case o.GetEdit() != nil:
+		e := o.GetEdit()
+		timestamp := bufferTimestamp{replicaId: e.ReplicaId, value: e.LamportTimestamp}
+		if observed(t.version, timestamp) {
+			return nil
+		}
+		version := map[uint32]uint32{}
+		for _, v := range e.Version {
+			version[v.ReplicaId] = max(version[v.ReplicaId], v.Timestamp)
+		}
+		if err := t.edit(timestamp, version, e.Ranges, e.NewText); err != nil {
+			return err
+		}
+		t.version[timestamp.replicaId] = timestamp.value
+	case o.GetUndo() != nil:
+		u := o.GetUndo()
+		timestamp := bufferTimestamp{replicaId: u.ReplicaId, value: u.LamportTimestamp}
+		if observed(t.version, timestamp) {
+			return nil
+		}
+		for _, c := range u.Counts {
+			edit := bufferTimestamp{replicaId: c.ReplicaId, value: c.LamportTimestamp}
+			t.undos[edit] = append(t.undos[edit], bufferUndo{undo: timestamp, count: c.Count})
+		}
+		t.version[timestamp.replicaId] = timestamp.value
+	}
+	return nil
+}
+
+// edit replaces ranges by newText, splitting the fragments at their ends.
+func (t *bufferText) edit(timestamp bufferTimestamp, version map[uint32]uint32, ranges []*pb.Range, newText []string) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	old := t.fragments
+	fragments := make([]bufferFragment, 0, len(old)+3*len(ranges))
+	// i is the current old fragment, start its offset at version.
+	i, start := 0, 0
+	end := func() int {
+		if i < len(old) && observed(version, old[i].insertion) {
+			return start + old[i].len
+		}
+		return start
+	}
+	next := func() {
+		start = end()
+		i++
+	}
+	// slice keeps the old fragments ending before an offset.
+	slice := func(offset int) {
+		for i < len(old) && end() < offset {
+			fragments = append(fragments, old[i])
+			next()
+		}
+	}
+	invalid := false
+	piece := func(f bufferFragment, from, n int) bufferFragment {
+		if from < 0 || n < 0 || from+n > f.len {
+			invalid = true
+		}
+		f.offset += from
+		f.len = n
+		f.deletions = slices.Clone(f.deletions)
+		return f
+	}
+
+	slice(int(ranges[0].Start))
+	fragmentStart := start
+	insertionOffset := 0
+	for j, r := range ranges {
+		rangeStart, rangeEnd := int(r.Start), int(r.End)
+		if rangeEnd < rangeStart || rangeStart < fragmentStart {
+			return fmt.Errorf("invalid edit %v ranges", timestamp)
+		}
+
+		// Keep the fragments before the range, finishing the current one.
+		if end() < rangeStart {
+			if fragmentStart > start {
+				if end() > fragmentStart {
+					fragments = append(fragments, piece(old[i], fragmentStart-start, end()-fragmentStart))
+				}
+				next()
+			}
+			slice(rangeStart)
+			fragmentStart = start
+		}
+		if fragmentEnd := end(); fragmentEnd == rangeStart && fragmentEnd > fragmentStart {
+			fragments = append(fragments, piece(old[i], fragmentStart-start, fragmentEnd-fragmentStart))
+			next()
+			fragmentStart = start
+		}
+
+		// Concurrent insertions with a higher timestamp go first.
+		for i < len(old) && fragmentStart == rangeStart && !observed(version, old[i].insertion) && timestamp.less(old[i].insertion) {
+			fragments = append(fragments, old[i])
+			next()
+		}
+
+		if fragmentStart < rangeStart {
+			if i >= len(old) {
+				return fmt.Errorf("edit %v is out of bounds", timestamp)
+			}
+			fragments = append(fragments, piece(old[i], fragmentStart-start, rangeStart-fragmentStart))
+			fragmentStart = rangeStart
+		}
+
+		if j < len(newText) && newText[j] != "" {
+			fragments = append(fragments, bufferFragment{insertion: timestamp, offset: insertionOffset, len: len(newText[j])})
+			insertionOffset += len(newText[j])
+		}
+
+		// Delete the parts of the fragments in the range that were visible at version.
+		for fragmentStart < rangeEnd {
+			if i >= len(old) {
+				return fmt.Errorf("edit %v is out of bounds", timestamp)
+			}
+			f := old[i]
+			fragmentEnd := end()
+			intersection := piece(f, 0, f.len)
+			intersectionEnd := min(rangeEnd, fragmentEnd)
+			if t.wasVisible(f, version) {
+				intersection = piece(f, fragmentStart-start, intersectionEnd-fragmentStart)
+				intersection.deletions = append(intersection.deletions, timestamp)
+			}
+			if intersection.len > 0 {
+				fragments = append(fragments, intersection)
+				fragmentStart = intersectionEnd
+			}
+			if fragmentEnd <= rangeEnd {
+				next()
+			}
+		}
+	}
+	if i < len(old) && fragmentStart > start {
+		if end() > fragmentStart {
+			fragments = append(fragments, piece(old[i], fragmentStart-start, end()-fragmentStart))
+		}
+		next()
+	}
+	fragments = append(fragments, old[min(i, len(old)):]...)
+	if invalid {
+		return fmt.Errorf("invalid edit %v ranges", timestamp)
+	}
+
+	t.fragments = fragments
+	t.insertions[timestamp] = strings.Join(newText, "")
+	return nil
+}
+
+// String returns the visible text.
+func (t *bufferText) String() string {
+	var b strings.Builder
+	for _, f := range t.fragments {
+		if t.visible(f) {
+			b.WriteString(t.insertions[f.insertion][f.offset : f.offset+f.len])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package zed
+
+import (
+	"testing"
+
+	"zedex/zed/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRangeEdit is an edit by a replica at a version, replacing ranges by texts.
+func testRangeEdit(replicaId, timestamp uint32, version map[uint32]uint32, ranges [][2]uint64, texts ...string) *pb.Operation {
+	edit := &pb.Operation_Edit{ReplicaId: replicaId, LamportTimestamp: timestamp, Version: vectorClock(version), NewText: texts}
+	for _, r := range ranges {
+		edit.Ranges = append(edit.Ranges, &pb.Range{Start: r[0], End: r[1]})
+	}
+	return &pb.Operation{Variant: &pb.Operation_Edit_{Edit: edit}}
+}
+
+func TestBufferText(t *testing.T) {
+	text := newBufferText("")
+	apply := func(o *pb.Operation) {
+		t.Helper()
+		assert.Nil(t, text.apply(o))
+	}
+	apply(testRangeEdit(8, 1, nil, [][2]uint64{{0, 0}}, "hello"))
+	assert.Equal(t, "hello", text.String())
+
+	// Concurrent insertions at the same offset, the higher timestamp goes first.
+	apply(testRangeEdit(9, 2, map[uint32]uint32{8: 1}, [][2]uint64{{5, 5}}, " world"))
+	apply(testRangeEdit(8, 2, map[uint32]uint32{8: 1}, [][2]uint64{{5, 5}}, "!"))
+	assert.Equal(t, "hello world!", text.String())
+	// Operations are applied once.
+	apply(testRangeEdit(8, 2, map[uint32]uint32{8: 1}, [][2]uint64{{5, 5}}, "!"))
+	assert.Equal(t, "hello world!", text.String())
+
+	// Undoing an edit hides its text, undoing the undo shows it again.
+	undo := func(timestamp, count uint32) *pb.Operation {
+		return &pb.Operation{Variant: &pb.Operation_Undo_{Undo: &pb.Operation_Undo{
+			ReplicaId:        8,
+			LamportTimestamp: timestamp,
+			Counts:           []*pb.UndoCount{{ReplicaId: 8, LamportTimestamp: 2, Count: count}},
+		}}}
+	}
+	apply(undo(3, 1))
+	assert.Equal(t, "hello world", text.String())
+
+	// Ranges count deleted text, at the version of the edit.
+	apply(testRangeEdit(9, 4, map[uint32]uint32{8: 3, 9: 2}, [][2]uint64{{0, 1}, {6, 11}}, "H", "World"))
+	assert.Equal(t, "Hello World", text.String())
+	apply(undo(5, 2))
+	assert.Equal(t, "Hello World!", text.String())
+
+	// Snapshots start from a base text.
+	text = newBufferText("Hello World!")
+	apply(testRangeEdit(8, 2, map[uint32]uint32{0: 1}, [][2]uint64{{5, 11}}, ""))
+	assert.Equal(t, "Hello!", text.String())
+
+	assert.NotNil(t, text.apply(testRangeEdit(8, 3, map[uint32]uint32{0: 1, 8: 2}, [][2]uint64{{20, 21}}, "x")))
+	assert.NotNil(t, text.apply(testRangeEdit(8, 3, map[uint32]uint32{0: 1, 8: 2}, [][2]uint64{{3, 2}}, "x")))
+	assert.Equal(t, "Hello!", text.String())
+}
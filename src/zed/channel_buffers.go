@@ -0,0 +1,208 @@
+package zed
+
+import (
+	"cmp"
+	"slices"
+
+	"zedex/zed/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The notes of a channel are a text buffer Zed edits as a CRDT. zedex hands the
+// operations out to collaborators that join later. When the last collaborator leaves,
+// the operations are applied to the base text and dropped, starting a new epoch.
+
+// bufferOperationTimestamp returns the replica and lamport timestamp of the operations
+// zedex keeps, edits and undos. Others, e.g. selections, are only relayed.
+func bufferOperationTimestamp(o *pb.Operation) (replicaId, timestamp uint32, ok bool) {
+	switch {
+	case o.GetEdit() != nil:
+		return o.GetEdit().ReplicaId, o.GetEdit().LamportTimestamp, true
+	case o.GetUndo() != nil:
+		return o.GetUndo().ReplicaId, o.GetUndo().LamportTimestamp, true
+	}
+	return 0, 0, false
+}
+
+func (s *ChannelStore) appendOperationsUnsafe(channelId uint64, operations []*pb.Operation) {
+	version := s.versions[channelId]
+	if version == nil {
+		version = map[uint32]uint32{}
+		s.versions[channelId] = version
+	}
+	for _, o := range operations {
+		replicaId, timestamp, _ := bufferOperationTimestamp(o)
+		version[replicaId] = max(version[replicaId], timestamp)
+	}
+	s.operations[channelId] = append(s.operations[channelId], operations...)
+}
+
+// vectorClock turns a version into entries ordered by replica.
+func vectorClock(version map[uint32]uint32) []*pb.VectorClockEntry {
+	entries := []*pb.VectorClockEntry{}
+	for replicaId, timestamp := range version {
+		entries = append(entries, &pb.VectorClockEntry{ReplicaId: replicaId, Timestamp: timestamp})
+	}
+	slices.SortFunc(entries, func(a, b *pb.VectorClockEntry) int { return cmp.Compare(a.ReplicaId, b.ReplicaId) })
+	return entries
+}
+
+// BufferOperations returns the operations of the notes of a channel a client at version
+// hasn't seen, all of them for a nil version.
+func (s *ChannelStore) BufferOperations(channelId uint64, version []*pb.VectorClockEntry) []*pb.Operation {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	seen := map[uint32]uint32{}
+	for _, e := range version {
+		seen[e.ReplicaId] = max(seen[e.ReplicaId], e.Timestamp)
+	}
+	operations := []*pb.Operation{}
+	for _, o := range s.operations[channelId] {
+		replicaId, timestamp, _ := bufferOperationTimestamp(o)
+		if timestamp > seen[replicaId] {
+			operations = append(operations, o)
+		}
+	}
+	return cloneAll(operations)
+}
+
+// BufferVersion returns the version of the notes of a channel.
+func (s *ChannelStore) BufferVersion(channelId uint64) []*pb.VectorClockEntry {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return vectorClock(s.versions[channelId])
+}
+
+// AddBufferOperations stores the edits and undos among operations, returning whether
+// the notes changed.
+func (s *ChannelStore) AddBufferOperations(channelId uint64, operations []*pb.Operation) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, err := s.channelUnsafe(channelId); err != nil {
+		return false, err
+	}
+	stored := []*pb.Operation{}
+	for _, o := range operations {
+		if _, _, ok := bufferOperationTimestamp(o); ok {
+			stored = append(stored, proto.Clone(o).(*pb.Operation))
+		}
+	}
+	if len(stored) == 0 {
+		return false, nil
+	}
+	if s.repo != nil {
+		if err := s.repo.AddChannelBufferOperations(channelId, uint64(len(s.operations[channelId])), stored); err != nil {
+			return false, err
+		}
+	}
+	s.appendOperationsUnsafe(channelId, stored)
+	return true, nil
+}
+
+// snapshotUnsafe returns the base text and epoch of the notes of a channel.
+func (s *ChannelStore) snapshotUnsafe(channelId uint64) *pb.JoinChannelBufferResponse {
+	if snapshot, ok := s.snapshots[channelId]; ok {
+		return snapshot
+	}
+	return &pb.JoinChannelBufferResponse{BufferId: channelId}
+}
+
+// BufferSnapshot returns the base text and epoch of the notes of a channel, which
+// collaborators apply the operations to.
+func (s *ChannelStore) BufferSnapshot(channelId uint64) (baseText string, epoch uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	snapshot := s.snapshotUnsafe(channelId)
+	return snapshot.BaseText, snapshot.Epoch
+}
+
+// SnapshotBuffer applies the operations of the notes of a channel to their base text
+// and drops them, starting a new epoch. Zed can only do that with nobody collaborating,
+// as the replicas of an epoch don't know the text of the next.
+func (s *ChannelStore) SnapshotBuffer(channelId uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.operations[channelId]) == 0 {
+		return nil
+	}
+	previous := s.snapshotUnsafe(channelId)
+	text := newBufferText(previous.BaseText)
+	for _, o := range s.operations[channelId] {
+		if err := text.apply(o); err != nil {
+			return err
+		}
+	}
+	snapshot := &pb.JoinChannelBufferResponse{BufferId: channelId, BaseText: text.String(), Epoch: previous.Epoch + 1}
+	if s.repo != nil {
+		if err := s.repo.SnapshotChannelBuffer(snapshot); err != nil {
+			return err
+		}
+	}
+	s.snapshots[channelId] = snapshot
+	delete(s.operations, channelId)
+	delete(s.versions, channelId)
+	return nil
+}
+
+// LatestBufferVersions returns the version of the notes of each channel a user sees
+// with notes, Zed shows notes as changed if they are newer than what the user observed.
+func (s *ChannelStore) LatestBufferVersions(userId uint64) []*pb.ChannelBufferVersion {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	versions := []*pb.ChannelBufferVersion{}
+	for channelId, version := range s.versions {
+		if _, ok := s.roleUnsafe(userId, s.channels[channelId]); ok && len(version) > 0 {
+			versions = append(versions, &pb.ChannelBufferVersion{ChannelId: channelId, Version: vectorClock(version), Epoch: s.snapshotUnsafe(channelId).Epoch})
+		}
+	}
+	slices.SortFunc(versions, func(a, b *pb.ChannelBufferVersion) int { return cmp.Compare(a.ChannelId, b.ChannelId) })
+	return versions
+}
+
+// ObservedBufferVersions returns the latest version of notes a user has seen per channel.
+func (s *ChannelStore) ObservedBufferVersions(userId uint64) []*pb.ChannelBufferVersion {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	versions := []*pb.ChannelBufferVersion{}
+	for _, v := range s.observedBuffers[userId] {
+		versions = append(versions, v)
+	}
+	slices.SortFunc(versions, func(a, b *pb.ChannelBufferVersion) int { return cmp.Compare(a.ChannelId, b.ChannelId) })
+	return cloneAll(versions)
+}
+
+// ObserveBuffer records that a user who sees a channel has seen its notes up to a
+// version, merged with what the user saw before.
+func (s *ChannelStore) ObserveBuffer(userId, channelId uint64, version []*pb.VectorClockEntry) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return err
+	}
+	if _, err := s.requireRoleUnsafe(userId, c); err != nil {
+		return err
+	}
+	epoch := s.snapshotUnsafe(channelId).Epoch
+	merged := map[uint32]uint32{}
+	if observed, ok := s.observedBuffers[userId][channelId]; ok && observed.Epoch == epoch {
+		for _, e := range observed.Version {
+			merged[e.ReplicaId] = e.Timestamp
+		}
+	}
+	for _, e := range version {
+		merged[e.ReplicaId] = max(merged[e.ReplicaId], e.Timestamp)
+	}
+	observed := &pb.ChannelBufferVersion{ChannelId: channelId, Version: vectorClock(merged), Epoch: epoch}
+	if s.repo != nil {
+		if err := s.repo.PutObservedChannelBuffer(userId, observed); err != nil {
+			return err
+		}
+	}
+	if s.observedBuffers[userId] == nil {
+		s.observedBuffers[userId] = map[uint64]*pb.ChannelBufferVersion{}
+	}
+	s.observedBuffers[userId][channelId] = observed
+	return nil
+}
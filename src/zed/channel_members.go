@@ -0,0 +1,356 @@
+package zed
+
+import (
+	"cmp"
+	"slices"
+
+	"zedex/zed/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// channelRoleRank orders the roles, the strongest of the memberships of a user along
+// the path of a channel is its role there.
+var channelRoleRank = map[pb.ChannelRole]int{
+	pb.ChannelRole_Guest:  0,
+	pb.ChannelRole_Talker: 1,
+	pb.ChannelRole_Banned: 2,
+	pb.ChannelRole_Member: 3,
+	pb.ChannelRole_Admin:  4,
+}
+
+// Roles allowed to do things in a channel besides seeing it, changing channels and
+// their members takes an admin.
+var (
+	channelChatRoles = []pb.ChannelRole{pb.ChannelRole_Admin, pb.ChannelRole_Member, pb.ChannelRole_Talker}
+	channelEditRoles = []pb.ChannelRole{pb.ChannelRole_Admin, pb.ChannelRole_Member}
+)
+
+// channelPath returns the IDs of the ancestors of a channel and its own.
+func channelPath(c *pb.Channel) []uint64 {
+	return append(slices.Clone(c.ParentPath), c.Id)
+}
+
+// roleUnsafe returns the role of a user in a channel, if the user sees it. Admins and
+// members see all descendants, guests and talkers only public ones, banned users none.
+func (s *ChannelStore) roleUnsafe(userId uint64, c *pb.Channel) (pb.ChannelRole, bool) {
+	if c == nil {
+		return pb.ChannelRole_Guest, false
+	}
+	role, ok := pb.ChannelRole_Guest, false
+	for _, id := range channelPath(c) {
+		for _, m := range s.members[id] {
+			if m.UserId == userId && m.Kind == pb.ChannelMember_Member && (!ok || channelRoleRank[m.Role] > channelRoleRank[role]) {
+				role, ok = m.Role, true
+			}
+		}
+	}
+	switch {
+	case !ok || role == pb.ChannelRole_Banned:
+		return role, false
+	case (role == pb.ChannelRole_Guest || role == pb.ChannelRole_Talker) && c.Visibility != pb.ChannelVisibility_Public:
+		return role, false
+	}
+	return role, true
+}
+
+// Role returns the role of a user in a channel, if the user sees it.
+func (s *ChannelStore) Role(userId, channelId uint64) (pb.ChannelRole, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.roleUnsafe(userId, s.channels[channelId])
+}
+
+// RequireRole fails unless a user sees a channel with one of roles, or any role if
+// none are given.
+func (s *ChannelStore) RequireRole(userId, channelId uint64, roles ...pb.ChannelRole) (pb.ChannelRole, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return pb.ChannelRole_Guest, err
+	}
+	return s.requireRoleUnsafe(userId, c, roles...)
+}
+
+func (s *ChannelStore) requireRoleUnsafe(userId uint64, c *pb.Channel, roles ...pb.ChannelRole) (pb.ChannelRole, error) {
+	role, ok := s.roleUnsafe(userId, c)
+	if !ok {
+		return role, rpcErrorf(pb.ErrorCode_Forbidden, "not a member of %v", c.Name)
+	}
+	if len(roles) > 0 && !slices.Contains(roles, role) {
+		return role, rpcErrorf(pb.ErrorCode_Forbidden, "%v can't do that in %v", role, c.Name)
+	}
+	return role, nil
+}
+
+func (s *ChannelStore) requireAdminUnsafe(userId uint64, c *pb.Channel) error {
+	if role, _ := s.roleUnsafe(userId, c); role != pb.ChannelRole_Admin {
+		return rpcErrorf(pb.ErrorCode_Forbidden, "only admins can change %v", c.Name)
+	}
+	return nil
+}
+
+// VisibleChannels returns the channels a user sees, ordered by ID.
+func (s *ChannelStore) VisibleChannels(userId uint64) []*pb.Channel {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return cloneAll(s.visibleChannelsUnsafe(userId))
+}
+
+func (s *ChannelStore) visibleChannelsUnsafe(userId uint64) []*pb.Channel {
+	channels := []*pb.Channel{}
+	for _, c := range s.channels {
+		if _, ok := s.roleUnsafe(userId, c); ok {
+			channels = append(channels, c)
+		}
+	}
+	slices.SortFunc(channels, func(a, b *pb.Channel) int { return cmp.Compare(a.Id, b.Id) })
+	return channels
+}
+
+// VisibleChannelIds returns the IDs of the channels a user sees.
+func (s *ChannelStore) VisibleChannelIds(userId uint64) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := []uint64{}
+	for _, c := range s.visibleChannelsUnsafe(userId) {
+		ids = append(ids, c.Id)
+	}
+	return ids
+}
+
+// ChannelUpdate returns what changed for a user who saw the channels before: channels
+// that became visible, visible ones of changed, and those no longer visible. It returns
+// nil if nothing changed for the user.
+func (s *ChannelStore) ChannelUpdate(userId uint64, before []uint64, changed []*pb.Channel) *pb.UpdateChannels {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	update := &pb.UpdateChannels{}
+	visible := map[uint64]bool{}
+	for _, c := range s.visibleChannelsUnsafe(userId) {
+		visible[c.Id] = true
+		if !slices.Contains(before, c.Id) || slices.ContainsFunc(changed, func(changed *pb.Channel) bool { return changed.Id == c.Id }) {
+			update.Channels = append(update.Channels, proto.Clone(c).(*pb.Channel))
+		}
+	}
+	for _, id := range before {
+		if !visible[id] {
+			update.DeleteChannels = append(update.DeleteChannels, id)
+		}
+	}
+	if len(update.Channels) == 0 && len(update.DeleteChannels) == 0 {
+		return nil
+	}
+	return update
+}
+
+// Audience returns the users that see a channel.
+func (s *ChannelStore) Audience(channelId uint64) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, ok := s.channels[channelId]
+	if !ok {
+		return []uint64{}
+	}
+	userIds := []uint64{}
+	for _, id := range channelPath(c) {
+		for _, m := range s.members[id] {
+			if _, ok := s.roleUnsafe(m.UserId, c); ok && !slices.Contains(userIds, m.UserId) {
+				userIds = append(userIds, m.UserId)
+			}
+		}
+	}
+	return userIds
+}
+
+// Invitations returns the channels a user is invited to, ordered by ID.
+func (s *ChannelStore) Invitations(userId uint64) []*pb.Channel {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	channels := []*pb.Channel{}
+	for channelId, members := range s.members {
+		if slices.ContainsFunc(members, func(m *pb.ChannelMember) bool {
+			return m.UserId == userId && m.Kind == pb.ChannelMember_Invitee
+		}) {
+			channels = append(channels, s.channels[channelId])
+		}
+	}
+	slices.SortFunc(channels, func(a, b *pb.Channel) int { return cmp.Compare(a.Id, b.Id) })
+	return cloneAll(channels)
+}
+
+// Memberships returns the roles a user was given in channels, Zed derives the roles in
+// their descendants.
+func (s *ChannelStore) Memberships(userId uint64) []*pb.ChannelMembership {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	memberships := []*pb.ChannelMembership{}
+	for channelId, members := range s.members {
+		for _, m := range members {
+			if m.UserId == userId && m.Kind == pb.ChannelMember_Member {
+				memberships = append(memberships, &pb.ChannelMembership{ChannelId: channelId, Role: m.Role})
+			}
+		}
+	}
+	slices.SortFunc(memberships, func(a, b *pb.ChannelMembership) int { return cmp.Compare(a.ChannelId, b.ChannelId) })
+	return memberships
+}
+
+// AllMembers returns the members of a channel and its ancestors with their role in the
+// channel, and those invited to the channel.
+func (s *ChannelStore) AllMembers(channelId uint64) []*pb.ChannelMember {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, ok := s.channels[channelId]
+	if !ok {
+		return []*pb.ChannelMember{}
+	}
+	members := []*pb.ChannelMember{}
+	seen := map[uint64]bool{}
+	for _, id := range channelPath(c) {
+		for _, m := range s.members[id] {
+			if m.Kind != pb.ChannelMember_Member || seen[m.UserId] {
+				continue
+			}
+			seen[m.UserId] = true
+			if role, ok := s.roleUnsafe(m.UserId, c); ok {
+				members = append(members, &pb.ChannelMember{UserId: m.UserId, Kind: pb.ChannelMember_Member, Role: role})
+			}
+		}
+	}
+	for _, m := range s.members[channelId] {
+		if m.Kind == pb.ChannelMember_Invitee {
+			members = append(members, proto.Clone(m).(*pb.ChannelMember))
+		}
+	}
+	return members
+}
+
+func (s *ChannelStore) memberUnsafe(channelId, userId uint64) (*pb.ChannelMember, bool) {
+	i := slices.IndexFunc(s.members[channelId], func(m *pb.ChannelMember) bool { return m.UserId == userId })
+	if i < 0 {
+		return nil, false
+	}
+	return s.members[channelId][i], true
+}
+
+func (s *ChannelStore) deleteMemberUnsafe(channelId, userId uint64) error {
+	if s.repo != nil {
+		if err := s.repo.DeleteChannelMember(channelId, userId); err != nil {
+			return err
+		}
+	}
+	s.members[channelId] = slices.DeleteFunc(s.members[channelId], func(m *pb.ChannelMember) bool { return m.UserId == userId })
+	return nil
+}
+
+// requireOtherAdminUnsafe keeps root channels from losing their last admin, no one
+// could manage them anymore.
+func (s *ChannelStore) requireOtherAdminUnsafe(c *pb.Channel, userId uint64) error {
+	if len(c.ParentPath) > 0 {
+		return nil
+	}
+	for _, m := range s.members[c.Id] {
+		if m.UserId != userId && m.Kind == pb.ChannelMember_Member && m.Role == pb.ChannelRole_Admin {
+			return nil
+		}
+	}
+	return rpcErrorf(pb.ErrorCode_Forbidden, "%v needs another admin first", c.Name)
+}
+
+// InviteMember invites a user to a channel with a role, as an admin of it. Inviting an
+// invitee again changes the role.
+func (s *ChannelStore) InviteMember(adminId, channelId, userId uint64, role pb.ChannelRole) (*pb.Channel, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(adminId, c); err != nil {
+		return nil, err
+	}
+	if role == pb.ChannelRole_Banned {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "can't invite banned users")
+	}
+	if m, ok := s.memberUnsafe(channelId, userId); ok && m.Kind == pb.ChannelMember_Member {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "user %v is a member of %v already", userId, c.Name)
+	}
+	if err := s.putMemberUnsafe(channelId, &pb.ChannelMember{UserId: userId, Kind: pb.ChannelMember_Invitee, Role: role}); err != nil {
+		return nil, err
+	}
+	return proto.Clone(c).(*pb.Channel), nil
+}
+
+// RespondToInvite makes an invitee a member of the channel, or drops the invite.
+func (s *ChannelStore) RespondToInvite(userId, channelId uint64, accept bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return err
+	}
+	m, ok := s.memberUnsafe(channelId, userId)
+	if !ok || m.Kind != pb.ChannelMember_Invitee {
+		return rpcErrorf(pb.ErrorCode_Forbidden, "no invite to %v", c.Name)
+	}
+	if !accept {
+		return s.deleteMemberUnsafe(channelId, userId)
+	}
+	return s.putMemberUnsafe(channelId, &pb.ChannelMember{UserId: userId, Kind: pb.ChannelMember_Member, Role: m.Role})
+}
+
+// RemoveMember removes a member or invitee from a channel, as an admin of it or the
+// member leaving.
+func (s *ChannelStore) RemoveMember(userId, channelId, memberId uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return err
+	}
+	if userId != memberId {
+		if err := s.requireAdminUnsafe(userId, c); err != nil {
+			return err
+		}
+	}
+	m, ok := s.memberUnsafe(channelId, memberId)
+	if !ok {
+		return rpcErrorf(pb.ErrorCode_Internal, "user %v is not a member of %v", memberId, c.Name)
+	}
+	if m.Kind == pb.ChannelMember_Member && m.Role == pb.ChannelRole_Admin {
+		if err := s.requireOtherAdminUnsafe(c, memberId); err != nil {
+			return err
+		}
+	}
+	return s.deleteMemberUnsafe(channelId, memberId)
+}
+
+// SetMemberRole changes the role of a member or invitee of a channel, as an admin of it.
+func (s *ChannelStore) SetMemberRole(adminId, channelId, memberId uint64, role pb.ChannelRole) (*pb.ChannelMember, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(adminId, c); err != nil {
+		return nil, err
+	}
+	m, ok := s.memberUnsafe(channelId, memberId)
+	if !ok {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "user %v is not a member of %v", memberId, c.Name)
+	}
+	if m.Kind == pb.ChannelMember_Member && m.Role == pb.ChannelRole_Admin && role != pb.ChannelRole_Admin {
+		if err := s.requireOtherAdminUnsafe(c, memberId); err != nil {
+			return nil, err
+		}
+	}
+	m = proto.Clone(m).(*pb.ChannelMember)
+	m.Role = role
+	if err := s.putMemberUnsafe(channelId, m); err != nil {
+		return nil, err
+	}
+	return proto.Clone(m).(*pb.ChannelMember), nil
+}
@@ -0,0 +1,669 @@
+package zed
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"zedex/zed/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ChannelStore keeps the channels, their members, chat messages, notes and what users
+// have read of them in memory, loaded from a Repository at startup and written through to it
+// on every change.
+//
+// Channels form trees, the parent path of a channel lists its ancestors from the root.
+// Members of a channel are members of its descendants too.
+//
+// A ChannelStore without a repository keeps its state in memory only.
+type ChannelStore struct {
+	repo     Repository
+	channels map[uint64]*pb.Channel
+	members  map[uint64][]*pb.ChannelMember
+	messages map[uint64][]*pb.ChannelMessage
+	// observed is the latest message each user has seen, by user and channel ID.
+	observed map[uint64]map[uint64]uint64
+	// operations are the edits and undos of the notes of each channel, versions the
+	// latest lamport timestamp of each replica among them.
+	operations map[uint64][]*pb.Operation
+	versions   map[uint64]map[uint32]uint32
+	// snapshots are the base text and epoch of the notes of each channel, the operations
+	// apply to them.
+	snapshots map[uint64]*pb.JoinChannelBufferResponse
+	// observedBuffers is the latest version of the notes each user has seen, by user
+	// and channel ID.
+	observedBuffers map[uint64]map[uint64]*pb.ChannelBufferVersion
+	nextId          uint64
+	// nextMessageId is the ID of the next chat message, they increase across channels
+	// as Zed fetches messages by ID alone.
+	nextMessageId uint64
+	mtx           sync.Mutex
+}
+
+func NewChannelStore(repo Repository) (*ChannelStore, error) {
+	s := &ChannelStore{
+		repo:            repo,
+		channels:        map[uint64]*pb.Channel{},
+		members:         map[uint64][]*pb.ChannelMember{},
+		messages:        map[uint64][]*pb.ChannelMessage{},
+		observed:        map[uint64]map[uint64]uint64{},
+		operations:      map[uint64][]*pb.Operation{},
+		versions:        map[uint64]map[uint32]uint32{},
+		snapshots:       map[uint64]*pb.JoinChannelBufferResponse{},
+		observedBuffers: map[uint64]map[uint64]*pb.ChannelBufferVersion{},
+		nextId:          1,
+		nextMessageId:   1,
+	}
+	if repo == nil {
+		return s, nil
+	}
+
+	channels, err := repo.Channels()
+	if err != nil {
+		return nil, err
+	}
+	// Databases of older zedex only know the IDs of the channels and messages left.
+	lastId, err := repo.LastChannelId()
+	if err != nil {
+		return nil, err
+	}
+	s.nextId = lastId + 1
+	for _, c := range channels {
+		s.channels[c.Id] = c
+		s.nextId = max(s.nextId, c.Id+1)
+	}
+	if s.members, err = repo.ChannelMembers(); err != nil {
+		return nil, err
+	}
+	if s.messages, err = repo.ChannelMessages(); err != nil {
+		return nil, err
+	}
+	lastMessageId, err := repo.LastChannelMessageId()
+	if err != nil {
+		return nil, err
+	}
+	s.nextMessageId = lastMessageId + 1
+	for _, messages := range s.messages {
+		slices.SortFunc(messages, func(a, b *pb.ChannelMessage) int { return cmp.Compare(a.Id, b.Id) })
+		if len(messages) > 0 {
+			s.nextMessageId = max(s.nextMessageId, messages[len(messages)-1].Id+1)
+		}
+	}
+	observed, err := repo.ObservedChannelMessages()
+	if err != nil {
+		return nil, err
+	}
+	for userId, ids := range observed {
+		s.observed[userId] = map[uint64]uint64{}
+		for _, id := range ids {
+			s.observed[userId][id.ChannelId] = id.MessageId
+		}
+	}
+	operations, err := repo.ChannelBufferOperations()
+	if err != nil {
+		return nil, err
+	}
+	for channelId, ops := range operations {
+		s.appendOperationsUnsafe(channelId, ops)
+	}
+	snapshots, err := repo.ChannelBufferSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		s.snapshots[snapshot.BufferId] = snapshot
+	}
+	observedBuffers, err := repo.ObservedChannelBuffers()
+	if err != nil {
+		return nil, err
+	}
+	for userId, versions := range observedBuffers {
+		s.observedBuffers[userId] = map[uint64]*pb.ChannelBufferVersion{}
+		for _, v := range versions {
+			s.observedBuffers[userId][v.ChannelId] = v
+		}
+	}
+	return s, nil
+}
+
+// cloneAll copies messages, so callers can't change the state of the store.
+func cloneAll[T proto.Message](messages []T) []T {
+	clones := make([]T, 0, len(messages))
+	for _, m := range messages {
+		clones = append(clones, proto.Clone(m).(T))
+	}
+	return clones
+}
+
+// Channels returns all channels ordered by ID.
+func (s *ChannelStore) Channels() []*pb.Channel {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	channels := []*pb.Channel{}
+	for _, c := range s.channels {
+		channels = append(channels, c)
+	}
+	slices.SortFunc(channels, func(a, b *pb.Channel) int { return cmp.Compare(a.Id, b.Id) })
+	return cloneAll(channels)
+}
+
+// Channel returns a channel by ID.
+func (s *ChannelStore) Channel(channelId uint64) (*pb.Channel, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, ok := s.channels[channelId]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(c).(*pb.Channel), true
+}
+
+func (s *ChannelStore) channelUnsafe(channelId uint64) (*pb.Channel, error) {
+	c, ok := s.channels[channelId]
+	if !ok {
+		return nil, rpcErrorf(pb.ErrorCode_NoSuchChannel, "no channel %v", channelId)
+	}
+	return c, nil
+}
+
+func (s *ChannelStore) putChannelUnsafe(channel *pb.Channel) error {
+	if s.repo != nil {
+		if err := s.repo.PutChannel(channel); err != nil {
+			return err
+		}
+	}
+	s.channels[channel.Id] = channel
+	return nil
+}
+
+// childrenUnsafe returns the children of a channel, 0 for the root channels, by order.
+func (s *ChannelStore) childrenUnsafe(parentId uint64) []*pb.Channel {
+	children := []*pb.Channel{}
+	for _, c := range s.channels {
+		if channelParentId(c) == parentId {
+			children = append(children, c)
+		}
+	}
+	slices.SortFunc(children, func(a, b *pb.Channel) int {
+		return cmp.Or(cmp.Compare(a.ChannelOrder, b.ChannelOrder), cmp.Compare(a.Id, b.Id))
+	})
+	return children
+}
+
+// descendantsUnsafe returns the channels below a channel.
+func (s *ChannelStore) descendantsUnsafe(channelId uint64) []*pb.Channel {
+	descendants := []*pb.Channel{}
+	for _, c := range s.channels {
+		if slices.Contains(c.ParentPath, channelId) {
+			descendants = append(descendants, c)
+		}
+	}
+	return descendants
+}
+
+// channelParentId returns the parent of a channel, 0 for root channels.
+func channelParentId(c *pb.Channel) uint64 {
+	if len(c.ParentPath) == 0 {
+		return 0
+	}
+	return c.ParentPath[len(c.ParentPath)-1]
+}
+
+// CreateChannel adds a channel below parentId, or a root channel if parentId is nil,
+// whose admin the creator becomes.
+func (s *ChannelStore) CreateChannel(name string, parentId *uint64, creatorId uint64) (*pb.Channel, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "channel name must not be empty")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	channel := &pb.Channel{
+		Id:         s.nextId,
+		Name:       name,
+		Visibility: pb.ChannelVisibility_Members,
+	}
+	var parent uint64
+	if parentId != nil {
+		p, err := s.channelUnsafe(*parentId)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.requireAdminUnsafe(creatorId, p); err != nil {
+			return nil, err
+		}
+		parent = p.Id
+		channel.ParentPath = append(slices.Clone(p.ParentPath), p.Id)
+	}
+	channel.ChannelOrder = s.nextOrderUnsafe(parent)
+	if err := s.putChannelUnsafe(channel); err != nil {
+		return nil, err
+	}
+	s.nextId++
+	if parentId == nil {
+		if err := s.putMemberUnsafe(channel.Id, &pb.ChannelMember{UserId: creatorId, Kind: pb.ChannelMember_Member, Role: pb.ChannelRole_Admin}); err != nil {
+			return nil, err
+		}
+	}
+	return proto.Clone(channel).(*pb.Channel), nil
+}
+
+func (s *ChannelStore) nextOrderUnsafe(parentId uint64) int32 {
+	order := int32(1)
+	for _, c := range s.childrenUnsafe(parentId) {
+		order = max(order, c.ChannelOrder+1)
+	}
+	return order
+}
+
+// RenameChannel renames a channel, as an admin of it.
+func (s *ChannelStore) RenameChannel(userId, channelId uint64, name string) (*pb.Channel, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "channel name must not be empty")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(userId, c); err != nil {
+		return nil, err
+	}
+	c = proto.Clone(c).(*pb.Channel)
+	c.Name = name
+	if err := s.putChannelUnsafe(c); err != nil {
+		return nil, err
+	}
+	return proto.Clone(c).(*pb.Channel), nil
+}
+
+// MoveChannel moves a channel with its descendants below another channel, as an admin
+// of both. It returns the changed channels.
+func (s *ChannelStore) MoveChannel(userId, channelId, to uint64) ([]*pb.Channel, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.channelUnsafe(to)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(userId, c); err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(userId, target); err != nil {
+		return nil, err
+	}
+	if target.Id == c.Id || slices.Contains(target.ParentPath, c.Id) {
+		return nil, rpcErrorf(pb.ErrorCode_CircularNesting, "cannot move %v into itself", c.Name)
+	}
+	if channelParentId(c) == target.Id {
+		return nil, rpcErrorf(pb.ErrorCode_WrongMoveTarget, "%v is in %v already", c.Name, target.Name)
+	}
+	if c.Visibility == pb.ChannelVisibility_Public && target.Visibility != pb.ChannelVisibility_Public {
+		return nil, rpcErrorf(pb.ErrorCode_BadPublicNesting, "public channels must be in public channels")
+	}
+
+	oldPath := append(slices.Clone(c.ParentPath), c.Id)
+	newPath := append(slices.Clone(target.ParentPath), target.Id, c.Id)
+	changed := []*pb.Channel{}
+	moved := proto.Clone(c).(*pb.Channel)
+	moved.ParentPath = newPath[:len(newPath)-1]
+	moved.ChannelOrder = s.nextOrderUnsafe(target.Id)
+	changed = append(changed, moved)
+	for _, d := range s.descendantsUnsafe(c.Id) {
+		d = proto.Clone(d).(*pb.Channel)
+		d.ParentPath = append(slices.Clone(newPath), d.ParentPath[len(oldPath):]...)
+		changed = append(changed, d)
+	}
+	for _, c := range changed {
+		if err := s.putChannelUnsafe(c); err != nil {
+			return nil, err
+		}
+	}
+	return cloneAll(changed), nil
+}
+
+// ReorderChannel moves a channel up or down among its siblings, as an admin of it. It
+// returns the changed channels.
+func (s *ChannelStore) ReorderChannel(userId, channelId uint64, direction pb.ReorderChannel_Direction) ([]*pb.Channel, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(userId, c); err != nil {
+		return nil, err
+	}
+	siblings := s.childrenUnsafe(channelParentId(c))
+	i := slices.IndexFunc(siblings, func(s *pb.Channel) bool { return s.Id == c.Id })
+	j := i - 1
+	if direction == pb.ReorderChannel_Down {
+		j = i + 1
+	}
+	if j < 0 || j >= len(siblings) {
+		return []*pb.Channel{}, nil
+	}
+
+	// Renumber the siblings, orders may be equal after moves.
+	siblings[i], siblings[j] = siblings[j], siblings[i]
+	changed := []*pb.Channel{}
+	for order, sibling := range siblings {
+		if sibling.ChannelOrder == int32(order+1) {
+			continue
+		}
+		sibling = proto.Clone(sibling).(*pb.Channel)
+		sibling.ChannelOrder = int32(order + 1)
+		if err := s.putChannelUnsafe(sibling); err != nil {
+			return nil, err
+		}
+		changed = append(changed, sibling)
+	}
+	return cloneAll(changed), nil
+}
+
+// SetChannelVisibility makes a channel public or visible to members only, as an admin
+// of it. Public channels must be in public channels.
+func (s *ChannelStore) SetChannelVisibility(userId, channelId uint64, visibility pb.ChannelVisibility) (*pb.Channel, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(userId, c); err != nil {
+		return nil, err
+	}
+	if visibility == pb.ChannelVisibility_Public {
+		if parent, ok := s.channels[channelParentId(c)]; ok && parent.Visibility != pb.ChannelVisibility_Public {
+			return nil, rpcErrorf(pb.ErrorCode_BadPublicNesting, "the parent of a public channel must be public")
+		}
+	} else {
+		for _, d := range s.descendantsUnsafe(c.Id) {
+			if d.Visibility == pb.ChannelVisibility_Public {
+				return nil, rpcErrorf(pb.ErrorCode_BadPublicNesting, "%v has public subchannels", c.Name)
+			}
+		}
+	}
+	c = proto.Clone(c).(*pb.Channel)
+	c.Visibility = visibility
+	if err := s.putChannelUnsafe(c); err != nil {
+		return nil, err
+	}
+	return proto.Clone(c).(*pb.Channel), nil
+}
+
+// DeleteChannel deletes a channel with its descendants, their members and chat, as an
+// admin of it. It returns the IDs of the deleted channels.
+func (s *ChannelStore) DeleteChannel(userId, channelId uint64) ([]uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireAdminUnsafe(userId, c); err != nil {
+		return nil, err
+	}
+	deleted := []uint64{}
+	for _, d := range append(s.descendantsUnsafe(c.Id), c) {
+		deleted = append(deleted, d.Id)
+	}
+	// A subtree is deleted in one transaction, so no orphaned descendants are left.
+	if s.repo != nil {
+		if err := s.repo.DeleteChannels(deleted...); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range deleted {
+		delete(s.channels, id)
+		delete(s.members, id)
+		delete(s.messages, id)
+		delete(s.operations, id)
+		delete(s.versions, id)
+		delete(s.snapshots, id)
+		for _, observed := range s.observed {
+			delete(observed, id)
+		}
+		for _, observed := range s.observedBuffers {
+			delete(observed, id)
+		}
+	}
+	return deleted, nil
+}
+
+// Members returns the members of a channel.
+func (s *ChannelStore) Members(channelId uint64) []*pb.ChannelMember {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return cloneAll(s.members[channelId])
+}
+
+// PutMember adds a member to a channel, or replaces the membership of the user.
+func (s *ChannelStore) PutMember(channelId uint64, member *pb.ChannelMember) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.putMemberUnsafe(channelId, member)
+}
+
+func (s *ChannelStore) putMemberUnsafe(channelId uint64, member *pb.ChannelMember) error {
+	member = proto.Clone(member).(*pb.ChannelMember)
+	if s.repo != nil {
+		if err := s.repo.PutChannelMember(channelId, member); err != nil {
+			return err
+		}
+	}
+	members := slices.DeleteFunc(s.members[channelId], func(m *pb.ChannelMember) bool { return m.UserId == member.UserId })
+	s.members[channelId] = append(members, member)
+	return nil
+}
+
+// Messages returns the chat messages of a channel, oldest first.
+func (s *ChannelStore) Messages(channelId uint64) []*pb.ChannelMessage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return cloneAll(s.messages[channelId])
+}
+
+// channelMessagesPerPage is how many chat messages Zed gets at once, older ones are
+// fetched when scrolling up.
+const channelMessagesPerPage = 100
+
+// maxChannelMessageLength is the longest chat message in characters.
+const maxChannelMessageLength = 1024
+
+// MessagesBefore returns a page of the chat messages of a channel older than a
+// message, or the latest if beforeMessageId is 0, oldest first. It reports whether
+// there are no older messages.
+func (s *ChannelStore) MessagesBefore(channelId, beforeMessageId uint64, limit int) ([]*pb.ChannelMessage, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	messages := s.messages[channelId]
+	end := len(messages)
+	if beforeMessageId > 0 {
+		end, _ = slices.BinarySearchFunc(messages, beforeMessageId, func(m *pb.ChannelMessage, id uint64) int { return cmp.Compare(m.Id, id) })
+	}
+	start := max(0, end-limit)
+	return cloneAll(messages[start:end]), start == 0
+}
+
+// MessagesById returns the chat messages with the given IDs in the channels a user sees.
+func (s *ChannelStore) MessagesById(userId uint64, messageIds []uint64) []*pb.ChannelMessage {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	found := []*pb.ChannelMessage{}
+	for channelId, messages := range s.messages {
+		if _, ok := s.roleUnsafe(userId, s.channels[channelId]); !ok {
+			continue
+		}
+		for _, m := range messages {
+			if slices.Contains(messageIds, m.Id) {
+				found = append(found, m)
+			}
+		}
+	}
+	slices.SortFunc(found, func(a, b *pb.ChannelMessage) int { return cmp.Compare(a.Id, b.Id) })
+	return cloneAll(found)
+}
+
+func validateMessageBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", rpcErrorf(pb.ErrorCode_Internal, "message can't be blank")
+	}
+	if utf8.RuneCountInString(body) > maxChannelMessageLength {
+		return "", rpcErrorf(pb.ErrorCode_Internal, "message is longer than %v characters", maxChannelMessageLength)
+	}
+	return body, nil
+}
+
+// AddMessage appends a chat message to a channel, giving it the next ID. It returns the
+// stored message.
+func (s *ChannelStore) AddMessage(channelId uint64, message *pb.ChannelMessage) (*pb.ChannelMessage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, err := s.channelUnsafe(channelId); err != nil {
+		return nil, err
+	}
+	message = proto.Clone(message).(*pb.ChannelMessage)
+	body, err := validateMessageBody(message.Body)
+	if err != nil {
+		return nil, err
+	}
+	message.Body = body
+	message.Id = s.nextMessageId
+	if s.repo != nil {
+		if err := s.repo.PutChannelMessage(channelId, message); err != nil {
+			return nil, err
+		}
+	}
+	s.nextMessageId++
+	s.messages[channelId] = append(s.messages[channelId], message)
+	return proto.Clone(message).(*pb.ChannelMessage), nil
+}
+
+// messageUnsafe returns the index of a chat message of a channel, checking that a user
+// wrote it or is an admin of the channel.
+func (s *ChannelStore) messageUnsafe(userId, channelId, messageId uint64) (int, error) {
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := slices.BinarySearchFunc(s.messages[channelId], messageId, func(m *pb.ChannelMessage, id uint64) int { return cmp.Compare(m.Id, id) })
+	if !ok {
+		return 0, rpcErrorf(pb.ErrorCode_Internal, "no message %v in %v", messageId, c.Name)
+	}
+	if s.messages[channelId][i].SenderId != userId {
+		if err := s.requireAdminUnsafe(userId, c); err != nil {
+			return 0, err
+		}
+	}
+	return i, nil
+}
+
+// UpdateMessage changes the body and mentions of a chat message, as its author or an
+// admin of the channel. It returns the changed message.
+func (s *ChannelStore) UpdateMessage(userId, channelId, messageId uint64, body string, mentions []*pb.ChatMention) (*pb.ChannelMessage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	i, err := s.messageUnsafe(userId, channelId, messageId)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = validateMessageBody(body); err != nil {
+		return nil, err
+	}
+	message := proto.Clone(s.messages[channelId][i]).(*pb.ChannelMessage)
+	message.Body = body
+	message.Mentions = mentions
+	message.EditedAt = proto.Uint64(uint64(time.Now().Unix()))
+	if s.repo != nil {
+		if err := s.repo.PutChannelMessage(channelId, message); err != nil {
+			return nil, err
+		}
+	}
+	s.messages[channelId][i] = message
+	return proto.Clone(message).(*pb.ChannelMessage), nil
+}
+
+// RemoveMessage deletes a chat message, as its author or an admin of the channel.
+func (s *ChannelStore) RemoveMessage(userId, channelId, messageId uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	i, err := s.messageUnsafe(userId, channelId, messageId)
+	if err != nil {
+		return err
+	}
+	if s.repo != nil {
+		if err := s.repo.DeleteChannelMessage(channelId, messageId); err != nil {
+			return err
+		}
+	}
+	s.messages[channelId] = slices.Delete(s.messages[channelId], i, i+1)
+	return nil
+}
+
+// LatestMessageIds returns the ID of the latest chat message of each channel a user
+// sees with messages, Zed shows a channel as unread if it is newer than what the user
+// observed.
+func (s *ChannelStore) LatestMessageIds(userId uint64) []*pb.ChannelMessageId {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := []*pb.ChannelMessageId{}
+	for channelId, messages := range s.messages {
+		if _, ok := s.roleUnsafe(userId, s.channels[channelId]); ok && len(messages) > 0 {
+			ids = append(ids, &pb.ChannelMessageId{ChannelId: channelId, MessageId: messages[len(messages)-1].Id})
+		}
+	}
+	slices.SortFunc(ids, func(a, b *pb.ChannelMessageId) int { return cmp.Compare(a.ChannelId, b.ChannelId) })
+	return ids
+}
+
+// ObservedMessageIds returns the latest chat message a user has seen per channel.
+func (s *ChannelStore) ObservedMessageIds(userId uint64) []*pb.ChannelMessageId {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := []*pb.ChannelMessageId{}
+	for channelId, messageId := range s.observed[userId] {
+		ids = append(ids, &pb.ChannelMessageId{ChannelId: channelId, MessageId: messageId})
+	}
+	slices.SortFunc(ids, func(a, b *pb.ChannelMessageId) int { return cmp.Compare(a.ChannelId, b.ChannelId) })
+	return ids
+}
+
+// ObserveMessage records that a user who sees a channel has seen its chat up to a
+// message, ignoring acknowledgements of older messages.
+func (s *ChannelStore) ObserveMessage(userId, channelId, messageId uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, err := s.channelUnsafe(channelId)
+	if err != nil {
+		return err
+	}
+	if _, err := s.requireRoleUnsafe(userId, c); err != nil {
+		return err
+	}
+	if s.observed[userId][channelId] >= messageId {
+		return nil
+	}
+	if s.repo != nil {
+		if err := s.repo.PutObservedChannelMessage(userId, &pb.ChannelMessageId{ChannelId: channelId, MessageId: messageId}); err != nil {
+			return err
+		}
+	}
+	if s.observed[userId] == nil {
+		s.observed[userId] = map[uint64]uint64{}
+	}
+	s.observed[userId][channelId] = messageId
+	return nil
+}
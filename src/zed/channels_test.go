@@ -0,0 +1,261 @@
+package zed
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"zedex/zed/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertRpcError asserts err is an RpcError with code.
+func assertRpcError(t *testing.T, code pb.ErrorCode, err error) {
+	t.Helper()
+	var rpcErr *RpcError
+	if assert.True(t, errors.As(err, &rpcErr), "not an RpcError: %v", err) {
+		assert.Equal(t, code, rpcErr.Code)
+	}
+}
+
+func TestChannelHierarchy(t *testing.T) {
+	channels, err := NewChannelStore(nil)
+	assert.Nil(t, err)
+	alice, bob := uint64(1), uint64(2)
+
+	root, err := channels.CreateChannel(" zed ", nil, alice)
+	assert.Nil(t, err)
+	assert.Equal(t, "zed", root.Name)
+	role, _ := channels.Role(alice, root.Id)
+	assert.Equal(t, pb.ChannelRole_Admin, role)
+	_, err = channels.CreateChannel("", nil, alice)
+	assert.NotNil(t, err)
+	_, err = channels.CreateChannel("docs", &root.Id, bob)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+	missing := uint64(42)
+	_, err = channels.CreateChannel("docs", &missing, alice)
+	assertRpcError(t, pb.ErrorCode_NoSuchChannel, err)
+
+	docs, err := channels.CreateChannel("docs", &root.Id, alice)
+	assert.Nil(t, err)
+	notes, err := channels.CreateChannel("notes", &root.Id, alice)
+	assert.Nil(t, err)
+	drafts, err := channels.CreateChannel("drafts", &docs.Id, alice)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{root.Id, docs.Id}, drafts.ParentPath)
+	assert.Less(t, docs.ChannelOrder, notes.ChannelOrder)
+	// Admins of a channel are admins of its descendants.
+	role, _ = channels.Role(alice, drafts.Id)
+	assert.Equal(t, pb.ChannelRole_Admin, role)
+
+	renamed, err := channels.RenameChannel(alice, docs.Id, "documentation")
+	assert.Nil(t, err)
+	assert.Equal(t, "documentation", renamed.Name)
+	_, err = channels.RenameChannel(bob, docs.Id, "mine")
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+
+	// Moving a channel moves its descendants along.
+	_, err = channels.MoveChannel(alice, docs.Id, drafts.Id)
+	assertRpcError(t, pb.ErrorCode_CircularNesting, err)
+	_, err = channels.MoveChannel(alice, docs.Id, root.Id)
+	assertRpcError(t, pb.ErrorCode_WrongMoveTarget, err)
+	moved, err := channels.MoveChannel(alice, docs.Id, notes.Id)
+	assert.Nil(t, err)
+	assert.Len(t, moved, 2)
+	drafts, _ = channels.Channel(drafts.Id)
+	assert.Equal(t, []uint64{root.Id, notes.Id, docs.Id}, drafts.ParentPath)
+
+	// Reordering swaps siblings, and does nothing at the ends.
+	other, err := channels.CreateChannel("other", &root.Id, alice)
+	assert.Nil(t, err)
+	reordered, err := channels.ReorderChannel(alice, other.Id, pb.ReorderChannel_Up)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, reordered)
+	other, _ = channels.Channel(other.Id)
+	notes, _ = channels.Channel(notes.Id)
+	assert.Less(t, other.ChannelOrder, notes.ChannelOrder)
+	reordered, err = channels.ReorderChannel(alice, other.Id, pb.ReorderChannel_Up)
+	assert.Nil(t, err)
+	assert.Empty(t, reordered)
+
+	// Public channels must be in public channels.
+	_, err = channels.SetChannelVisibility(alice, notes.Id, pb.ChannelVisibility_Public)
+	assertRpcError(t, pb.ErrorCode_BadPublicNesting, err)
+	_, err = channels.SetChannelVisibility(alice, root.Id, pb.ChannelVisibility_Public)
+	assert.Nil(t, err)
+	_, err = channels.SetChannelVisibility(alice, notes.Id, pb.ChannelVisibility_Public)
+	assert.Nil(t, err)
+	_, err = channels.SetChannelVisibility(alice, root.Id, pb.ChannelVisibility_Members)
+	assertRpcError(t, pb.ErrorCode_BadPublicNesting, err)
+
+	_, err = channels.DeleteChannel(bob, notes.Id)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+	deleted, err := channels.DeleteChannel(alice, notes.Id)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []uint64{notes.Id, docs.Id, drafts.Id}, deleted)
+	assert.Len(t, channels.Channels(), 2)
+}
+
+func TestChannelRoles(t *testing.T) {
+	channels, err := NewChannelStore(nil)
+	assert.Nil(t, err)
+	alice, bob := uint64(1), uint64(2)
+	root, err := channels.CreateChannel("zed", nil, alice)
+	assert.Nil(t, err)
+	_, err = channels.SetChannelVisibility(alice, root.Id, pb.ChannelVisibility_Public)
+	assert.Nil(t, err)
+	private, err := channels.CreateChannel("private", &root.Id, alice)
+	assert.Nil(t, err)
+
+	_, err = channels.InviteMember(bob, root.Id, alice, pb.ChannelRole_Member)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+	_, err = channels.InviteMember(alice, root.Id, bob, pb.ChannelRole_Guest)
+	assert.Nil(t, err)
+	assert.Empty(t, channels.VisibleChannels(bob))
+	assert.Len(t, channels.Invitations(bob), 1)
+	assert.Nil(t, channels.RespondToInvite(bob, root.Id, true))
+	assert.Empty(t, channels.Invitations(bob))
+	assert.Equal(t, []uint64{root.Id}, channels.VisibleChannelIds(bob))
+	_, err = channels.RequireRole(bob, root.Id, channelChatRoles...)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+
+	// A role in a descendant adds to the one inherited, bans win over guests.
+	assert.Nil(t, channels.PutMember(private.Id, &pb.ChannelMember{UserId: bob, Role: pb.ChannelRole_Member}))
+	role, ok := channels.Role(bob, private.Id)
+	assert.True(t, ok)
+	assert.Equal(t, pb.ChannelRole_Member, role)
+	_, err = channels.SetMemberRole(alice, root.Id, bob, pb.ChannelRole_Banned)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{private.Id}, channels.VisibleChannelIds(bob))
+	assert.ElementsMatch(t, []uint64{alice}, channels.Audience(root.Id))
+
+	_, err = channels.SetMemberRole(alice, root.Id, alice, pb.ChannelRole_Member)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+	assert.Nil(t, channels.RemoveMember(alice, root.Id, bob))
+	assert.Empty(t, channels.Members(root.Id)[1:])
+}
+
+// testEdit returns an edit of the notes of a channel.
+func testEdit(replicaId, timestamp uint32, text string) *pb.Operation {
+	return &pb.Operation{Variant: &pb.Operation_Edit_{Edit: &pb.Operation_Edit{
+		ReplicaId:        replicaId,
+		LamportTimestamp: timestamp,
+		NewText:          []string{text},
+	}}}
+}
+
+func TestChannelBuffers(t *testing.T) {
+	channels, err := NewChannelStore(nil)
+	assert.Nil(t, err)
+	zed, err := channels.CreateChannel("zed", nil, 1)
+	assert.Nil(t, err)
+
+	// Selections are relayed, not kept.
+	selections := &pb.Operation{Variant: &pb.Operation_UpdateSelections_{UpdateSelections: &pb.Operation_UpdateSelections{ReplicaId: 8}}}
+	changed, err := channels.AddBufferOperations(zed.Id, []*pb.Operation{selections})
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	changed, err = channels.AddBufferOperations(zed.Id, []*pb.Operation{testEdit(8, 1, "a"), testEdit(9, 2, "b"), testEdit(8, 3, "c")})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []*pb.VectorClockEntry{{ReplicaId: 8, Timestamp: 3}, {ReplicaId: 9, Timestamp: 2}}, channels.BufferVersion(zed.Id))
+	missing := channels.BufferOperations(zed.Id, []*pb.VectorClockEntry{{ReplicaId: 8, Timestamp: 1}})
+	assert.Len(t, missing, 2)
+	assert.Equal(t, "b", missing[0].GetEdit().NewText[0])
+	assert.Len(t, channels.LatestBufferVersions(1), 1)
+	assert.Empty(t, channels.LatestBufferVersions(2))
+	assert.NotNil(t, channels.ObserveBuffer(2, zed.Id, []*pb.VectorClockEntry{{ReplicaId: 9, Timestamp: 2}}))
+	assert.NotNil(t, channels.ObserveBuffer(1, zed.Id+1, []*pb.VectorClockEntry{{ReplicaId: 9, Timestamp: 2}}))
+
+	assert.Nil(t, channels.PutMember(zed.Id, &pb.ChannelMember{UserId: 2, Kind: pb.ChannelMember_Member, Role: pb.ChannelRole_Member}))
+	assert.Nil(t, channels.ObserveBuffer(2, zed.Id, []*pb.VectorClockEntry{{ReplicaId: 9, Timestamp: 2}}))
+	assert.Nil(t, channels.ObserveBuffer(2, zed.Id, []*pb.VectorClockEntry{{ReplicaId: 8, Timestamp: 1}, {ReplicaId: 9, Timestamp: 1}}))
+	assert.Equal(t, []*pb.VectorClockEntry{{ReplicaId: 8, Timestamp: 1}, {ReplicaId: 9, Timestamp: 2}}, channels.ObservedBufferVersions(2)[0].Version)
+
+	// Snapshots apply the operations to the base text and start a new epoch, which
+	// starts without changes.
+	notes, err := channels.CreateChannel("notes", nil, 1)
+	assert.Nil(t, err)
+	_, err = channels.AddBufferOperations(notes.Id, []*pb.Operation{testRangeEdit(8, 1, nil, [][2]uint64{{0, 0}}, "hello")})
+	assert.Nil(t, err)
+	assert.Nil(t, channels.ObserveBuffer(1, notes.Id, channels.BufferVersion(notes.Id)))
+	assert.Nil(t, channels.SnapshotBuffer(notes.Id))
+	baseText, epoch := channels.BufferSnapshot(notes.Id)
+	assert.Equal(t, "hello", baseText)
+	assert.Equal(t, uint64(1), epoch)
+	assert.Empty(t, channels.BufferOperations(notes.Id, nil))
+	assert.Len(t, channels.LatestBufferVersions(1), 1)
+	_, err = channels.AddBufferOperations(notes.Id, []*pb.Operation{testRangeEdit(8, 2, map[uint32]uint32{0: 1}, [][2]uint64{{5, 5}}, "!")})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), channels.LatestBufferVersions(1)[1].Epoch)
+	assert.Nil(t, channels.ObserveBuffer(1, notes.Id, nil))
+	observed := channels.ObservedBufferVersions(1)
+	assert.Equal(t, uint64(1), observed[len(observed)-1].Epoch)
+	assert.Empty(t, observed[len(observed)-1].Version)
+	assert.Nil(t, channels.SnapshotBuffer(notes.Id))
+	baseText, epoch = channels.BufferSnapshot(notes.Id)
+	assert.Equal(t, "hello!", baseText)
+	assert.Equal(t, uint64(2), epoch)
+}
+
+func TestChannelMessages(t *testing.T) {
+	channels, err := NewChannelStore(nil)
+	assert.Nil(t, err)
+	alice, bob := uint64(1), uint64(2)
+	zed, err := channels.CreateChannel("zed", nil, alice)
+	assert.Nil(t, err)
+	other, err := channels.CreateChannel("other", nil, bob)
+	assert.Nil(t, err)
+	assert.Nil(t, channels.PutMember(zed.Id, &pb.ChannelMember{UserId: bob, Role: pb.ChannelRole_Member}))
+
+	_, err = channels.AddMessage(zed.Id, &pb.ChannelMessage{Body: "  "})
+	assert.NotNil(t, err)
+	for i := range 5 {
+		sender := alice
+		if i%2 == 1 {
+			sender = bob
+		}
+		message, err := channels.AddMessage(zed.Id, &pb.ChannelMessage{Body: fmt.Sprint(i), SenderId: sender})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), message.Id)
+	}
+	otherMessage, err := channels.AddMessage(other.Id, &pb.ChannelMessage{Body: "other", SenderId: bob})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), otherMessage.Id)
+
+	// Pages go back from the latest message.
+	page, done := channels.MessagesBefore(zed.Id, 0, 2)
+	assert.Equal(t, []string{"3", "4"}, messageBodies(page))
+	assert.False(t, done)
+	page, done = channels.MessagesBefore(zed.Id, page[0].Id, 3)
+	assert.Equal(t, []string{"0", "1", "2"}, messageBodies(page))
+	assert.True(t, done)
+	assert.Equal(t, []string{"1"}, messageBodies(channels.MessagesById(alice, []uint64{2, otherMessage.Id})))
+
+	// Authors and admins change messages, others don't.
+	_, err = channels.UpdateMessage(bob, zed.Id, 1, "mine", nil)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+	updated, err := channels.UpdateMessage(bob, zed.Id, 2, "edited", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, updated.EditedAt)
+	assert.Nil(t, channels.RemoveMessage(alice, zed.Id, 2))
+	assertRpcError(t, pb.ErrorCode_Forbidden, channels.RemoveMessage(alice, other.Id, otherMessage.Id))
+	page, _ = channels.MessagesBefore(zed.Id, 0, 10)
+	assert.Equal(t, []string{"0", "2", "3", "4"}, messageBodies(page))
+
+	// Only users who see a channel acknowledge its messages.
+	assert.Nil(t, channels.ObserveMessage(bob, zed.Id, 4))
+	assertRpcError(t, pb.ErrorCode_Forbidden, channels.ObserveMessage(alice, other.Id, otherMessage.Id))
+	assert.NotNil(t, channels.ObserveMessage(alice, other.Id+1, 1))
+	assert.Empty(t, channels.ObservedMessageIds(alice))
+}
+
+func messageBodies(messages []*pb.ChannelMessage) []string {
+	bodies := []string{}
+	for _, m := range messages {
+		bodies = append(bodies, m.Body)
+	}
+	return bodies
+}
@@ -171,19 +171,8 @@ func (c *Client) LoadExtensionArchive(extension Extension) ([]byte, error) {
 }
 
 func (c *Client) GetLatestZedVersion() (Version, error) {
-	os := runtime.GOOS
 	arch := utils.IfElse(runtime.GOARCH == "amd64", "x86_64", runtime.GOARCH)
-	u := fmt.Sprintf("%s/api/releases/latest?asset=zed&os=%s&arch=%s", c.host, os, arch)
-	resp, err := http.Get(u)
-	if err != nil {
-		return Version{}, err
-	}
-	var ver Version
-	if err := json.NewDecoder(resp.Body).Decode(&ver); err != nil {
-		return Version{}, err
-	}
-
-	return ver, nil
+	return c.GetLatestRelease("zed", Platform{OS: runtime.GOOS, Arch: arch})
 }
 
 func (c *Client) LoadLatestZedVersionFromFile(versionFile string) (Version, error) {
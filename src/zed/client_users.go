@@ -1,8 +1,12 @@
 package zed
 
 import (
+	"encoding/json"
+	"fmt"
 	"time"
 
+	"zedex/zed/pb"
+
 	"google.golang.org/protobuf/proto"
 )
 
@@ -61,11 +65,29 @@ const (
 	ZedProTrial
 )
 
+var plans = [...]string{"Free", "ZedPro", "ZedProTrial"}
+
 func (p Plan) String() string {
-	plans := [...]string{"Free", "ZedPro", "ZedProTrial"}
 	return plans[p]
 }
 
+func (p Plan) Proto() pb.Plan {
+	return pb.Plan(p)
+}
+
+// ParsePlan parses the name of a plan, an empty name is the free plan.
+func ParsePlan(s string) (Plan, error) {
+	if s == "" {
+		return ZedFree, nil
+	}
+	for i, name := range plans {
+		if name == s {
+			return Plan(i), nil
+		}
+	}
+	return ZedFree, fmt.Errorf("unknown plan %q", s)
+}
+
 type GetSubscriptionResponse struct {
 	Plan  Plan          `json:"plan"`
 	Usage *CurrentUsage `json:"usage"`
@@ -77,42 +99,99 @@ type CurrentUsage struct {
 }
 
 type UsageData struct {
-	Used  uint32 `json:"used"`
-	Limit string `json:"limit"`
+	Used  uint32     `json:"used"`
+	Limit UsageLimit `json:"limit"`
 }
 
+// UsageLimit is serialized like the Rust enum Zed uses, either "unlimited" or
+// {"limited": <n>}.
 type UsageLimit struct {
 	Limited   *int32 `json:"limited"`
 	Unlimited bool   `json:"unlimited"`
 }
 
-func NewGetAuthenticatedUsersResponse() GetAuthenticatedUserResponse {
+// NewUsageLimit converts a limit where 0 is unlimited.
+func NewUsageLimit(limit int) UsageLimit {
+	if limit <= 0 {
+		return UsageLimit{Unlimited: true}
+	}
+	return UsageLimit{Limited: proto.Int32(int32(limit))}
+}
+
+func (l UsageLimit) MarshalJSON() ([]byte, error) {
+	if l.Limited == nil {
+		return json.Marshal("unlimited")
+	}
+	return json.Marshal(map[string]int32{"limited": *l.Limited})
+}
+
+func (l *UsageLimit) UnmarshalJSON(b []byte) error {
+	var unlimited string
+	if err := json.Unmarshal(b, &unlimited); err == nil {
+		if unlimited != "unlimited" {
+			return fmt.Errorf("invalid usage limit %q", unlimited)
+		}
+		*l = UsageLimit{Unlimited: true}
+		return nil
+	}
+	var limited struct {
+		Limited *int32 `json:"limited"`
+	}
+	if err := json.Unmarshal(b, &limited); err != nil {
+		return err
+	}
+	if limited.Limited == nil {
+		return fmt.Errorf("invalid usage limit %s", b)
+	}
+	*l = UsageLimit{Limited: limited.Limited}
+	return nil
+}
+
+// AuthenticatedUser is the user as the Zed cloud API returns it.
+func (u UserRecord) AuthenticatedUser() AuthenticatedUser {
+	user := AuthenticatedUser{
+		ID:          int(u.ID),
+		MetricsID:   u.MetricsID,
+		AvatarURL:   u.AvatarURL,
+		GithubLogin: u.Login,
+		IsStaff:     u.Staff,
+	}
+	if u.Name != "" {
+		user.Name = proto.String(u.Name)
+	}
+	if u.AcceptedTosAt != nil {
+		user.AcceptedTosAt = proto.String(u.AcceptedTosAt.UTC().Format(time.RFC3339))
+	}
+	return user
+}
+
+func NewGetAuthenticatedUsersResponse(user UserRecord, planDefinition PlanDefinition, featureFlags []string, usage Usage, period UsagePeriod) GetAuthenticatedUserResponse {
+	plan, _ := ParsePlan(planDefinition.ZedPlan)
+	limits := planDefinition.Limits
+	var trialStartedAt *string
+	if plan == ZedProTrial {
+		trialStartedAt = proto.String(user.CreatedAt.UTC().Format(time.RFC3339))
+	}
 	return GetAuthenticatedUserResponse{
-		User: AuthenticatedUser{
-			ID:        1,
-			MetricsID: "",
-			AvatarURL: "",
-			// TODO: Fix me
-			GithubLogin:   "",
-			Name:          nil,
-			IsStaff:       false,
-			AcceptedTosAt: proto.String(time.Now().UTC().Format(time.RFC3339)),
-		},
-		FeatureFlags: []string{},
+		User:         user.AuthenticatedUser(),
+		FeatureFlags: featureFlags,
 		Plan: PlanInfo{
-			Plan:               "Free",
-			SubscriptionPeriod: nil,
+			Plan: plan.String(),
+			SubscriptionPeriod: &SubscriptionPeriod{
+				StartedAt: period.Start.Format(time.RFC3339),
+				EndedAt:   period.End.Format(time.RFC3339),
+			},
 			Usage: CurrentUsage{
 				ModelRequests: UsageData{
 					Used:  0,
-					Limit: "unlimited",
+					Limit: NewUsageLimit(0),
 				},
 				EditPredictions: UsageData{
-					Used:  0,
-					Limit: "unlimited",
+					Used:  uint32(usage.EditPredictions),
+					Limit: NewUsageLimit(limits.EditPredictions),
 				},
 			},
-			TrialStartedAt:             proto.String(time.Now().UTC().Format(time.RFC3339)),
+			TrialStartedAt:             trialStartedAt,
 			IsUsageBasedBillingEnabled: false,
 			IsAccountTooYoung:          false,
 			HasOverdueInvoices:         false,
@@ -120,10 +199,10 @@ func NewGetAuthenticatedUsersResponse() GetAuthenticatedUserResponse {
 	}
 }
 
-func NewLLMToken() CreateLlmTokenResponse {
+func NewLLMToken(token string) CreateLlmTokenResponse {
 	return CreateLlmTokenResponse{
 		Token: LlmToken{
-			Token:                  "le-token",
+			Token:                  token,
 			SupportsEditPrediction: true,
 		},
 	}
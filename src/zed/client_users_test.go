@@ -0,0 +1,61 @@
+package zed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatedUser(t *testing.T) {
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	user, err := users.Resolve("device:a", UserProfile{Login: "jane", Name: "Jane", AvatarURL: "https://example.com/jane.png"})
+	assert.Nil(t, err)
+	user, err = users.Update(user.ID, func(u *UserRecord) {
+		u.Staff = true
+		u.Plan = ZedPro.String()
+	})
+	assert.Nil(t, err)
+	token, err := users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	router := api.Router()
+
+	request := func(method, url, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", "/client/users/me", fmt.Sprintf("%d wrong", user.ID))
+	assert.Equal(t, 401, w.Code)
+
+	w = request("GET", "/client/users/me", fmt.Sprintf("%d %s", user.ID, token))
+	assert.Equal(t, 200, w.Code)
+	var me GetAuthenticatedUserResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &me))
+	assert.Equal(t, int(user.ID), me.User.ID)
+	assert.Equal(t, "jane", me.User.GithubLogin)
+	assert.Equal(t, "Jane", *me.User.Name)
+	assert.Equal(t, user.MetricsID, me.User.MetricsID)
+	assert.True(t, me.User.IsStaff)
+	assert.Nil(t, me.User.AcceptedTosAt)
+	assert.Equal(t, "ZedPro", me.Plan.Plan)
+	assert.ElementsMatch(t, defaultFeatureFlags, me.FeatureFlags)
+
+	w = request("POST", "/client/terms_of_service/accept", fmt.Sprintf("%d %s", user.ID, token))
+	assert.Equal(t, 200, w.Code)
+	var accepted AcceptTermsOfServiceResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+	assert.NotNil(t, accepted.User.AcceptedTosAt)
+
+	stored, _ := users.Get(user.ID)
+	assert.Equal(t, stored.AcceptedTosAt.Format(time.RFC3339), *accepted.User.AcceptedTosAt)
+}
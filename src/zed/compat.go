@@ -0,0 +1,170 @@
+package zed
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+// CURRENT_SCHEMA_VERSION is the highest extension schema version Zed loads.
+const CURRENT_SCHEMA_VERSION = 1
+
+// wasmAPIVersions lists the first Zed release that loads each extension wasm API
+// version, as documented in the "Compatible Zed versions" table of
+// https://github.com/zed-industries/zed/blob/main/crates/extension_api/README.md.
+var wasmAPIVersions = []struct {
+	zed     SemanticVersion
+	wasmAPI SemanticVersion
+}{
+	{zed: SemanticVersion{0, 128, 0}, wasmAPI: SemanticVersion{0, 0, 1}},
+	{zed: SemanticVersion{0, 129, 0}, wasmAPI: SemanticVersion{0, 0, 4}},
+	{zed: SemanticVersion{0, 130, 0}, wasmAPI: SemanticVersion{0, 0, 5}},
+	{zed: SemanticVersion{0, 131, 0}, wasmAPI: SemanticVersion{0, 0, 6}},
+	{zed: SemanticVersion{0, 149, 0}, wasmAPI: SemanticVersion{0, 1, 0}},
+	{zed: SemanticVersion{0, 162, 0}, wasmAPI: SemanticVersion{0, 2, 0}},
+	{zed: SemanticVersion{0, 178, 0}, wasmAPI: SemanticVersion{0, 3, 0}},
+	{zed: SemanticVersion{0, 184, 0}, wasmAPI: SemanticVersion{0, 4, 0}},
+	{zed: SemanticVersion{0, 186, 0}, wasmAPI: SemanticVersion{0, 5, 0}},
+	{zed: SemanticVersion{0, 192, 0}, wasmAPI: SemanticVersion{0, 6, 0}},
+	{zed: SemanticVersion{0, 205, 0}, wasmAPI: SemanticVersion{0, 7, 0}},
+}
+
+// ExtensionSupport is the range of extension versions a Zed release can load.
+type ExtensionSupport struct {
+	ZedVersion        SemanticVersion
+	MaxSchemaVersion  int
+	MinWasmAPIVersion SemanticVersion
+	MaxWasmAPIVersion SemanticVersion
+}
+
+// ExtensionSupportFor returns what a Zed release can load. Releases newer than the last
+// known entry are assumed to support the newest known wasm API version.
+func ExtensionSupportFor(zedVersion SemanticVersion) (ExtensionSupport, error) {
+	support := ExtensionSupport{
+		ZedVersion:        zedVersion,
+		MaxSchemaVersion:  CURRENT_SCHEMA_VERSION,
+		MinWasmAPIVersion: wasmAPIVersions[0].wasmAPI,
+	}
+	found := false
+	for _, v := range wasmAPIVersions {
+		if zedVersion.Compare(v.zed) >= 0 {
+			support.MaxWasmAPIVersion = v.wasmAPI
+			found = true
+		}
+	}
+	if !found {
+		return ExtensionSupport{}, fmt.Errorf("zed %v predates extension support", zedVersion)
+	}
+	return support, nil
+}
+
+// Check returns whether an extension can be loaded, and if not, why.
+func (s ExtensionSupport) Check(ext Extension) (bool, string) {
+	if ext.SchemaVersion > s.MaxSchemaVersion {
+		return false, fmt.Sprintf("schema version %d is newer than %d", ext.SchemaVersion, s.MaxSchemaVersion)
+	}
+	// Extensions without wasm (themes, grammars, ...) only depend on the schema.
+	if ext.WasmAPIVersion == "" {
+		return true, ""
+	}
+	v, err := ParseSemanticVersion(ext.WasmAPIVersion)
+	if err != nil {
+		return false, fmt.Sprintf("invalid wasm API version %q", ext.WasmAPIVersion)
+	}
+	if v.Compare(s.MaxWasmAPIVersion) > 0 {
+		return false, fmt.Sprintf("wasm API %v is newer than %v", v, s.MaxWasmAPIVersion)
+	}
+	if v.Compare(s.MinWasmAPIVersion) < 0 {
+		return false, fmt.Sprintf("wasm API %v is older than %v", v, s.MinWasmAPIVersion)
+	}
+	return true, ""
+}
+
+type CompatEntry struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Version        string `json:"version"`
+	SchemaVersion  int    `json:"schema_version"`
+	WasmAPIVersion string `json:"wasm_api_version"`
+	Compatible     bool   `json:"compatible"`
+	Reason         string `json:"reason,omitempty"`
+	Mirrored       bool   `json:"mirrored"`
+}
+
+// CompatReport lists which extensions of the local mirror a Zed release can load.
+type CompatReport struct {
+	ZedVersion        string        `json:"zed_version"`
+	MaxSchemaVersion  int           `json:"max_schema_version"`
+	MinWasmAPIVersion string        `json:"min_wasm_api_version"`
+	MaxWasmAPIVersion string        `json:"max_wasm_api_version"`
+	Compatible        int           `json:"compatible"`
+	Incompatible      int           `json:"incompatible"`
+	Extensions        []CompatEntry `json:"extensions"`
+}
+
+// IncompatibleOnly returns a copy of the report without compatible extensions.
+func (r CompatReport) IncompatibleOnly() CompatReport {
+	entries := []CompatEntry{}
+	for _, e := range r.Extensions {
+		if !e.Compatible {
+			entries = append(entries, e)
+		}
+	}
+	r.Extensions = entries
+	return r
+}
+
+// CompatReport checks the local extension index against a Zed version. An empty
+// zedVersion uses the mirrored latest release.
+func (c *Client) CompatReport(zedVersion string) (CompatReport, error) {
+	if zedVersion == "" {
+		latest, err := c.LoadLatestZedVersionFromFile(path.Join(c.extensionsLocalDir, "latest_release.json"))
+		if err != nil {
+			return CompatReport{}, err
+		}
+		zedVersion = latest.Version
+	}
+	v, err := ParseSemanticVersion(zedVersion)
+	if err != nil {
+		return CompatReport{}, err
+	}
+	support, err := ExtensionSupportFor(v)
+	if err != nil {
+		return CompatReport{}, err
+	}
+
+	extensions, err := c.LoadExtensionIndex(path.Join(c.extensionsLocalDir, "extensions.json"))
+	if err != nil {
+		return CompatReport{}, err
+	}
+
+	report := CompatReport{
+		ZedVersion:        v.String(),
+		MaxSchemaVersion:  support.MaxSchemaVersion,
+		MinWasmAPIVersion: support.MinWasmAPIVersion.String(),
+		MaxWasmAPIVersion: support.MaxWasmAPIVersion.String(),
+		Extensions:        []CompatEntry{},
+	}
+	for _, ext := range extensions {
+		compatible, reason := support.Check(ext)
+		_, err := os.Stat(path.Join(c.extensionsLocalDir, ext.ID+".tar.gz"))
+		report.Extensions = append(report.Extensions, CompatEntry{
+			ID:             ext.ID,
+			Name:           ext.Name,
+			Version:        ext.Version,
+			SchemaVersion:  ext.SchemaVersion,
+			WasmAPIVersion: ext.WasmAPIVersion,
+			Compatible:     compatible,
+			Reason:         reason,
+			Mirrored:       err == nil,
+		})
+		if compatible {
+			report.Compatible++
+		} else {
+			report.Incompatible++
+		}
+	}
+	sort.Slice(report.Extensions, func(i, j int) bool { return report.Extensions[i].ID < report.Extensions[j].ID })
+	return report, nil
+}
@@ -0,0 +1,50 @@
+package zed
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtensionSupportFor(t *testing.T) {
+	_, err := ExtensionSupportFor(SemanticVersion{0, 120, 0})
+	assert.NotNil(t, err)
+
+	support, err := ExtensionSupportFor(SemanticVersion{0, 170, 3})
+	assert.Nil(t, err)
+	assert.Equal(t, SemanticVersion{0, 2, 0}, support.MaxWasmAPIVersion)
+
+	ok, _ := support.Check(Extension{SchemaVersion: 1, WasmAPIVersion: "0.1.0"})
+	assert.True(t, ok)
+	ok, _ = support.Check(Extension{SchemaVersion: 1})
+	assert.True(t, ok)
+	ok, reason := support.Check(Extension{SchemaVersion: 1, WasmAPIVersion: "0.3.0"})
+	assert.False(t, ok)
+	assert.Equal(t, "wasm API 0.3.0 is newer than 0.2.0", reason)
+	ok, _ = support.Check(Extension{SchemaVersion: 2})
+	assert.False(t, ok)
+}
+
+func TestCompatReport(t *testing.T) {
+	zc := NewZedClient(1)
+	zc.WithExtensionsLocalDir(t.TempDir())
+	assert.Nil(t, zc.StoreExtensionIndex(Extensions{
+		{ID: "new", SchemaVersion: 1, WasmAPIVersion: "0.5.0"},
+		{ID: "old", SchemaVersion: 1, WasmAPIVersion: "0.0.6"},
+	}))
+	assert.Nil(t, zc.StoreExtensionArchive(Extension{ID: "old"}, []byte{}))
+	assert.Nil(t, zc.StoreLatestRelease(Version{Version: "0.185.1"}, ReleaseNotes{}))
+
+	report, err := zc.CompatReport("")
+	assert.Nil(t, err)
+	assert.Equal(t, "0.185.1", report.ZedVersion)
+	assert.Equal(t, 1, report.Compatible)
+	assert.Equal(t, 1, report.Incompatible)
+	assert.Equal(t, "new", report.IncompatibleOnly().Extensions[0].ID)
+	assert.False(t, report.Extensions[0].Mirrored)
+	assert.True(t, report.Extensions[1].Mirrored)
+
+	report, err = zc.CompatReport("0.186.0")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Incompatible)
+}
@@ -0,0 +1,175 @@
+package zed
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"zedex/zed/pb"
+)
+
+// ContactStore keeps the contacts of users and the pending requests to become contacts
+// in memory, loaded from a Repository at startup and written through to it on every
+// change. A ContactStore without a repository keeps its state in memory only.
+type ContactStore struct {
+	repo Repository
+	// contacts has both directions of each contact, by user ID.
+	contacts map[uint64]map[uint64]bool
+	// requests are the users asking, by the ID of the user asked.
+	requests map[uint64]map[uint64]bool
+	mtx      sync.Mutex
+}
+
+func NewContactStore(repo Repository) (*ContactStore, error) {
+	s := &ContactStore{
+		repo:     repo,
+		contacts: map[uint64]map[uint64]bool{},
+		requests: map[uint64]map[uint64]bool{},
+	}
+	if repo == nil {
+		return s, nil
+	}
+
+	contacts, err := repo.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	for userId, cs := range contacts {
+		for _, c := range cs {
+			s.link(s.contacts, userId, c.UserId)
+			s.link(s.contacts, c.UserId, userId)
+		}
+	}
+	requests, err := repo.ContactRequests()
+	if err != nil {
+		return nil, err
+	}
+	for responderId, rs := range requests {
+		for _, r := range rs {
+			s.link(s.requests, responderId, r.RequesterId)
+		}
+	}
+	return s, nil
+}
+
+func (s *ContactStore) link(m map[uint64]map[uint64]bool, a, b uint64) {
+	if m[a] == nil {
+		m[a] = map[uint64]bool{}
+	}
+	m[a][b] = true
+}
+
+func sortedKeys(m map[uint64]bool) []uint64 {
+	keys := []uint64{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, cmp.Compare)
+	return keys
+}
+
+// Contacts returns the IDs of the contacts of a user.
+func (s *ContactStore) Contacts(userId uint64) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return sortedKeys(s.contacts[userId])
+}
+
+// IncomingRequests returns the IDs of the users asking a user to become contacts.
+func (s *ContactStore) IncomingRequests(userId uint64) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return sortedKeys(s.requests[userId])
+}
+
+// OutgoingRequests returns the IDs of the users a user asked to become contacts.
+func (s *ContactStore) OutgoingRequests(userId uint64) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := []uint64{}
+	for responderId, requesters := range s.requests {
+		if requesters[userId] {
+			ids = append(ids, responderId)
+		}
+	}
+	slices.SortFunc(ids, cmp.Compare)
+	return ids
+}
+
+// Request asks a user to become a contact of another. If the other user asked already,
+// they become contacts right away, which is reported as accepted.
+func (s *ContactStore) Request(requesterId, responderId uint64) (accepted bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch {
+	case requesterId == responderId:
+		return false, rpcErrorf(pb.ErrorCode_Internal, "can't add yourself as a contact")
+	case s.contacts[requesterId][responderId]:
+		return false, rpcErrorf(pb.ErrorCode_Internal, "user %v is a contact already", responderId)
+	case s.requests[responderId][requesterId]:
+		return false, rpcErrorf(pb.ErrorCode_Internal, "user %v was asked already", responderId)
+	case s.requests[requesterId][responderId]:
+		return true, s.acceptUnsafe(requesterId, responderId)
+	}
+	if s.repo != nil {
+		if err := s.repo.PutContactRequest(responderId, requesterId); err != nil {
+			return false, err
+		}
+	}
+	s.link(s.requests, responderId, requesterId)
+	return false, nil
+}
+
+func (s *ContactStore) acceptUnsafe(responderId, requesterId uint64) error {
+	if s.repo != nil {
+		if err := s.repo.PutContact(responderId, requesterId); err != nil {
+			return err
+		}
+	}
+	s.link(s.contacts, responderId, requesterId)
+	s.link(s.contacts, requesterId, responderId)
+	return s.deleteRequestUnsafe(responderId, requesterId)
+}
+
+func (s *ContactStore) deleteRequestUnsafe(responderId, requesterId uint64) error {
+	if s.repo != nil {
+		if err := s.repo.DeleteContactRequest(responderId, requesterId); err != nil {
+			return err
+		}
+	}
+	delete(s.requests[responderId], requesterId)
+	return nil
+}
+
+// Respond accepts or declines the request of a user to become a contact.
+func (s *ContactStore) Respond(responderId, requesterId uint64, accept bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.requests[responderId][requesterId] {
+		return rpcErrorf(pb.ErrorCode_Internal, "no contact request from user %v", requesterId)
+	}
+	if accept {
+		return s.acceptUnsafe(responderId, requesterId)
+	}
+	return s.deleteRequestUnsafe(responderId, requesterId)
+}
+
+// Remove removes a contact of a user, or withdraws the request to become one.
+func (s *ContactStore) Remove(userId, contactId uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch {
+	case s.contacts[userId][contactId]:
+		if s.repo != nil {
+			if err := s.repo.DeleteContact(userId, contactId); err != nil {
+				return err
+			}
+		}
+		delete(s.contacts[userId], contactId)
+		delete(s.contacts[contactId], userId)
+		return nil
+	case s.requests[contactId][userId]:
+		return s.deleteRequestUnsafe(contactId, userId)
+	}
+	return rpcErrorf(pb.ErrorCode_Internal, "user %v is not a contact", contactId)
+}
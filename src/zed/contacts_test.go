@@ -0,0 +1,48 @@
+package zed
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContacts(t *testing.T) {
+	contacts, err := NewContactStore(nil)
+	assert.Nil(t, err)
+	alice, bob, carol := uint64(1), uint64(2), uint64(3)
+
+	_, err = contacts.Request(alice, alice)
+	assert.NotNil(t, err)
+	accepted, err := contacts.Request(alice, bob)
+	assert.Nil(t, err)
+	assert.False(t, accepted)
+	_, err = contacts.Request(alice, bob)
+	assert.NotNil(t, err)
+	assert.Equal(t, []uint64{bob}, contacts.OutgoingRequests(alice))
+	assert.Equal(t, []uint64{alice}, contacts.IncomingRequests(bob))
+
+	assert.Nil(t, contacts.Respond(bob, alice, true))
+	assert.NotNil(t, contacts.Respond(bob, alice, true))
+	assert.Equal(t, []uint64{bob}, contacts.Contacts(alice))
+	assert.Equal(t, []uint64{alice}, contacts.Contacts(bob))
+	assert.Empty(t, contacts.IncomingRequests(bob))
+	_, err = contacts.Request(bob, alice)
+	assert.NotNil(t, err)
+
+	// Asking a user that asked already accepts their request.
+	_, err = contacts.Request(carol, alice)
+	assert.Nil(t, err)
+	accepted, err = contacts.Request(alice, carol)
+	assert.Nil(t, err)
+	assert.True(t, accepted)
+	assert.Equal(t, []uint64{bob, carol}, contacts.Contacts(alice))
+
+	// Removing withdraws requests too.
+	_, err = contacts.Request(bob, carol)
+	assert.Nil(t, err)
+	assert.Nil(t, contacts.Remove(bob, carol))
+	assert.Empty(t, contacts.IncomingRequests(carol))
+	assert.Nil(t, contacts.Remove(bob, alice))
+	assert.Equal(t, []uint64{carol}, contacts.Contacts(alice))
+	assert.NotNil(t, contacts.Remove(bob, alice))
+}
@@ -0,0 +1,102 @@
+package zed
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// AtomFeed is the subset of RFC 4287 needed to publish the change journal.
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    AtomLink    `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type AtomEntry struct {
+	ID       string       `xml:"id"`
+	Title    string       `xml:"title"`
+	Updated  string       `xml:"updated"`
+	Category AtomCategory `xml:"category"`
+	Content  string       `xml:"content"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// JSONFeed follows https://www.jsonfeed.org/version/1.1/.
+type JSONFeed struct {
+	Version string         `json:"version"`
+	Title   string         `json:"title"`
+	FeedURL string         `json:"feed_url"`
+	Items   []JSONFeedItem `json:"items"`
+}
+
+type JSONFeedItem struct {
+	ID            string   `json:"id"`
+	Title         string   `json:"title"`
+	ContentText   string   `json:"content_text"`
+	DatePublished string   `json:"date_published"`
+	Tags          []string `json:"tags"`
+	Change        Change   `json:"_zedex"`
+}
+
+func changeEntryID(ch Change) string {
+	return fmt.Sprintf("urn:zedex:change:%d:%s:%s:%s", ch.Timestamp.UnixNano(), ch.Kind, ch.ID, ch.Action)
+}
+
+// NewAtomFeed renders changes, newest first, as an Atom feed served from feedURL.
+func NewAtomFeed(feedURL string, changes []Change) AtomFeed {
+	updated := time.Unix(0, 0).UTC()
+	if len(changes) > 0 {
+		updated = changes[0].Timestamp
+	}
+
+	feed := AtomFeed{
+		ID:      feedURL,
+		Title:   "zedex changes",
+		Updated: updated.Format(time.RFC3339),
+		Link:    AtomLink{Href: feedURL, Rel: "self"},
+		Entries: []AtomEntry{},
+	}
+	for _, ch := range changes {
+		feed.Entries = append(feed.Entries, AtomEntry{
+			ID:       changeEntryID(ch),
+			Title:    ch.Title(),
+			Updated:  ch.Timestamp.Format(time.RFC3339),
+			Category: AtomCategory{Term: ch.Kind + "-" + ch.Action},
+			Content:  ch.Title(),
+		})
+	}
+	return feed
+}
+
+// NewJSONFeed renders changes, newest first, as a JSON feed served from feedURL.
+func NewJSONFeed(feedURL string, changes []Change) JSONFeed {
+	feed := JSONFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   "zedex changes",
+		FeedURL: feedURL,
+		Items:   []JSONFeedItem{},
+	}
+	for _, ch := range changes {
+		feed.Items = append(feed.Items, JSONFeedItem{
+			ID:            changeEntryID(ch),
+			Title:         ch.Title(),
+			ContentText:   ch.Title(),
+			DatePublished: ch.Timestamp.Format(time.RFC3339),
+			Tags:          []string{ch.Kind, ch.Action},
+			Change:        ch,
+		})
+	}
+	return feed
+}
@@ -0,0 +1,190 @@
+package zed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zedex/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultFeatureFlags are enabled for everyone until a flags file is written.
+var defaultFeatureFlags = []string{"zed-pro", "notebooks", "debugger", "llm-closed-beta", "thread-auto-capture"}
+
+// FeatureFlag enables a Zed feature flag for everyone, or for some users.
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Everyone enables the flag for all users, ignoring the other rules.
+	Everyone bool `json:"everyone,omitempty"`
+	// Users are user IDs or logins.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Percentage enables the flag for a stable share (0-100) of all users.
+	Percentage int `json:"percentage,omitempty"`
+}
+
+// EnabledFor returns whether the flag is enabled for a user.
+func (f FeatureFlag) EnabledFor(user UserRecord) bool {
+	if f.Everyone {
+		return true
+	}
+	id := strconv.FormatUint(user.ID, 10)
+	if slices.ContainsFunc(f.Users, func(u string) bool { return u == id || strings.EqualFold(u, user.Login) }) {
+		return true
+	}
+	if slices.ContainsFunc(f.Groups, func(g string) bool { return slices.Contains(user.Groups, g) }) {
+		return true
+	}
+	// Hash the flag name too, so each flag rolls out to a different set of users.
+	return f.Percentage > 0 && utils.StringToUInt64Hash(f.Name+":"+id)%100 < uint64(f.Percentage)
+}
+
+func (f FeatureFlag) Validate() error {
+	if f.Name == "" || strings.ContainsAny(f.Name, " \t\n/") {
+		return fmt.Errorf("invalid flag name %q", f.Name)
+	}
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return fmt.Errorf("percentage must be between 0 and 100, got %d", f.Percentage)
+	}
+	return nil
+}
+
+// FlagStore keeps the feature flags in a JSON file, which is reread when it changes on
+// disk so `zedex flags` applies to a running server.
+type FlagStore struct {
+	path    string
+	flags   map[string]FeatureFlag
+	modTime time.Time
+	mtx     sync.Mutex
+}
+
+func NewFlagStore(path string) (*FlagStore, error) {
+	s := &FlagStore{path: path}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FlagStore) loadUnsafe() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.flags = map[string]FeatureFlag{}
+		for _, name := range defaultFeatureFlags {
+			s.flags[name] = FeatureFlag{Name: name, Everyone: true}
+		}
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	flags := []FeatureFlag{}
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return fmt.Errorf("failed to read %v: %w", s.path, err)
+	}
+	s.flags = map[string]FeatureFlag{}
+	for _, f := range flags {
+		s.flags[f.Name] = f
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *FlagStore) saveUnsafe() error {
+	b, err := json.MarshalIndent(s.flagsUnsafe(), "", "\t")
+	if err != nil {
+		return err
+	}
+	utils.CreateDirIfNotExists(path.Dir(s.path))
+	if err := utils.WriteFileAtomic(s.path, b, 0o644); err != nil {
+		return err
+	}
+	// Force a reread, the modification time may not change within the same tick.
+	s.modTime = time.Time{}
+	return nil
+}
+
+func (s *FlagStore) flagsUnsafe() []FeatureFlag {
+	flags := []FeatureFlag{}
+	for _, f := range s.flags {
+		flags = append(flags, f)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// Flags returns all flags ordered by name.
+func (s *FlagStore) Flags() ([]FeatureFlag, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return []FeatureFlag{}, err
+	}
+	return s.flagsUnsafe(), nil
+}
+
+// Set creates or replaces a flag.
+func (s *FlagStore) Set(flag FeatureFlag) error {
+	if err := flag.Validate(); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return err
+	}
+	s.flags[flag.Name] = flag
+	return s.saveUnsafe()
+}
+
+func (s *FlagStore) Delete(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return err
+	}
+	if _, ok := s.flags[name]; !ok {
+		return fmt.Errorf("unknown flag %q", name)
+	}
+	delete(s.flags, name)
+	return s.saveUnsafe()
+}
+
+// FlagsFor returns the names of the flags enabled for a user, ordered by name. If the
+// flags file can't be read, the last flags read are used.
+func (s *FlagStore) FlagsFor(user UserRecord) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		log.Errorf("failed to load feature flags: %v", err)
+	}
+	enabled := []string{}
+	for _, f := range s.flagsUnsafe() {
+		if f.EnabledFor(user) {
+			enabled = append(enabled, f.Name)
+		}
+	}
+	return enabled
+}
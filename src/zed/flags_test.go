@@ -0,0 +1,59 @@
+package zed
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFlagStore(t *testing.T) *FlagStore {
+	flags, err := NewFlagStore(path.Join(t.TempDir(), "flags.json"))
+	assert.Nil(t, err)
+	return flags
+}
+
+func TestFeatureFlags(t *testing.T) {
+	file := path.Join(t.TempDir(), "flags.json")
+	flags, err := NewFlagStore(file)
+	assert.Nil(t, err)
+	jane := UserRecord{ID: 1, Login: "jane", Groups: []string{"pilot"}}
+	john := UserRecord{ID: 2, Login: "john"}
+
+	// Without a flags file, the default flags are enabled for everyone.
+	assert.Equal(t, flags.FlagsFor(john), flags.FlagsFor(jane))
+	assert.Contains(t, flags.FlagsFor(john), "debugger")
+
+	assert.Nil(t, flags.Set(FeatureFlag{Name: "debugger", Groups: []string{"pilot"}}))
+	assert.Nil(t, flags.Set(FeatureFlag{Name: "notebooks", Users: []string{"JOHN"}}))
+	assert.Nil(t, flags.Set(FeatureFlag{Name: "agent", Users: []string{"1"}}))
+	assert.NotNil(t, flags.Set(FeatureFlag{Name: "rollout", Percentage: 101}))
+	assert.NotNil(t, flags.Set(FeatureFlag{Name: "in valid"}))
+
+	// Another process, e.g. `zedex flags`, sees the changes.
+	other, err := NewFlagStore(file)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"agent", "debugger", "llm-closed-beta", "thread-auto-capture", "zed-pro"}, other.FlagsFor(jane))
+	assert.Equal(t, []string{"llm-closed-beta", "notebooks", "thread-auto-capture", "zed-pro"}, other.FlagsFor(john))
+
+	assert.Nil(t, other.Delete("zed-pro"))
+	assert.NotNil(t, other.Delete("zed-pro"))
+	assert.NotContains(t, flags.FlagsFor(jane), "zed-pro")
+}
+
+func TestFeatureFlagPercentage(t *testing.T) {
+	flag := FeatureFlag{Name: "rollout", Percentage: 30}
+	enabled := 0
+	for id := uint64(1); id <= 1000; id++ {
+		user := UserRecord{ID: id}
+		if flag.EnabledFor(user) {
+			enabled++
+		}
+		// The same user always gets the same result.
+		assert.Equal(t, flag.EnabledFor(user), flag.EnabledFor(user))
+	}
+	assert.InDelta(t, 300, enabled, 60)
+
+	assert.False(t, FeatureFlag{Name: "off"}.EnabledFor(UserRecord{ID: 1}))
+	assert.True(t, FeatureFlag{Name: "all", Percentage: 100}.EnabledFor(UserRecord{ID: 1}))
+}
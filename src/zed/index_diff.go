@@ -0,0 +1,128 @@
+package zed
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"zedex/utils"
+)
+
+// FieldChange is a single field that differs between two versions of an extension.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// ExtensionUpdate is an extension present in both indexes with changed fields.
+type ExtensionUpdate struct {
+	ID                string        `json:"id"`
+	Name              string        `json:"name"`
+	Changes           []FieldChange `json:"changes"`
+	RepositoryChanged bool          `json:"repository_changed"`
+}
+
+// IndexDiff is the difference between two extension indexes.
+type IndexDiff struct {
+	Added   Extensions        `json:"added"`
+	Removed Extensions        `json:"removed"`
+	Updated []ExtensionUpdate `json:"updated"`
+}
+
+// DiffExtensionIndex compares two extension indexes field by field. Download counts
+// and publish dates are ignored, as they change without the extension changing.
+func DiffExtensionIndex(before, after Extensions) IndexDiff {
+	oldByID := map[string]Extension{}
+	for _, ext := range before {
+		oldByID[ext.ID] = ext
+	}
+
+	diff := IndexDiff{Added: Extensions{}, Removed: Extensions{}, Updated: []ExtensionUpdate{}}
+	for _, ext := range after {
+		o, exists := oldByID[ext.ID]
+		delete(oldByID, ext.ID)
+		if !exists {
+			diff.Added = append(diff.Added, ext)
+			continue
+		}
+		if changes := diffExtension(o, ext); len(changes) > 0 {
+			diff.Updated = append(diff.Updated, ExtensionUpdate{
+				ID:                ext.ID,
+				Name:              ext.Name,
+				Changes:           changes,
+				RepositoryChanged: o.Repository != ext.Repository,
+			})
+		}
+	}
+	for _, ext := range oldByID {
+		diff.Removed = append(diff.Removed, ext)
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].ID < diff.Added[j].ID })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].ID < diff.Removed[j].ID })
+	sort.Slice(diff.Updated, func(i, j int) bool { return diff.Updated[i].ID < diff.Updated[j].ID })
+	return diff
+}
+
+func diffExtension(before, after Extension) []FieldChange {
+	changes := []FieldChange{}
+	add := func(field, o, n string) {
+		if o != n {
+			changes = append(changes, FieldChange{Field: field, Old: o, New: n})
+		}
+	}
+	add("name", before.Name, after.Name)
+	add("version", before.Version, after.Version)
+	add("description", before.Description, after.Description)
+	add("repository", before.Repository, after.Repository)
+	if !slices.Equal(before.Authors, after.Authors) {
+		add("authors", strings.Join(before.Authors, ", "), strings.Join(after.Authors, ", "))
+	}
+	if !slices.Equal(before.Provides, after.Provides) {
+		add("provides", strings.Join(before.Provides, ", "), strings.Join(after.Provides, ", "))
+	}
+	add("schema_version", fmt.Sprint(before.SchemaVersion), fmt.Sprint(after.SchemaVersion))
+	add("wasm_api_version", before.WasmAPIVersion, after.WasmAPIVersion)
+	return changes
+}
+
+// RepositoryChanges returns the updates that moved an existing extension to another
+// repository, which may mean the extension was taken over by someone else.
+func (d IndexDiff) RepositoryChanges() []ExtensionUpdate {
+	changed := []ExtensionUpdate{}
+	for _, u := range d.Updated {
+		if u.RepositoryChanged {
+			changed = append(changed, u)
+		}
+	}
+	return changed
+}
+
+func (d IndexDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0
+}
+
+// String renders the diff for humans, flagging repository changes with "!!".
+func (d IndexDiff) String() string {
+	var sb strings.Builder
+	for _, ext := range d.Added {
+		fmt.Fprintf(&sb, "+ %s %s (%s)\n", ext.ID, ext.Version, ext.Repository)
+	}
+	for _, ext := range d.Removed {
+		fmt.Fprintf(&sb, "- %s %s\n", ext.ID, ext.Version)
+	}
+	for _, u := range d.Updated {
+		fmt.Fprintf(&sb, "%s %s\n", utils.IfElse(u.RepositoryChanged, "!!", "~"), u.ID)
+		for _, ch := range u.Changes {
+			fmt.Fprintf(&sb, "    %s: %q -> %q\n", ch.Field, ch.Old, ch.New)
+		}
+	}
+	fmt.Fprintf(&sb, "%d added, %d removed, %d updated", len(d.Added), len(d.Removed), len(d.Updated))
+	if n := len(d.RepositoryChanges()); n > 0 {
+		fmt.Fprintf(&sb, ", %d with a changed repository (!!)", n)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,35 @@
+package zed
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffExtensionIndex(t *testing.T) {
+	before := Extensions{
+		{ID: "html", Version: "0.1.0", Repository: "https://github.com/zed-industries/zed", Authors: []string{"a"}, SchemaVersion: 1, WasmAPIVersion: "0.1.0", DownloadCount: 1},
+		{ID: "toml", Version: "0.1.0", Repository: "https://github.com/zed-extensions/toml", DownloadCount: 1},
+	}
+	after := Extensions{
+		{ID: "html", Version: "0.1.0", Repository: "https://github.com/zed-industries/zed", Authors: []string{"a", "b"}, SchemaVersion: 1, WasmAPIVersion: "0.2.0", DownloadCount: 2},
+		{ID: "toml", Version: "0.1.1", Repository: "https://github.com/someone-else/toml", DownloadCount: 2},
+	}
+
+	diff := DiffExtensionIndex(before, after)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Equal(t, []ExtensionUpdate{
+		{ID: "html", Changes: []FieldChange{
+			{Field: "authors", Old: "a", New: "a, b"},
+			{Field: "wasm_api_version", Old: "0.1.0", New: "0.2.0"},
+		}},
+		{ID: "toml", RepositoryChanged: true, Changes: []FieldChange{
+			{Field: "version", Old: "0.1.0", New: "0.1.1"},
+			{Field: "repository", Old: "https://github.com/zed-extensions/toml", New: "https://github.com/someone-else/toml"},
+		}},
+	}, diff.Updated)
+	assert.Len(t, diff.RepositoryChanges(), 1)
+	assert.Contains(t, diff.String(), "!! toml")
+	assert.True(t, DiffExtensionIndex(before, before).Empty())
+}
@@ -0,0 +1,162 @@
+package zed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"zedex/utils"
+	"zedex/zed/pb"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// LIVEKIT_TOKEN_TTL is how long Zed may use a token to connect to the LiveKit room of a
+// call, it stays connected after that.
+const LIVEKIT_TOKEN_TTL = 6 * time.Hour
+
+// LIVEKIT_REQUEST_TIMEOUT bounds requests to the LiveKit server API, which are made while
+// handling the messages of a connection.
+const LIVEKIT_REQUEST_TIMEOUT = 5 * time.Second
+
+// LiveKitConfig configures the self-hosted LiveKit server Zed uses for the audio and
+// screen sharing of calls.
+type LiveKitConfig struct {
+	URL       string
+	APIKey    string
+	APISecret string
+}
+
+// LiveKitConfigFromEnv reads the LIVEKIT_* environment variables.
+func LiveKitConfigFromEnv() LiveKitConfig {
+	return LiveKitConfig{
+		URL:       utils.EnvWithFallback("LIVEKIT_URL", ""),
+		APIKey:    utils.EnvWithFallback("LIVEKIT_API_KEY", ""),
+		APISecret: utils.EnvWithFallback("LIVEKIT_API_SECRET", ""),
+	}
+}
+
+// LiveKitVideoGrant is what a LiveKit token allows in a room.
+type LiveKitVideoGrant struct {
+	Room           string `json:"room"`
+	RoomJoin       bool   `json:"roomJoin"`
+	CanPublish     bool   `json:"canPublish"`
+	CanPublishData bool   `json:"canPublishData"`
+	CanSubscribe   bool   `json:"canSubscribe"`
+	// RoomAdmin allows managing the participants of the room through the server API.
+	RoomAdmin bool `json:"roomAdmin,omitempty"`
+}
+
+// LiveKitClaims are the claims of LiveKit access tokens, issued by the API key to a
+// participant identified by their user ID.
+type LiveKitClaims struct {
+	jwt.RegisteredClaims
+	Video LiveKitVideoGrant `json:"video"`
+}
+
+// LiveKitTokens issues the HS256 tokens participants of calls join LiveKit rooms with.
+type LiveKitTokens struct {
+	config LiveKitConfig
+	ttl    time.Duration
+	client *http.Client
+}
+
+func NewLiveKitTokens(config LiveKitConfig) *LiveKitTokens {
+	return &LiveKitTokens{
+		config: config,
+		ttl:    LIVEKIT_TOKEN_TTL,
+		client: &http.Client{Timeout: LIVEKIT_REQUEST_TIMEOUT},
+	}
+}
+
+// Issue issues a token for a user to join a LiveKit room, publishing audio and screens
+// unless canPublish is false.
+func (t *LiveKitTokens) Issue(room string, userId uint64, canPublish bool) (string, error) {
+	return t.sign(strconv.FormatUint(userId, 10), LiveKitVideoGrant{
+		Room:           room,
+		RoomJoin:       true,
+		CanPublish:     canPublish,
+		CanPublishData: canPublish,
+		CanSubscribe:   true,
+	})
+}
+
+func (t *LiveKitTokens) sign(identity string, grant LiveKitVideoGrant) (string, error) {
+	now := time.Now()
+	claims := LiveKitClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.config.APIKey,
+			Subject:   identity,
+			ID:        identity,
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.ttl)),
+		},
+		Video: grant,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(t.config.APISecret))
+}
+
+// UpdatePermissions changes whether a participant connected to a LiveKit room publishes,
+// e.g. when their role changed, through the room service of the LiveKit server. Tokens
+// only apply when joining, so Zed's collab server does the same.
+func (t *LiveKitTokens) UpdatePermissions(room string, userId uint64, canPublish bool) error {
+	token, err := t.sign("zedex", LiveKitVideoGrant{Room: room, RoomAdmin: true})
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{
+		"room":     room,
+		"identity": strconv.FormatUint(userId, 10),
+		"permission": map[string]bool{
+			"can_subscribe":    true,
+			"can_publish":      canPublish,
+			"can_publish_data": canPublish,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// The server API is served over HTTP next to the websocket URL clients connect to.
+	url := strings.Replace(strings.Replace(t.config.URL, "wss://", "https://", 1), "ws://", "http://", 1)
+	req, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/twirp/livekit.RoomService/UpdateParticipant", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to update LiveKit participant %v: %v", userId, resp.Status)
+	}
+	return nil
+}
+
+// liveKitCanPublish returns whether a role speaks and shares its screen, only guests
+// listen.
+func liveKitCanPublish(role pb.ChannelRole) bool {
+	return role != pb.ChannelRole_Guest
+}
+
+// ConnectionInfo returns how a participant of a room connects to its LiveKit room. Only
+// guests listen without speaking or sharing their screen.
+func (t *LiveKitTokens) ConnectionInfo(room *pb.Room, userId uint64) (*pb.LiveKitConnectionInfo, error) {
+	canPublish := false
+	for _, p := range room.Participants {
+		if p.UserId == userId {
+			canPublish = liveKitCanPublish(p.Role)
+		}
+	}
+	token, err := t.Issue(room.LivekitRoom, userId, canPublish)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LiveKitConnectionInfo{ServerUrl: t.config.URL, Token: token, CanPublish: canPublish}, nil
+}
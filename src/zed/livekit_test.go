@@ -0,0 +1,89 @@
+package zed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"zedex/zed/pb"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveKitTokens(t *testing.T) {
+	tokens := NewLiveKitTokens(LiveKitConfig{URL: "wss://livekit.example.com", APIKey: "key", APISecret: "secret"})
+	room := &pb.Room{
+		Id:          1,
+		LivekitRoom: "zedex-room-1",
+		Participants: []*pb.Participant{
+			{UserId: 42, Role: pb.ChannelRole_Member},
+			{UserId: 43, Role: pb.ChannelRole_Guest},
+		},
+	}
+	parse := func(token string) LiveKitClaims {
+		t.Helper()
+		claims := LiveKitClaims{}
+		_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+			return []byte("secret"), nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		assert.Nil(t, err)
+		return claims
+	}
+
+	member, err := tokens.ConnectionInfo(room, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, "wss://livekit.example.com", member.ServerUrl)
+	assert.True(t, member.CanPublish)
+	claims := parse(member.Token)
+	assert.Equal(t, "key", claims.Issuer)
+	assert.Equal(t, "42", claims.Subject)
+	assert.WithinDuration(t, time.Now().Add(LIVEKIT_TOKEN_TTL), claims.ExpiresAt.Time, time.Minute)
+	assert.Equal(t, LiveKitVideoGrant{Room: "zedex-room-1", RoomJoin: true, CanPublish: true, CanPublishData: true, CanSubscribe: true}, claims.Video)
+
+	// Guests only listen.
+	guest, err := tokens.ConnectionInfo(room, 43)
+	assert.Nil(t, err)
+	assert.False(t, guest.CanPublish)
+	claims = parse(guest.Token)
+	assert.False(t, claims.Video.CanPublish)
+	assert.True(t, claims.Video.CanSubscribe)
+
+	_, err = jwt.Parse(guest.Token, func(*jwt.Token) (any, error) { return []byte("other"), nil })
+	assert.NotNil(t, err)
+}
+
+func TestLiveKitUpdatePermissions(t *testing.T) {
+	var request map[string]any
+	var claims LiveKitClaims
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/twirp/livekit.RoomService/UpdateParticipant", r.URL.Path)
+		_, err := jwt.ParseWithClaims(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), &claims, func(*jwt.Token) (any, error) {
+			return []byte("secret"), nil
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	tokens := NewLiveKitTokens(LiveKitConfig{URL: strings.Replace(server.URL, "http://", "ws://", 1), APIKey: "key", APISecret: "secret"})
+
+	assert.Nil(t, tokens.UpdatePermissions("zedex-room-1", 43, false))
+	assert.Equal(t, LiveKitVideoGrant{Room: "zedex-room-1", RoomAdmin: true}, claims.Video)
+	assert.Equal(t, "zedex-room-1", request["room"])
+	assert.Equal(t, "43", request["identity"])
+	assert.Equal(t, map[string]any{"can_subscribe": true, "can_publish": false, "can_publish_data": false}, request["permission"])
+
+	server.Config.Handler = http.NotFoundHandler()
+	assert.NotNil(t, tokens.UpdatePermissions("zedex-room-1", 43, true))
+
+	// A LiveKit server that does not answer must not hold up the connection.
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	tokens.client.Timeout = 100 * time.Millisecond
+	assert.NotNil(t, tokens.UpdatePermissions("zedex-room-1", 43, true))
+}
@@ -0,0 +1,115 @@
+package zed
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"zedex/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	LLM_TOKEN_TTL    = time.Hour
+	LLM_TOKEN_ISSUER = "zedex"
+	// EXPIRED_LLM_TOKEN_HEADER tells Zed to fetch a new LLM token and retry.
+	EXPIRED_LLM_TOKEN_HEADER = "x-zed-expired-token"
+)
+
+var ErrLLMTokenExpired = errors.New("llm token expired")
+
+// LLMTokenClaims are the claims of the tokens Zed sends to the LLM endpoints.
+type LLMTokenClaims struct {
+	jwt.RegisteredClaims
+	Login string `json:"login"`
+	Plan  string `json:"plan"`
+}
+
+// UserID returns the ID of the user the token was issued to.
+func (c LLMTokenClaims) UserID() (uint64, error) {
+	return strconv.ParseUint(c.Subject, 10, 64)
+}
+
+// LLMTokens issues and verifies short-lived HS256 tokens for the LLM endpoints, so they
+// can be checked without looking up the users access tokens.
+type LLMTokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewLLMTokens(secret []byte) *LLMTokens {
+	return &LLMTokens{secret: secret, ttl: LLM_TOKEN_TTL}
+}
+
+func (t *LLMTokens) WithTTL(ttl time.Duration) *LLMTokens {
+	t.ttl = ttl
+	return t
+}
+
+func (t *LLMTokens) Issue(user UserRecord) (string, error) {
+	now := time.Now()
+	claims := LLMTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    LLM_TOKEN_ISSUER,
+			Subject:   strconv.FormatUint(user.ID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.ttl)),
+		},
+		Login: user.Login,
+		Plan:  user.Plan,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.secret)
+}
+
+// Verify checks a token, returning ErrLLMTokenExpired if it is valid but expired.
+func (t *LLMTokens) Verify(token string) (LLMTokenClaims, error) {
+	claims := LLMTokenClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return t.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(LLM_TOKEN_ISSUER), jwt.WithExpirationRequired())
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return LLMTokenClaims{}, ErrLLMTokenExpired
+	}
+	if err != nil {
+		return LLMTokenClaims{}, err
+	}
+	return claims, nil
+}
+
+// VerifyHeader verifies the "Bearer <token>" Authorization header Zed sends.
+func (t *LLMTokens) VerifyHeader(authorization string) (LLMTokenClaims, error) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return LLMTokenClaims{}, fmt.Errorf("missing bearer token")
+	}
+	return t.Verify(token)
+}
+
+// LoadOrCreateSecret reads a hex encoded secret from path, generating one if the file
+// does not exist.
+func LoadOrCreateSecret(name string) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(b)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	utils.CreateDirIfNotExists(path.Dir(name))
+	if err := utils.WriteFileAtomic(name, []byte(hex.EncodeToString(secret)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
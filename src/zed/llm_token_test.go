@@ -0,0 +1,87 @@
+package zed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLLMTokens(t *testing.T) {
+	tokens := NewLLMTokens([]byte("secret"))
+	user := UserRecord{ID: 42, Login: "jane", Plan: "ZedPro"}
+
+	token, err := tokens.Issue(user)
+	assert.Nil(t, err)
+	claims, err := tokens.Verify(token)
+	assert.Nil(t, err)
+	id, err := claims.UserID()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), id)
+	assert.Equal(t, "jane", claims.Login)
+	assert.Equal(t, "ZedPro", claims.Plan)
+
+	_, err = NewLLMTokens([]byte("other")).Verify(token)
+	assert.NotNil(t, err)
+	_, err = tokens.Verify(token + "x")
+	assert.NotNil(t, err)
+
+	expired, err := NewLLMTokens([]byte("secret")).WithTTL(-time.Minute).Issue(user)
+	assert.Nil(t, err)
+	_, err = tokens.Verify(expired)
+	assert.ErrorIs(t, err, ErrLLMTokenExpired)
+
+	// Unsigned tokens are rejected.
+	_, err = tokens.Verify("eyJhbGciOiJub25lIn0.eyJzdWIiOiI0MiIsImlzcyI6InplZGV4In0.")
+	assert.NotNil(t, err)
+}
+
+func TestLLMTokenEndpoints(t *testing.T) {
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	user, err := users.Resolve("device:a", UserProfile{})
+	assert.Nil(t, err)
+	accessToken, err := users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	tokens := NewLLMTokens([]byte("secret"))
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), tokens, newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	router := api.Router()
+
+	request := func(method, url, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/client/llm_tokens", "")
+	assert.Equal(t, 401, w.Code)
+	w = request("POST", "/client/llm_tokens", fmt.Sprintf("%d %s", user.ID, accessToken))
+	assert.Equal(t, 200, w.Code)
+	var created CreateLlmTokenResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	claims, err := tokens.Verify(created.Token.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprint(user.ID), claims.Subject)
+
+	w = request("POST", "/predict_edits/v2", "")
+	assert.Equal(t, 401, w.Code)
+	w = request("POST", "/predict_edits/v2", "Bearer "+accessToken)
+	assert.Equal(t, 401, w.Code)
+	assert.Empty(t, w.Header().Get(EXPIRED_LLM_TOKEN_HEADER))
+
+	expired, err := NewLLMTokens([]byte("secret")).WithTTL(-time.Minute).Issue(user)
+	assert.Nil(t, err)
+	w = request("POST", "/predict_edits/v2", "Bearer "+expired)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "true", w.Header().Get(EXPIRED_LLM_TOKEN_HEADER))
+
+	// A valid token gets past authentication, and fails on the empty body.
+	w = request("POST", "/predict_edits/v2", "Bearer "+created.Token.Token)
+	assert.NotEqual(t, 401, w.Code)
+}
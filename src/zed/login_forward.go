@@ -0,0 +1,145 @@
+package zed
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// LoginForwarder passes sign-in, the user endpoints and the collab connection through to
+// zed.dev (ZED_HOST) and its API (ZED_API_HOST), for --enable-login=false.
+//
+// Zed asks /rpc where to connect to and then opens a WebSocket there. The forwarder
+// answers /rpc with its own /handle-rpc, which looks up the collab server the same way
+// and proxies the WebSocket to it, so Zed only ever talks to zedex.
+type LoginForwarder struct {
+	host    *url.URL
+	apiHost *url.URL
+	client  *http.Client
+}
+
+func NewLoginForwarder(zedClient Client) (*LoginForwarder, error) {
+	host, err := url.Parse(zedClient.host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZED_HOST: %w", err)
+	}
+	apiHost, err := url.Parse(zedClient.apiHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZED_API_HOST: %w", err)
+	}
+	return &LoginForwarder{
+		host:    host,
+		apiHost: apiHost,
+		client: &http.Client{
+			// The redirect of /rpc is the answer, not something to follow.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}, nil
+}
+
+func (f *LoginForwarder) proxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = target.Scheme
+			r.Out.URL.Host = target.Host
+			r.Out.Host = ""
+			// A target with a path, like the collab server's, replaces the path of the
+			// request, otherwise the request keeps its path.
+			if target.Path != "" && target.Path != "/" {
+				r.Out.URL.Path = target.Path
+				r.Out.URL.RawPath = target.RawPath
+				r.Out.URL.RawQuery = target.RawQuery
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logrus.Errorf("failed to forward %v to %v: %v", r.URL.Path, target.Host, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// Host forwards a request to ZED_HOST, e.g. the sign-in pages.
+func (f *LoginForwarder) Host(c *gin.Context) {
+	f.proxy(f.host).ServeHTTP(c.Writer, c.Request)
+}
+
+// API forwards a request to ZED_API_HOST, e.g. /client/users/me.
+func (f *LoginForwarder) API(c *gin.Context) {
+	f.proxy(f.apiHost).ServeHTTP(c.Writer, c.Request)
+}
+
+// collabURL asks ZED_HOST/rpc, with the credentials of the request, where the collab
+// server is. A nil URL means upstream refused, and its response was sent to the client.
+func (f *LoginForwarder) collabURL(c *gin.Context) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(c.Request.Context(), "GET", f.host.JoinPath("rpc").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.Request.Header {
+		if name == "Authorization" || name == "User-Agent" || strings.HasPrefix(name, "X-Zed-") {
+			req.Header[name] = values
+		}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	location, err := resp.Location()
+	if err != nil {
+		// Not a redirect, e.g. 401 on invalid credentials or 426 on an outdated Zed.
+		c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
+		return nil, nil
+	}
+	return location, nil
+}
+
+// Rpc answers Zed's question where to connect to with /handle-rpc on baseURL, if
+// upstream accepts the credentials.
+func (f *LoginForwarder) Rpc(baseURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		location, err := f.collabURL(c)
+		if err != nil {
+			logrus.Error(err)
+			c.JSON(502, gin.H{
+				"error":   "Bad Gateway",
+				"message": err.Error(),
+			})
+			return
+		}
+		if location == nil {
+			return
+		}
+		c.Redirect(302, baseURL+"/handle-rpc")
+	}
+}
+
+// HandleWebSocketRequest proxies the collab WebSocket of Zed, including the upgrade, to
+// the collab server of upstream.
+func (f *LoginForwarder) HandleWebSocketRequest(c *gin.Context) {
+	location, err := f.collabURL(c)
+	if err != nil {
+		logrus.Error(err)
+		c.JSON(502, gin.H{
+			"error":   "Bad Gateway",
+			"message": err.Error(),
+		})
+		return
+	}
+	if location == nil {
+		return
+	}
+	switch location.Scheme {
+	case "ws":
+		location.Scheme = "http"
+	case "wss":
+		location.Scheme = "https"
+	}
+	f.proxy(location).ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,118 @@
+package zed
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeZed serves the parts of zed.dev and its collab server zedex forwards to,
+// accepting the access token "1 secret".
+func newFakeZed(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	authorized := func(r *http.Request) bool { return r.Header.Get("Authorization") == "1 secret" }
+	mux.HandleFunc("GET /native_app_signin", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://github.com/login/oauth/authorize?port="+r.URL.Query().Get("native_app_port"), http.StatusFound)
+	})
+	mux.HandleFunc("GET /client/users/me", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"user": {"id": 1, "github_login": "upstream"}}`)
+	})
+	mux.HandleFunc("GET /rpc", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Location", "ws://"+r.Host+"/collab/rpc")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("GET /collab/rpc", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, append([]byte("echo "), message...))
+		}
+	})
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestLoginForwarder(t *testing.T) {
+	upstream := newFakeZed(t)
+	t.Setenv("ZED_HOST", upstream.URL)
+	t.Setenv("ZED_API_HOST", upstream.URL)
+
+	zedClient := NewZedClient(1)
+	forwarder, err := NewLoginForwarder(zedClient)
+	assert.Nil(t, err)
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	api := NewAPI(true, false, false, true, true, zedClient, users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	api.WithLoginForwarder(forwarder)
+	server := httptest.NewServer(api.Router())
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(url, authorization string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+url, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", authorization)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/native_app_signin?native_app_port=1234", "")
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://github.com/login/oauth/authorize?port=1234", resp.Header.Get("Location"))
+
+	resp = get("/client/users/me", "1 secret")
+	assert.Equal(t, 200, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "upstream")
+	assert.Equal(t, 401, get("/client/users/me", "1 wrong").StatusCode)
+
+	resp = get("/rpc", "1 wrong")
+	assert.Equal(t, 401, resp.StatusCode)
+	resp = get("/rpc", "1 secret")
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.True(t, strings.HasSuffix(resp.Header.Get("Location"), "/handle-rpc"))
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/handle-rpc"
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"1 wrong"}})
+	assert.NotNil(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"1 secret"}})
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	_, message, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "echo hello", string(message))
+
+	// Extensions and releases are still served by zedex.
+	assert.NotEqual(t, 301, get("/api/releases/latest", "").StatusCode)
+}
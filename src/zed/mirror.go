@@ -0,0 +1,83 @@
+package zed
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+
+	"zedex/utils"
+)
+
+// StoreExtensionIndex writes the index to <local dir>/extensions.json. The file is
+// replaced atomically, so a running server never reads a partially written index.
+// Differences to the previous index are recorded in the change journal.
+func (c *Client) StoreExtensionIndex(extensions Extensions) error {
+	if err := c.ensureExtensionsLocalDir(); err != nil {
+		return err
+	}
+
+	extensionsJson, err := json.MarshalIndent(extensions.AsWrapped(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	indexFile := path.Join(c.extensionsLocalDir, "extensions.json")
+	previous, err := c.LoadExtensionIndex(indexFile)
+	initialImport := errors.Is(err, os.ErrNotExist)
+	if err != nil && !initialImport {
+		return err
+	}
+	if err := utils.WriteFileAtomic(indexFile, extensionsJson, 0o644); err != nil {
+		return err
+	}
+
+	// The first index written is the initial import, not a change.
+	if initialImport {
+		return nil
+	}
+	return c.ChangeJournal().Append(DiffExtensions(previous, extensions))
+}
+
+// StoreExtensionArchive writes an extension tarball to <local dir>/<extension id>.tar.gz.
+func (c *Client) StoreExtensionArchive(extension Extension, archive []byte) error {
+	if err := c.ensureExtensionsLocalDir(); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path.Join(c.extensionsLocalDir, extension.ID+".tar.gz"), archive, 0o644)
+}
+
+// StoreLatestRelease writes <local dir>/latest_release.json and
+// <local dir>/latest_release_notes.json, and records a new release in the change
+// journal.
+func (c *Client) StoreLatestRelease(version Version, releaseNotes ReleaseNotes) error {
+	if err := c.ensureExtensionsLocalDir(); err != nil {
+		return err
+	}
+
+	versionJson, err := json.MarshalIndent(version, "", "\t")
+	if err != nil {
+		return err
+	}
+	releaseNotesJson, err := json.MarshalIndent(releaseNotes, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	versionFile := path.Join(c.extensionsLocalDir, "latest_release.json")
+	previous, err := c.LoadLatestZedVersionFromFile(versionFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := utils.WriteFileAtomic(path.Join(c.extensionsLocalDir, "latest_release_notes.json"), releaseNotesJson, 0o644); err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(versionFile, versionJson, 0o644); err != nil {
+		return err
+	}
+
+	if previous.Version == "" {
+		return nil
+	}
+	return c.ChangeJournal().Append(DiffVersions(previous, version))
+}
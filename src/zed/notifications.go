@@ -0,0 +1,230 @@
+package zed
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"zedex/zed/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The kinds of notifications Zed shows. Their entity is the user, channel or message the
+// notification is about, the other fields are the JSON content.
+const (
+	// NotificationContactRequest has the requesting user as entity.
+	NotificationContactRequest = "ContactRequest"
+	// NotificationContactRequestAccepted has the accepting user as entity.
+	NotificationContactRequestAccepted = "ContactRequestAccepted"
+	// NotificationChannelInvitation has the channel as entity.
+	NotificationChannelInvitation = "ChannelInvitation"
+	// NotificationChannelMessageMention has the chat message as entity.
+	NotificationChannelMessageMention = "ChannelMessageMention"
+)
+
+// notificationAnswerable returns whether users respond to notifications of a kind, e.g.
+// accept an invite, rather than only read them.
+func notificationAnswerable(kind string) bool {
+	return kind == NotificationContactRequest || kind == NotificationChannelInvitation
+}
+
+// channelInvitationContent is the content of a NotificationChannelInvitation.
+type channelInvitationContent struct {
+	ChannelName string `json:"channel_name"`
+	InviterId   uint64 `json:"inviter_id"`
+}
+
+// channelMessageMentionContent is the content of a NotificationChannelMessageMention.
+type channelMessageMentionContent struct {
+	SenderId  uint64 `json:"sender_id"`
+	ChannelId uint64 `json:"channel_id"`
+}
+
+// notificationsPerPage is the number of notifications GetNotifications returns at once.
+const notificationsPerPage = 50
+
+// NotificationStore keeps the notifications of users in memory, loaded from a Repository
+// at startup and written through to it on every change. A NotificationStore without a
+// repository keeps its state in memory only.
+type NotificationStore struct {
+	repo Repository
+	// notifications are ordered by ID, by user ID.
+	notifications map[uint64][]*pb.Notification
+	// nextId is the ID of the next notification, they increase across users as Zed
+	// marks notifications read by ID alone.
+	nextId uint64
+	mtx    sync.Mutex
+}
+
+func NewNotificationStore(repo Repository) (*NotificationStore, error) {
+	s := &NotificationStore{
+		repo:          repo,
+		notifications: map[uint64][]*pb.Notification{},
+		nextId:        1,
+	}
+	if repo == nil {
+		return s, nil
+	}
+
+	notifications, err := repo.Notifications()
+	if err != nil {
+		return nil, err
+	}
+	lastId, err := repo.LastNotificationId()
+	if err != nil {
+		return nil, err
+	}
+	s.nextId = lastId + 1
+	for userId, ns := range notifications {
+		s.notifications[userId] = ns
+		if len(ns) > 0 {
+			s.nextId = max(s.nextId, ns[len(ns)-1].Id+1)
+		}
+	}
+	return s, nil
+}
+
+func (s *NotificationStore) indexUnsafe(userId, notificationId uint64) (int, error) {
+	i, found := slices.BinarySearchFunc(s.notifications[userId], notificationId, func(n *pb.Notification, id uint64) int { return cmp.Compare(n.Id, id) })
+	if !found {
+		return 0, rpcErrorf(pb.ErrorCode_Internal, "no notification %v", notificationId)
+	}
+	return i, nil
+}
+
+func (s *NotificationStore) putUnsafe(userId uint64, notification *pb.Notification) error {
+	if s.repo != nil {
+		return s.repo.PutNotification(userId, notification)
+	}
+	return nil
+}
+
+// Add notifies a user of an entity. Notifications users respond to are only added if
+// there is no unanswered one for the entity yet, otherwise Add returns nil.
+func (s *NotificationStore) Add(userId uint64, kind string, entityId uint64, content any) (*pb.Notification, error) {
+	b, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if notificationAnswerable(kind) && slices.ContainsFunc(s.notifications[userId], func(n *pb.Notification) bool {
+		return n.Kind == kind && n.GetEntityId() == entityId && n.Response == nil
+	}) {
+		return nil, nil
+	}
+	notification := &pb.Notification{
+		Id:        s.nextId,
+		Timestamp: uint64(time.Now().Unix()),
+		Kind:      kind,
+		EntityId:  proto.Uint64(entityId),
+		Content:   string(b),
+	}
+	if err := s.putUnsafe(userId, notification); err != nil {
+		return nil, err
+	}
+	s.nextId++
+	s.notifications[userId] = append(s.notifications[userId], notification)
+	return proto.Clone(notification).(*pb.Notification), nil
+}
+
+// Page returns the notifications of a user older than a notification, or the latest if
+// beforeId is 0, oldest first. It reports whether there are no older notifications.
+func (s *NotificationStore) Page(userId, beforeId uint64, limit int) ([]*pb.Notification, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	notifications := s.notifications[userId]
+	end := len(notifications)
+	if beforeId > 0 {
+		end, _ = slices.BinarySearchFunc(notifications, beforeId, func(n *pb.Notification, id uint64) int { return cmp.Compare(n.Id, id) })
+	}
+	start := max(0, end-limit)
+	return cloneAll(notifications[start:end]), start == 0
+}
+
+// MarkRead marks a notification of a user read.
+func (s *NotificationStore) MarkRead(userId, notificationId uint64) (*pb.Notification, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	i, err := s.indexUnsafe(userId, notificationId)
+	if err != nil {
+		return nil, err
+	}
+	notification := proto.Clone(s.notifications[userId][i]).(*pb.Notification)
+	notification.IsRead = true
+	if err := s.putUnsafe(userId, notification); err != nil {
+		return nil, err
+	}
+	s.notifications[userId][i] = notification
+	return proto.Clone(notification).(*pb.Notification), nil
+}
+
+// Respond records the answer of a user to the unanswered notification of a kind for an
+// entity, e.g. accepting an invite, and marks it read. It returns nil if there is none.
+func (s *NotificationStore) Respond(userId uint64, kind string, entityId uint64, accept bool) (*pb.Notification, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	i := slices.IndexFunc(s.notifications[userId], func(n *pb.Notification) bool {
+		return n.Kind == kind && n.GetEntityId() == entityId && n.Response == nil
+	})
+	if i < 0 {
+		return nil, nil
+	}
+	notification := proto.Clone(s.notifications[userId][i]).(*pb.Notification)
+	notification.IsRead = true
+	notification.Response = proto.Bool(accept)
+	if err := s.putUnsafe(userId, notification); err != nil {
+		return nil, err
+	}
+	s.notifications[userId][i] = notification
+	return proto.Clone(notification).(*pb.Notification), nil
+}
+
+// Delete deletes a notification of a user.
+func (s *NotificationStore) Delete(userId, notificationId uint64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	i, err := s.indexUnsafe(userId, notificationId)
+	if err != nil {
+		return err
+	}
+	return s.deleteUnsafe(userId, i)
+}
+
+func (s *NotificationStore) deleteUnsafe(userId uint64, i int) error {
+	if s.repo != nil {
+		if err := s.repo.DeleteNotification(userId, s.notifications[userId][i].Id); err != nil {
+			return err
+		}
+	}
+	s.notifications[userId] = slices.Delete(s.notifications[userId], i, i+1)
+	return nil
+}
+
+// Retract deletes the unanswered notifications of a kind for an entity, of all users
+// or only of userIds, when the entity went away, e.g. a request was withdrawn. It
+// returns the IDs of the deleted notifications by user ID.
+func (s *NotificationStore) Retract(kind string, entityId uint64, userIds ...uint64) (map[uint64][]uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	retracted := map[uint64][]uint64{}
+	for userId, notifications := range s.notifications {
+		if len(userIds) > 0 && !slices.Contains(userIds, userId) {
+			continue
+		}
+		for i := len(notifications) - 1; i >= 0; i-- {
+			n := notifications[i]
+			if n.Kind != kind || n.GetEntityId() != entityId || n.Response != nil {
+				continue
+			}
+			if err := s.deleteUnsafe(userId, i); err != nil {
+				return retracted, err
+			}
+			retracted[userId] = append(retracted[userId], n.Id)
+		}
+	}
+	return retracted, nil
+}
@@ -0,0 +1,63 @@
+package zed
+
+import (
+	"testing"
+
+	"zedex/zed/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifications(t *testing.T) {
+	notifications, err := NewNotificationStore(nil)
+	assert.Nil(t, err)
+	alice, bob := uint64(1), uint64(2)
+
+	invite, err := notifications.Add(alice, NotificationChannelInvitation, 7, channelInvitationContent{ChannelName: "zed", InviterId: bob})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"channel_name":"zed","inviter_id":2}`, invite.Content)
+	// Unanswered notifications aren't repeated.
+	again, err := notifications.Add(alice, NotificationChannelInvitation, 7, channelInvitationContent{ChannelName: "zed", InviterId: bob})
+	assert.Nil(t, err)
+	assert.Nil(t, again)
+	for messageId := range uint64(3) {
+		_, err := notifications.Add(alice, NotificationChannelMessageMention, messageId, channelMessageMentionContent{SenderId: bob, ChannelId: 7})
+		assert.Nil(t, err)
+	}
+	_, err = notifications.Add(bob, NotificationContactRequest, alice, struct{}{})
+	assert.Nil(t, err)
+	// Notifications nobody responds to are repeated, e.g. a contact accepting again.
+	for range 2 {
+		accepted, err := notifications.Add(bob, NotificationContactRequestAccepted, alice, struct{}{})
+		assert.Nil(t, err)
+		assert.NotNil(t, accepted)
+	}
+
+	// Pages go back from the latest notification.
+	page, done := notifications.Page(alice, 0, 3)
+	assert.Len(t, page, 3)
+	assert.False(t, done)
+	page, done = notifications.Page(alice, page[0].Id, 3)
+	assert.Equal(t, invite.Id, page[0].Id)
+	assert.True(t, done)
+
+	read, err := notifications.MarkRead(alice, invite.Id)
+	assert.Nil(t, err)
+	assert.True(t, read.IsRead)
+	_, err = notifications.MarkRead(bob, invite.Id)
+	assertRpcError(t, pb.ErrorCode_Internal, err)
+	answered, err := notifications.Respond(alice, NotificationChannelInvitation, 7, true)
+	assert.Nil(t, err)
+	assert.True(t, answered.GetResponse())
+
+	// Retracting keeps answered notifications.
+	retracted, err := notifications.Retract(NotificationChannelInvitation, 7)
+	assert.Nil(t, err)
+	assert.Empty(t, retracted)
+	retracted, err = notifications.Retract(NotificationChannelMessageMention, 1)
+	assert.Nil(t, err)
+	assert.Len(t, retracted[alice], 1)
+	assert.Nil(t, notifications.Delete(alice, invite.Id))
+	page, _ = notifications.Page(alice, 0, 10)
+	assert.Len(t, page, 2)
+}
@@ -0,0 +1,221 @@
+package zed
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"zedex/utils"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const OIDC_LOGIN_TIMEOUT = 10 * time.Minute
+
+// OIDCConfig configures sign in through an OpenID Connect provider.
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// LoginClaim is the claim used as the users login, falling back to the local part
+	// of the email address.
+	LoginClaim  string
+	GroupsClaim string
+	// AllowedGroups and AllowedDomains restrict who may sign in, if set.
+	AllowedGroups  []string
+	AllowedDomains []string
+}
+
+// OIDCConfigFromEnv reads the OIDC_* environment variables.
+func OIDCConfigFromEnv() OIDCConfig {
+	split := func(s string) []string {
+		values := strings.Split(s, ",")
+		for i, v := range values {
+			values[i] = strings.TrimSpace(v)
+		}
+		return slices.DeleteFunc(values, func(v string) bool { return v == "" })
+	}
+	return OIDCConfig{
+		IssuerURL:      utils.EnvWithFallback("OIDC_ISSUER_URL", ""),
+		ClientID:       utils.EnvWithFallback("OIDC_CLIENT_ID", ""),
+		ClientSecret:   utils.EnvWithFallback("OIDC_CLIENT_SECRET", ""),
+		Scopes:         strings.Fields(utils.EnvWithFallback("OIDC_SCOPES", "openid profile email")),
+		LoginClaim:     utils.EnvWithFallback("OIDC_LOGIN_CLAIM", "preferred_username"),
+		GroupsClaim:    utils.EnvWithFallback("OIDC_GROUPS_CLAIM", "groups"),
+		AllowedGroups:  split(utils.EnvWithFallback("OIDC_ALLOWED_GROUPS", "")),
+		AllowedDomains: split(utils.EnvWithFallback("OIDC_ALLOWED_DOMAINS", "")),
+	}
+}
+
+// oidcLogin is a sign in waiting for the provider to redirect back.
+type oidcLogin struct {
+	nativeAppPort      string
+	nativeAppPublicKey string
+	nonce              string
+	startedAt          time.Time
+}
+
+// OIDCIdentity is a user authenticated by the provider.
+type OIDCIdentity struct {
+	Identity string
+	Profile  UserProfile
+}
+
+type OIDCProvider struct {
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	logins   utils.ConcurrentMap[string, oidcLogin]
+}
+
+// NewOIDCProvider discovers the provider configuration from the issuer.
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.IssuerURL == "" || config.ClientID == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER_URL and OIDC_CLIENT_ID must be set")
+	}
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(config.Scopes, oidc.ScopeOpenID) {
+		config.Scopes = append([]string{oidc.ScopeOpenID}, config.Scopes...)
+	}
+
+	return &OIDCProvider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       config.Scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		logins:   utils.NewConcurrentMap[string, oidcLogin](),
+	}, nil
+}
+
+// AuthCodeURL starts a sign in for a Zed instance and returns the URL of the provider to
+// send the browser to.
+func (p *OIDCProvider) AuthCodeURL(redirectURL, nativeAppPort, nativeAppPublicKey string) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	p.logins.Transaction(func(m map[string]oidcLogin) map[string]oidcLogin {
+		for k, l := range m {
+			if now.Sub(l.startedAt) > OIDC_LOGIN_TIMEOUT {
+				delete(m, k)
+			}
+		}
+		m[state] = oidcLogin{
+			nativeAppPort:      nativeAppPort,
+			nativeAppPublicKey: nativeAppPublicKey,
+			nonce:              nonce,
+			startedAt:          now,
+		}
+		return m
+	})
+
+	config := p.oauth2
+	config.RedirectURL = redirectURL
+	return config.AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+// Exchange completes a sign in: it redeems the code, verifies the ID token and checks
+// the allowed groups and domains. It returns the sign in started by AuthCodeURL.
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURL, state, code string) (OIDCIdentity, oidcLogin, error) {
+	login := p.logins.Pop(state)
+	if login.nonce == "" || time.Since(login.startedAt) > OIDC_LOGIN_TIMEOUT {
+		return OIDCIdentity{}, oidcLogin{}, fmt.Errorf("unknown or expired sign in, try again")
+	}
+
+	config := p.oauth2
+	config.RedirectURL = redirectURL
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return OIDCIdentity{}, oidcLogin{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OIDCIdentity{}, oidcLogin{}, fmt.Errorf("no id_token in token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return OIDCIdentity{}, oidcLogin{}, err
+	}
+	if idToken.Nonce != login.nonce {
+		return OIDCIdentity{}, oidcLogin{}, fmt.Errorf("invalid nonce")
+	}
+
+	claims := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		return OIDCIdentity{}, oidcLogin{}, err
+	}
+	identity, err := p.identityFromClaims(idToken.Issuer, idToken.Subject, claims)
+	return identity, login, err
+}
+
+func (p *OIDCProvider) identityFromClaims(issuer, subject string, claims map[string]any) (OIDCIdentity, error) {
+	str := func(k string) string {
+		s, _ := claims[k].(string)
+		return s
+	}
+
+	email := str("email")
+	domain := ""
+	if _, d, ok := strings.Cut(email, "@"); ok {
+		domain = strings.ToLower(d)
+	}
+	if len(p.config.AllowedDomains) > 0 {
+		// Providers that don't vouch for the email, e.g. omit the claim, don't prove the domain.
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return OIDCIdentity{}, fmt.Errorf("email %v is not verified", email)
+		}
+		if !slices.ContainsFunc(p.config.AllowedDomains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+			return OIDCIdentity{}, fmt.Errorf("email domain %q is not allowed", domain)
+		}
+	}
+
+	groups := []string{}
+	if values, ok := claims[p.config.GroupsClaim].([]any); ok {
+		for _, v := range values {
+			if g, ok := v.(string); ok {
+				groups = append(groups, g)
+			}
+		}
+	}
+	if len(p.config.AllowedGroups) > 0 && !slices.ContainsFunc(groups, func(g string) bool { return slices.Contains(p.config.AllowedGroups, g) }) {
+		return OIDCIdentity{}, fmt.Errorf("user is not in any of the allowed groups")
+	}
+
+	login := str(p.config.LoginClaim)
+	if login == "" {
+		login, _, _ = strings.Cut(email, "@")
+	}
+	if login == "" {
+		login = subject
+	}
+	// Logins are shown like GitHub handles, so keep them free of domains and spaces.
+	login, _, _ = strings.Cut(login, "@")
+	login = strings.ReplaceAll(login, " ", "-")
+
+	return OIDCIdentity{
+		Identity: "oidc:" + issuer + "|" + subject,
+		Profile: UserProfile{
+			Login:     login,
+			Name:      str("name"),
+			AvatarURL: str("picture"),
+			Groups:    groups,
+		},
+	}, nil
+}
@@ -0,0 +1,196 @@
+package zed
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIssuer is a minimal OpenID Connect provider that signs in everyone with claims.
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+	nonces map[string]string
+}
+
+func newFakeIssuer(t *testing.T, claims map[string]any) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	f := &fakeIssuer{key: key, claims: claims, nonces: map[string]string{}}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                f.server.URL,
+			"authorization_endpoint":                f.server.URL + "/authorize",
+			"token_endpoint":                        f.server.URL + "/token",
+			"jwks_uri":                              f.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": b64(key.N.Bytes()),
+			"e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f.nonces["code"] = q.Get("nonce")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=code&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims := map[string]any{
+			"iss":   f.server.URL,
+			"aud":   "zedex",
+			"sub":   "1234",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": f.nonces[r.Form.Get("code")],
+		}
+		for k, v := range f.claims {
+			claims[k] = v
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     signed + "." + b64(signature),
+		})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// signIn runs the sign in flow of a Zed instance and returns the final response of zedex.
+func (f *fakeIssuer) signIn(t *testing.T, api *API, pubKey string) *httptest.ResponseRecorder {
+	router := api.Router()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/native_app_signin?native_app_port=9999&native_app_public_key="+url.QueryEscape(pubKey), nil))
+	assert.Equal(t, 302, w.Code)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	assert.Nil(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", callback.RequestURI(), nil))
+	return w
+}
+
+func TestOIDCConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_ALLOWED_DOMAINS", "a.com, b.com,,")
+	t.Setenv("OIDC_ALLOWED_GROUPS", " engineering , design")
+	config := OIDCConfigFromEnv()
+	assert.Equal(t, []string{"a.com", "b.com"}, config.AllowedDomains)
+	assert.Equal(t, []string{"engineering", "design"}, config.AllowedGroups)
+}
+
+func TestOIDCSignin(t *testing.T) {
+	t.Setenv("BASE_URL", "http://zedex.test")
+	issuer := newFakeIssuer(t, map[string]any{
+		"preferred_username": "jane",
+		"name":               "Jane Doe",
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"groups":             []string{"engineering"},
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	pubKey := base64.URLEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+
+	newAPI := func(config OIDCConfig) (*API, *UserStore) {
+		config.IssuerURL = issuer.server.URL
+		config.ClientID = "zedex"
+		config.GroupsClaim = "groups"
+		config.LoginClaim = "preferred_username"
+		provider, err := NewOIDCProvider(context.Background(), config)
+		assert.Nil(t, err)
+		users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+		assert.Nil(t, err)
+		api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+		return api.WithOIDC(provider), users
+	}
+
+	t.Run("signs in", func(t *testing.T) {
+		api, users := newAPI(OIDCConfig{AllowedGroups: []string{"engineering"}, AllowedDomains: []string{"example.com"}})
+		w := issuer.signIn(t, api, pubKey)
+		assert.Equal(t, 302, w.Code)
+
+		redirect, err := url.Parse(w.Header().Get("Location"))
+		assert.Nil(t, err)
+		assert.Equal(t, "127.0.0.1:9999", redirect.Host)
+		ciphertext, err := base64.URLEncoding.DecodeString(redirect.Query().Get("access_token"))
+		assert.Nil(t, err)
+		token, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext, nil)
+		assert.Nil(t, err)
+
+		user, err := users.Authenticate(fmt.Sprintf("%s %s", redirect.Query().Get("user_id"), token))
+		assert.Nil(t, err)
+		assert.Equal(t, "jane", user.Login)
+		assert.Equal(t, "Jane Doe", user.Name)
+		assert.Equal(t, []string{"engineering"}, user.Groups)
+		assert.Equal(t, []string{"oidc:" + issuer.server.URL + "|1234"}, user.Identities)
+	})
+
+	t.Run("rejects other groups", func(t *testing.T) {
+		api, users := newAPI(OIDCConfig{AllowedGroups: []string{"sales"}})
+		w := issuer.signIn(t, api, pubKey)
+		assert.Equal(t, 403, w.Code)
+		assert.Empty(t, users.Users())
+	})
+
+	t.Run("rejects other domains", func(t *testing.T) {
+		api, users := newAPI(OIDCConfig{AllowedDomains: []string{"example.org"}})
+		w := issuer.signIn(t, api, pubKey)
+		assert.Equal(t, 403, w.Code)
+		assert.Empty(t, users.Users())
+	})
+
+	t.Run("rejects unverified emails", func(t *testing.T) {
+		delete(issuer.claims, "email_verified")
+		defer func() { issuer.claims["email_verified"] = true }()
+		api, users := newAPI(OIDCConfig{AllowedDomains: []string{"example.com"}})
+		w := issuer.signIn(t, api, pubKey)
+		assert.Equal(t, 403, w.Code)
+		assert.Empty(t, users.Users())
+	})
+
+	t.Run("rejects unknown state", func(t *testing.T) {
+		api, _ := newAPI(OIDCConfig{})
+		w := httptest.NewRecorder()
+		api.Router().ServeHTTP(w, httptest.NewRequest("GET", "/native_app_signin/oidc/callback?code=code&state=forged", nil))
+		assert.Equal(t, 403, w.Code)
+	})
+}
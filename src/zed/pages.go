@@ -0,0 +1,51 @@
+package zed
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var pages = template.Must(template.New("page").Parse(`<html>
+<body style="background-color: #1e1e2e; color: #ffffff; text-align: center; display: flex; justify-content: center; align-items: center">
+{{ if eq .Page "login" }}
+	<form method="post" action="/native_app_signin" style="display: flex; flex-direction: column; gap: 0.5em">
+		<p>Sign in to Zedex</p>
+		{{ if .Error }}<p style="color: #f38ba8">{{ .Error }}</p>{{ end }}
+		<input type="hidden" name="native_app_port" value="{{ .NativeAppPort }}">
+		<input type="hidden" name="native_app_public_key" value="{{ .NativeAppPublicKey }}">
+		<input type="text" name="login" placeholder="Username" value="{{ .Login }}" autofocus required>
+		<input type="password" name="password" placeholder="Password" required>
+		<button type="submit">Sign in</button>
+	</form>
+{{ else if eq .Page "signed_in" }}
+	<p>You should now be signed into Zed{{ with .User }} as {{ .Login }}{{ end }}. You can close this tab.</p>
+{{ else if .User }}
+	<p>You are logged in to Zedex as {{ .User.Login }}{{ with .User.Name }} ({{ . }}){{ end }}.</p>
+{{ else }}
+	<p>You are not logged in to Zedex. Sign in from Zed.</p>
+{{ end }}
+</body>
+</html>
+`))
+
+type pageData struct {
+	Page               string
+	User               *UserRecord
+	Error              string
+	Login              string
+	NativeAppPort      string
+	NativeAppPublicKey string
+}
+
+func renderPage(c *gin.Context, status int, data pageData) {
+	var b bytes.Buffer
+	if err := pages.Execute(&b, data); err != nil {
+		logrus.Error(err)
+		c.String(500, "failed to render page")
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", b.Bytes())
+}
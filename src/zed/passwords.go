@@ -0,0 +1,176 @@
+package zed
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zedex/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const PASSWORD_IDENTITY_PREFIX = "password:"
+
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("zedex"), bcrypt.DefaultCost)
+	return hash
+})
+
+// PasswordFile is an htpasswd-style file of "<login>:<bcrypt hash>" lines. It is reread
+// when it changes on disk, so accounts managed with `zedex users` apply to a running
+// server.
+type PasswordFile struct {
+	path    string
+	hashes  map[string]string
+	modTime time.Time
+	mtx     sync.Mutex
+}
+
+func NewPasswordFile(path string) *PasswordFile {
+	return &PasswordFile{path: path, hashes: map[string]string{}}
+}
+
+// loadUnsafe rereads the file if it was modified since it was last read. A missing file
+// has no accounts.
+func (p *PasswordFile) loadUnsafe() error {
+	info, err := os.Stat(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		p.hashes = map[string]string{}
+		p.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		login, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("malformed line in %v", p.path)
+		}
+		hashes[login] = hash
+	}
+	p.hashes = hashes
+	p.modTime = info.ModTime()
+	return nil
+}
+
+func (p *PasswordFile) saveUnsafe() error {
+	logins := []string{}
+	for login := range p.hashes {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	var sb strings.Builder
+	for _, login := range logins {
+		fmt.Fprintf(&sb, "%s:%s\n", login, p.hashes[login])
+	}
+	utils.CreateDirIfNotExists(path.Dir(p.path))
+	if err := utils.WriteFileAtomic(p.path, []byte(sb.String()), 0o600); err != nil {
+		return err
+	}
+	// Force a reread, the modification time may not change within the same tick.
+	p.modTime = time.Time{}
+	return nil
+}
+
+// Set creates an account, or changes the password of an existing one.
+func (p *PasswordFile) Set(login, password string) error {
+	if login == "" || strings.ContainsAny(login, ": \t\n") {
+		return fmt.Errorf("invalid login %q", login)
+	}
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err := p.loadUnsafe(); err != nil {
+		return err
+	}
+	p.hashes[login] = string(hash)
+	return p.saveUnsafe()
+}
+
+func (p *PasswordFile) Remove(login string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err := p.loadUnsafe(); err != nil {
+		return err
+	}
+	if _, ok := p.hashes[login]; !ok {
+		return fmt.Errorf("unknown user %q", login)
+	}
+	delete(p.hashes, login)
+	return p.saveUnsafe()
+}
+
+func (p *PasswordFile) Exists(login string) (bool, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err := p.loadUnsafe(); err != nil {
+		return false, err
+	}
+	_, ok := p.hashes[login]
+	return ok, nil
+}
+
+// Verify returns whether the password is correct for the login.
+func (p *PasswordFile) Verify(login, password string) (bool, error) {
+	p.mtx.Lock()
+	err := p.loadUnsafe()
+	hash, ok := p.hashes[login]
+	p.mtx.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Compare anyway, so unknown logins take as long as wrong passwords.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return false, nil
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// CheckIdentity rejects password identities whose account was removed. Other identities
+// are accepted.
+func (p *PasswordFile) CheckIdentity(identity string) error {
+	login, ok := strings.CutPrefix(identity, PASSWORD_IDENTITY_PREFIX)
+	if !ok {
+		return nil
+	}
+	exists, err := p.Exists(login)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("account %q was removed", login)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package zed
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordFile(t *testing.T) {
+	file := path.Join(t.TempDir(), "users.htpasswd")
+	passwords := NewPasswordFile(file)
+	assert.Nil(t, passwords.Set("jane", "secret"))
+	assert.NotNil(t, passwords.Set("ja:ne", "secret"))
+
+	// Another process, e.g. `zedex users`, sees the account.
+	other := NewPasswordFile(file)
+	ok, err := other.Verify("jane", "secret")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = other.Verify("jane", "wrong")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = other.Verify("john", "secret")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, passwords.Set("jane", "changed"))
+	ok, _ = other.Verify("jane", "secret")
+	assert.False(t, ok)
+	ok, _ = other.Verify("jane", "changed")
+	assert.True(t, ok)
+
+	assert.Nil(t, other.CheckIdentity(PASSWORD_IDENTITY_PREFIX+"jane"))
+	assert.Nil(t, other.CheckIdentity("device:abc"))
+	assert.Nil(t, passwords.Remove("jane"))
+	assert.NotNil(t, passwords.Remove("jane"))
+	assert.NotNil(t, other.CheckIdentity(PASSWORD_IDENTITY_PREFIX+"jane"))
+}
+
+func TestPasswordSignin(t *testing.T) {
+	t.Setenv("BASE_URL", "https://zedex.test")
+	dir := t.TempDir()
+	passwords := NewPasswordFile(path.Join(dir, "users.htpasswd"))
+	assert.Nil(t, passwords.Set("jane", "secret"))
+	users, err := NewUserStore(path.Join(dir, "users.json"))
+	assert.Nil(t, err)
+	users.WithIdentityCheck(passwords.CheckIdentity)
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	router := api.WithPasswords(passwords).Router()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	pubKey := base64.URLEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/native_app_signin?native_app_port=9999&native_app_public_key="+url.QueryEscape(pubKey), nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `type="password"`)
+
+	signIn := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"login": {"jane"}, "password": {password}, "native_app_port": {"9999"}, "native_app_public_key": {pubKey}}
+		req := httptest.NewRequest("POST", "/native_app_signin", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = signIn("wrong")
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid username or password")
+
+	w = signIn("secret")
+	assert.Equal(t, 302, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "http://127.0.0.1:9999/native_app_signin?user_id=1&"))
+	cookies := w.Result().Cookies()
+	// The browser gets a session token of its own, only sent over HTTPS to zedex.
+	i := slices.IndexFunc(cookies, func(c *http.Cookie) bool { return c.Name == SESSION_COOKIE })
+	assert.GreaterOrEqual(t, i, 0)
+	session := cookies[i]
+	assert.True(t, session.Secure)
+	assert.True(t, session.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, session.SameSite)
+	sessionValue, err := url.QueryUnescape(session.Value)
+	assert.Nil(t, err)
+	_, err = users.Authenticate(sessionValue)
+	assert.NotNil(t, err)
+
+	account := func() string {
+		req := httptest.NewRequest("GET", "/account", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	assert.Contains(t, account(), "logged in to Zedex as jane")
+
+	// Removing the account signs it out.
+	assert.Nil(t, passwords.Remove("jane"))
+	assert.Contains(t, account(), "not logged in")
+}
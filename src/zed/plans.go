@@ -0,0 +1,195 @@
+package zed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zedex/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PlanDefinition is a plan admins can assign to users, e.g. an internal "pro" tier with
+// higher limits and a more capable model.
+type PlanDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// ZedPlan is the plan Zed shows: Free, ZedPro or ZedProTrial.
+	ZedPlan string      `json:"zed_plan"`
+	Limits  UsageLimits `json:"limits"`
+	// Model is the edit prediction model of the plan, the configured model if empty.
+	Model string `json:"model,omitempty"`
+}
+
+func (p PlanDefinition) Validate() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, " \t\n/") {
+		return fmt.Errorf("invalid plan name %q", p.Name)
+	}
+	if _, err := ParsePlan(p.ZedPlan); err != nil {
+		return err
+	}
+	if p.Limits.EditPredictions < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// PlanStore keeps the plan definitions in a JSON file, which is reread when it changes
+// on disk so `zedex plans` applies to a running server.
+//
+// Users without a plan get the default plan. Users on a plan that is not defined, but
+// named like a Zed plan (e.g. "ZedPro"), get that Zed plan with the default limits.
+type PlanStore struct {
+	path        string
+	defaultPlan PlanDefinition
+	plans       map[string]PlanDefinition
+	modTime     time.Time
+	mtx         sync.Mutex
+}
+
+func NewPlanStore(path string, defaultLimits UsageLimits) (*PlanStore, error) {
+	s := &PlanStore{
+		path:        path,
+		defaultPlan: PlanDefinition{Name: ZedFree.String(), ZedPlan: ZedFree.String(), Limits: defaultLimits},
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PlanStore) loadUnsafe() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.plans = map[string]PlanDefinition{}
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	plans := []PlanDefinition{}
+	if err := json.Unmarshal(b, &plans); err != nil {
+		return fmt.Errorf("failed to read %v: %w", s.path, err)
+	}
+	s.plans = map[string]PlanDefinition{}
+	for _, p := range plans {
+		s.plans[p.Name] = p
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *PlanStore) saveUnsafe() error {
+	b, err := json.MarshalIndent(s.plansUnsafe(), "", "\t")
+	if err != nil {
+		return err
+	}
+	utils.CreateDirIfNotExists(path.Dir(s.path))
+	if err := utils.WriteFileAtomic(s.path, b, 0o644); err != nil {
+		return err
+	}
+	// Force a reread, the modification time may not change within the same tick.
+	s.modTime = time.Time{}
+	return nil
+}
+
+func (s *PlanStore) plansUnsafe() []PlanDefinition {
+	plans := []PlanDefinition{}
+	for _, p := range s.plans {
+		plans = append(plans, p)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Name < plans[j].Name })
+	return plans
+}
+
+// Plans returns the defined plans ordered by name.
+func (s *PlanStore) Plans() ([]PlanDefinition, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return []PlanDefinition{}, err
+	}
+	return s.plansUnsafe(), nil
+}
+
+// Get returns the plan with the given name, see PlanStore for how undefined plans are
+// resolved.
+func (s *PlanStore) Get(name string) (PlanDefinition, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		log.Errorf("failed to load plans: %v", err)
+	}
+	if name == "" {
+		return s.defaultPlan, true
+	}
+	if p, ok := s.plans[name]; ok {
+		return p, true
+	}
+	if zedPlan, err := ParsePlan(name); err == nil {
+		p := s.defaultPlan
+		p.Name = name
+		p.ZedPlan = zedPlan.String()
+		return p, true
+	}
+	return PlanDefinition{}, false
+}
+
+// For returns the plan of a user, falling back to the default plan if the plan of the
+// user was deleted.
+func (s *PlanStore) For(user UserRecord) PlanDefinition {
+	if p, ok := s.Get(user.Plan); ok {
+		return p
+	}
+	log.Warnf("user %v is on the unknown plan %q, using the default plan", user.ID, user.Plan)
+	p, _ := s.Get("")
+	return p
+}
+
+// Set creates or replaces a plan.
+func (s *PlanStore) Set(plan PlanDefinition) error {
+	if plan.ZedPlan == "" {
+		plan.ZedPlan = ZedFree.String()
+	}
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return err
+	}
+	s.plans[plan.Name] = plan
+	return s.saveUnsafe()
+}
+
+func (s *PlanStore) Delete(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.loadUnsafe(); err != nil {
+		return err
+	}
+	if _, ok := s.plans[name]; !ok {
+		return fmt.Errorf("unknown plan %q", name)
+	}
+	delete(s.plans, name)
+	return s.saveUnsafe()
+}
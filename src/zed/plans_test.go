@@ -0,0 +1,94 @@
+package zed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPlanStore(t *testing.T, defaultLimits UsageLimits) *PlanStore {
+	plans, err := NewPlanStore(path.Join(t.TempDir(), "plans.json"), defaultLimits)
+	assert.Nil(t, err)
+	return plans
+}
+
+func TestPlanStore(t *testing.T) {
+	file := path.Join(t.TempDir(), "plans.json")
+	plans, err := NewPlanStore(file, UsageLimits{EditPredictions: 10})
+	assert.Nil(t, err)
+
+	free := plans.For(UserRecord{ID: 1})
+	assert.Equal(t, "Free", free.ZedPlan)
+	assert.Equal(t, UsageLimits{EditPredictions: 10}, free.Limits)
+	// Zed plans are known without being defined.
+	pro := plans.For(UserRecord{ID: 1, Plan: "ZedPro"})
+	assert.Equal(t, "ZedPro", pro.ZedPlan)
+	assert.Equal(t, UsageLimits{EditPredictions: 10}, pro.Limits)
+
+	internal := PlanDefinition{Name: "internal", ZedPlan: "ZedPro", Model: "large", Limits: UsageLimits{EditPredictions: 1000}}
+	assert.Nil(t, plans.Set(internal))
+	assert.NotNil(t, plans.Set(PlanDefinition{Name: "in valid"}))
+	assert.NotNil(t, plans.Set(PlanDefinition{Name: "team", ZedPlan: "Enterprise"}))
+	assert.NotNil(t, plans.Set(PlanDefinition{Name: "team", Limits: UsageLimits{EditPredictions: -1}}))
+
+	// Another process, e.g. `zedex plans`, sees the changes.
+	other, err := NewPlanStore(file, UsageLimits{EditPredictions: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, internal, other.For(UserRecord{ID: 1, Plan: "internal"}))
+	assert.Nil(t, other.Delete("internal"))
+	assert.NotNil(t, other.Delete("internal"))
+
+	// Users on a deleted plan fall back to the default plan.
+	assert.Equal(t, free, plans.For(UserRecord{ID: 1, Plan: "internal"}))
+	_, ok := plans.Get("internal")
+	assert.False(t, ok)
+}
+
+func TestAdminPlans(t *testing.T) {
+	t.Setenv("ZEDEX_ADMIN_TOKEN", "admin")
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	user, err := users.Resolve("device:a", UserProfile{})
+	assert.Nil(t, err)
+	accessToken, err := users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{EditPredictions: 10}), 8080)
+	router := api.Router()
+
+	request := func(method, url, authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("PUT", "/zedex/admin/plans/internal", "Bearer admin", `{"zed_plan": "ZedPro", "limits": {"edit_predictions": 1000}}`)
+	assert.Equal(t, 200, w.Code)
+	w = request("PATCH", "/zedex/admin/users/"+user.Login, "Bearer admin", `{"plan": "unknown"}`)
+	assert.Equal(t, 400, w.Code)
+	w = request("PATCH", "/zedex/admin/users/"+user.Login, "Bearer admin", `{"plan": "internal", "staff": true}`)
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "access_tokens")
+
+	updated, _ := users.Get(user.ID)
+	assert.Equal(t, "internal", updated.Plan)
+	assert.True(t, updated.Staff)
+
+	w = request("GET", "/client/users/me", fmt.Sprintf("%d %s", user.ID, accessToken), "")
+	assert.Equal(t, 200, w.Code)
+	var me GetAuthenticatedUserResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &me))
+	assert.Equal(t, NewUsageLimit(1000), me.Plan.Usage.EditPredictions.Limit)
+
+	w = request("GET", "/zedex/admin/users", "Bearer admin", "")
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "access_tokens")
+	w = request("DELETE", "/zedex/admin/plans/internal", "", "")
+	assert.Equal(t, 401, w.Code)
+}
@@ -0,0 +1,197 @@
+package zed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"zedex/utils"
+)
+
+const (
+	REMOTE_SERVER_ASSET = "zed-remote-server"
+	REMOTE_SERVER_DIR   = "remote_server"
+)
+
+// Platform is an os/arch pair as named by Zed, e.g. "linux" and "x86_64".
+type Platform struct {
+	OS   string
+	Arch string
+}
+
+// RemoteServerPlatforms are the platforms zed.dev publishes remote server binaries for.
+var RemoteServerPlatforms = []Platform{
+	{OS: "linux", Arch: "x86_64"},
+	{OS: "linux", Arch: "aarch64"},
+	{OS: "macos", Arch: "x86_64"},
+	{OS: "macos", Arch: "aarch64"},
+}
+
+// ParsePlatform parses "<os>-<arch>", e.g. "linux-x86_64".
+func ParsePlatform(s string) (Platform, error) {
+	os, arch, ok := strings.Cut(s, "-")
+	if !ok || os == "" || arch == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected <os>-<arch>", s)
+	}
+	return Platform{OS: os, Arch: arch}, nil
+}
+
+func (p Platform) String() string {
+	return p.OS + "-" + p.Arch
+}
+
+// RemoteServerFileName is the name zed.dev uses for a remote server binary, e.g.
+// "zed-remote-server-linux-x86_64.gz".
+func RemoteServerFileName(p Platform) string {
+	return fmt.Sprintf("%s-%s.gz", REMOTE_SERVER_ASSET, p)
+}
+
+// ParseRemoteServerFileName is the inverse of RemoteServerFileName.
+func ParseRemoteServerFileName(name string) (Platform, bool) {
+	s, ok := strings.CutPrefix(name, REMOTE_SERVER_ASSET+"-")
+	if !ok {
+		return Platform{}, false
+	}
+	s, ok = strings.CutSuffix(s, ".gz")
+	if !ok {
+		return Platform{}, false
+	}
+	p, err := ParsePlatform(s)
+	return p, err == nil
+}
+
+// GetLatestRelease asks zed.dev for the latest stable release of an asset
+// ("zed" or "zed-remote-server") on the given platform.
+func (c *Client) GetLatestRelease(asset string, p Platform) (Version, error) {
+	u := fmt.Sprintf("%s/api/releases/latest?asset=%s&os=%s&arch=%s", c.host, asset, p.OS, p.Arch)
+	resp, err := http.Get(u)
+	if err != nil {
+		return Version{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Version{}, fmt.Errorf("HTTP request failed with status code %d", resp.StatusCode)
+	}
+
+	var ver Version
+	if err := json.NewDecoder(resp.Body).Decode(&ver); err != nil {
+		return Version{}, err
+	}
+	return ver, nil
+}
+
+// RemoteServerRelease returns where zed.dev serves a remote server version of a release
+// channel ("stable" or "preview") for a platform.
+func (c *Client) RemoteServerRelease(channel, version string, p Platform) (Version, error) {
+	if err := checkRemoteServerVersion(version); err != nil {
+		return Version{}, fmt.Errorf("%w: %w", err, os.ErrNotExist)
+	}
+	return Version{
+		Version: version,
+		URL:     fmt.Sprintf("%s/api/releases/%s/%s/%s", c.host, channel, version, RemoteServerFileName(p)),
+	}, nil
+}
+
+// DownloadRemoteServer downloads the gzipped remote server binary for a platform. An
+// empty version downloads the latest stable release. The returned Version holds the
+// version that was actually downloaded.
+func (c *Client) DownloadRemoteServer(version string, p Platform) ([]byte, Version, error) {
+	v := Version{
+		Version: version,
+		URL:     fmt.Sprintf("%s/api/releases/stable/%s/%s", c.host, version, RemoteServerFileName(p)),
+	}
+	if version == "" {
+		var err error
+		if v, err = c.GetLatestRelease(REMOTE_SERVER_ASSET, p); err != nil {
+			return []byte{}, Version{}, err
+		}
+	}
+
+	resp, err := http.Get(v.URL)
+	if err != nil {
+		return []byte{}, Version{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, Version{}, fmt.Errorf("HTTP request failed with status code %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, Version{}, err
+	}
+	return b, v, nil
+}
+
+// checkRemoteServerVersion accepts plain "<major>.<minor>.<patch>" versions only, as they
+// name directories of the mirror and come from request paths.
+func checkRemoteServerVersion(version string) error {
+	v, err := ParseSemanticVersion(version)
+	if err != nil {
+		return err
+	}
+	if v.String() != version {
+		return fmt.Errorf("invalid version %q", version)
+	}
+	return nil
+}
+
+func (c *Client) remoteServerPath(version string, p Platform) string {
+	return path.Join(c.extensionsLocalDir, REMOTE_SERVER_DIR, version, RemoteServerFileName(p))
+}
+
+// StoreRemoteServer writes a downloaded remote server binary to the local directory.
+func (c *Client) StoreRemoteServer(version string, p Platform, b []byte) error {
+	if err := checkRemoteServerVersion(version); err != nil {
+		return err
+	}
+	filePath := c.remoteServerPath(version, p)
+	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filePath, b, 0o644)
+}
+
+// RemoteServerFile returns the path of a mirrored remote server binary in the local
+// directory. Invalid versions are never mirrored, so they are reported as os.ErrNotExist.
+func (c *Client) RemoteServerFile(version string, p Platform) (string, error) {
+	if err := checkRemoteServerVersion(version); err != nil {
+		return "", fmt.Errorf("%w: %w", err, os.ErrNotExist)
+	}
+	filePath := c.remoteServerPath(version, p)
+	if _, err := os.Stat(filePath); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// LatestLocalRemoteServerVersion returns the highest mirrored remote server version
+// available for a platform, or an os.ErrNotExist error if none is mirrored.
+func (c *Client) LatestLocalRemoteServerVersion(p Platform) (string, error) {
+	entries, err := os.ReadDir(path.Join(c.extensionsLocalDir, REMOTE_SERVER_DIR))
+	if err != nil {
+		return "", err
+	}
+
+	latest, latestStr := SemanticVersion{}, ""
+	for _, entry := range entries {
+		v, err := ParseSemanticVersion(entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		if _, err := os.Stat(c.remoteServerPath(entry.Name(), p)); err != nil {
+			continue
+		}
+		if latestStr == "" || v.Compare(latest) > 0 {
+			latest, latestStr = v, entry.Name()
+		}
+	}
+	if latestStr == "" {
+		return "", fmt.Errorf("no remote server mirrored for %v: %w", p, os.ErrNotExist)
+	}
+	return latestStr, nil
+}
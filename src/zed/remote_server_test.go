@@ -0,0 +1,139 @@
+package zed
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatestLocalRemoteServerVersion(t *testing.T) {
+	zc := NewZedClient(1)
+	zc.WithExtensionsLocalDir(t.TempDir())
+	linux := Platform{OS: "linux", Arch: "x86_64"}
+	mac := Platform{OS: "macos", Arch: "aarch64"}
+
+	_, err := zc.LatestLocalRemoteServerVersion(linux)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Nil(t, zc.StoreRemoteServer("0.190.5", linux, []byte("a")))
+	assert.Nil(t, zc.StoreRemoteServer("0.99.0", linux, []byte("b")))
+	assert.Nil(t, zc.StoreRemoteServer("0.191.0", mac, []byte("c")))
+
+	latest, err := zc.LatestLocalRemoteServerVersion(linux)
+	assert.Nil(t, err)
+	assert.Equal(t, "0.190.5", latest)
+
+	filePath, err := zc.RemoteServerFile(latest, linux)
+	assert.Nil(t, err)
+	b, err := os.ReadFile(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), b)
+
+	_, err = zc.RemoteServerFile("0.191.0", linux)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = zc.RemoteServerFile("../../etc", linux)
+	assert.NotNil(t, err)
+	// Pre-release and build suffixes could walk out of the mirror.
+	_, err = zc.RemoteServerFile("0.1.0-x/../../..", linux)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.NotNil(t, zc.StoreRemoteServer("0.1.0+x/../..", linux, []byte("d")))
+	assert.NotNil(t, zc.StoreRemoteServer("v0.1.0", linux, []byte("d")))
+}
+
+func TestDownloadRemoteServer(t *testing.T) {
+	zc := NewZedClient(1)
+	zc.WithExtensionsLocalDir(t.TempDir())
+	linux := Platform{OS: "linux", Arch: "x86_64"}
+	assert.Nil(t, zc.StoreRemoteServer("0.190.5", linux, []byte("binary")))
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	api := NewAPI(false, false, false, true, false, zc, users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	router := httptest.NewServer(api.Router())
+	defer router.Close()
+
+	res, err := http.Get(router.URL + "/releases/stable/latest/asset?asset=zed-remote-server&os=linux&arch=x86_64")
+	assert.Nil(t, err)
+	var v Version
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&v))
+	res.Body.Close()
+	assert.Equal(t, "0.190.5", v.Version)
+
+	res, err = http.Get(router.URL + "/api/releases/stable/0.190.5/zed-remote-server-linux-x86_64.gz")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/gzip", res.Header.Get("Content-Type"))
+	assert.Equal(t, []byte("binary"), b)
+
+	res, err = http.Get(router.URL + "/api/releases/stable/0.190.4/zed-remote-server-linux-x86_64.gz")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestParseRemoteServerFileName(t *testing.T) {
+	p, ok := ParseRemoteServerFileName("zed-remote-server-linux-aarch64.gz")
+	assert.True(t, ok)
+	assert.Equal(t, Platform{OS: "linux", Arch: "aarch64"}, p)
+	assert.Equal(t, "zed-remote-server-linux-aarch64.gz", RemoteServerFileName(p))
+
+	_, ok = ParseRemoteServerFileName("zed-linux-aarch64.tar.gz")
+	assert.False(t, ok)
+}
+
+func TestReleaseParams(t *testing.T) {
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/api/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Version{Version: "0.190.0", URL: "https://example.com/" + r.URL.Query().Get("asset")})
+	})
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	zc := NewZedClient(1)
+	zc.host, zc.apiHost = server.URL, server.URL
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	api := NewAPI(false, false, false, false, false, zc, users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	router := httptest.NewServer(api.Router())
+	defer router.Close()
+
+	get := func(url string) (int, Version) {
+		res, err := http.Get(router.URL + url)
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		var v Version
+		json.NewDecoder(res.Body).Decode(&v)
+		return res.StatusCode, v
+	}
+
+	status, v := get("/releases/stable/0.185.2/asset?asset=zed-remote-server&os=linux&arch=x86_64")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, Version{Version: "0.185.2", URL: server.URL + "/api/releases/stable/0.185.2/zed-remote-server-linux-x86_64.gz"}, v)
+	status, v = get("/releases/preview/0.186.0/asset?asset=zed-remote-server&os=linux&arch=x86_64")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, server.URL+"/api/releases/preview/0.186.0/zed-remote-server-linux-x86_64.gz", v.URL)
+	status, v = get("/releases/stable/latest/asset?asset=zed-remote-server&os=linux&arch=x86_64")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "0.190.0", v.Version)
+
+	status, _ = get("/releases/nightly/0.186.0/asset?asset=zed-remote-server&os=linux&arch=x86_64")
+	assert.Equal(t, 404, status)
+	status, _ = get("/releases/stable/0.1.0-x/asset?asset=zed-remote-server&os=linux&arch=x86_64")
+	assert.Equal(t, 404, status)
+
+	status, v = get("/releases/stable/0.190.0/asset?asset=zed")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "0.190.0", v.Version)
+	status, _ = get("/releases/stable/0.185.2/asset?asset=zed")
+	assert.Equal(t, 404, status)
+	status, _ = get("/releases/preview/latest/asset?asset=zed")
+	assert.Equal(t, 404, status)
+}
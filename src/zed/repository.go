@@ -0,0 +1,514 @@
+package zed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"zedex/utils"
+	"zedex/zed/pb"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// Repository persists the collaboration state of the RPC handler: channels, their
+// members, chat messages, notes and what users have read, contacts and notifications.
+type Repository interface {
+	Channels() ([]*pb.Channel, error)
+	// LastChannelId returns the highest channel ID stored so far, deleted channels
+	// included, so it isn't handed out again.
+	LastChannelId() (uint64, error)
+	PutChannel(channel *pb.Channel) error
+	// DeleteChannels deletes channels with their members, messages and notes at once.
+	DeleteChannels(channelIds ...uint64) error
+
+	ChannelMembers() (map[uint64][]*pb.ChannelMember, error)
+	PutChannelMember(channelId uint64, member *pb.ChannelMember) error
+	DeleteChannelMember(channelId, userId uint64) error
+
+	ChannelMessages() (map[uint64][]*pb.ChannelMessage, error)
+	// LastChannelMessageId returns the highest chat message ID stored so far, removed
+	// messages included.
+	LastChannelMessageId() (uint64, error)
+	PutChannelMessage(channelId uint64, message *pb.ChannelMessage) error
+	DeleteChannelMessage(channelId, messageId uint64) error
+
+	// ObservedChannelMessages returns the latest chat message each user has seen per
+	// channel, by user ID.
+	ObservedChannelMessages() (map[uint64][]*pb.ChannelMessageId, error)
+	PutObservedChannelMessage(userId uint64, observed *pb.ChannelMessageId) error
+
+	// ChannelBufferOperations returns the operations of the notes of each channel in the
+	// order they were added.
+	ChannelBufferOperations() (map[uint64][]*pb.Operation, error)
+	// AddChannelBufferOperations stores operations of the notes of a channel, the first
+	// one being the seq'th operation of the channel.
+	AddChannelBufferOperations(channelId, seq uint64, operations []*pb.Operation) error
+
+	// ChannelBufferSnapshots returns the base text and epoch of the notes of each channel
+	// that were snapshotted, with the channel ID as buffer ID.
+	ChannelBufferSnapshots() ([]*pb.JoinChannelBufferResponse, error)
+	// SnapshotChannelBuffer replaces the operations of the notes of a channel by a new
+	// base text and epoch.
+	SnapshotChannelBuffer(snapshot *pb.JoinChannelBufferResponse) error
+
+	// ObservedChannelBuffers returns the latest version of the notes each user has seen
+	// per channel, by user ID.
+	ObservedChannelBuffers() (map[uint64][]*pb.ChannelBufferVersion, error)
+	PutObservedChannelBuffer(userId uint64, observed *pb.ChannelBufferVersion) error
+
+	// Contacts returns the contacts of each user, by user ID. Every contact is returned
+	// once, by the lower ID of the two users.
+	Contacts() (map[uint64][]*pb.Contact, error)
+	PutContact(userId, contactId uint64) error
+	DeleteContact(userId, contactId uint64) error
+
+	// ContactRequests returns the pending contact requests, by the ID of the user asked.
+	ContactRequests() (map[uint64][]*pb.IncomingContactRequest, error)
+	PutContactRequest(responderId, requesterId uint64) error
+	DeleteContactRequest(responderId, requesterId uint64) error
+
+	// Notifications returns the notifications of each user ordered by ID, by user ID.
+	Notifications() (map[uint64][]*pb.Notification, error)
+	// LastNotificationId returns the highest notification ID stored so far, deleted
+	// notifications included.
+	LastNotificationId() (uint64, error)
+	PutNotification(userId uint64, notification *pb.Notification) error
+	DeleteNotification(userId, notificationId uint64) error
+
+	Close() error
+}
+
+var (
+	boltMetaBucket            = []byte("meta")
+	boltChannelsBucket        = []byte("channels")
+	boltChannelMembersBucket  = []byte("channel_members")
+	boltChannelMessagesBucket = []byte("channel_messages")
+	boltObservedMessageBucket = []byte("observed_channel_messages")
+	boltBufferOperationBucket = []byte("channel_buffer_operations")
+	boltObservedBufferBucket  = []byte("observed_channel_buffers")
+	boltContactsBucket        = []byte("contacts")
+	boltContactRequestsBucket = []byte("contact_requests")
+	boltNotificationsBucket   = []byte("notifications")
+	boltBufferSnapshotsBucket = []byte("channel_buffer_snapshots")
+
+	boltSchemaVersionKey = []byte("schema_version")
+)
+
+// boltMigrations upgrade the schema of the database, its version is the number of
+// migrations applied. Append new migrations, never change released ones.
+var boltMigrations = []func(tx *bbolt.Tx) error{
+	// 1: channels, their members and chat messages, keyed by channel ID (and user or
+	// message ID).
+	func(tx *bbolt.Tx) error {
+		return createBoltBuckets(tx, boltChannelsBucket, boltChannelMembersBucket, boltChannelMessagesBucket)
+	},
+	// 2: the latest chat message each user has seen, keyed by user and channel ID.
+	func(tx *bbolt.Tx) error {
+		return createBoltBuckets(tx, boltObservedMessageBucket)
+	},
+	// 3: the operations of channel notes, keyed by channel ID and sequence number, and
+	// the latest version of them each user has seen, keyed by user and channel ID.
+	func(tx *bbolt.Tx) error {
+		return createBoltBuckets(tx, boltBufferOperationBucket, boltObservedBufferBucket)
+	},
+	// 4: contacts, keyed by the lower and the higher user ID, and contact requests, keyed
+	// by the IDs of the user asked and the user asking.
+	func(tx *bbolt.Tx) error {
+		return createBoltBuckets(tx, boltContactsBucket, boltContactRequestsBucket)
+	},
+	// 5: notifications, keyed by user and notification ID.
+	func(tx *bbolt.Tx) error {
+		return createBoltBuckets(tx, boltNotificationsBucket)
+	},
+	// 6: the base text and epoch of channel notes, keyed by channel ID.
+	func(tx *bbolt.Tx) error {
+		return createBoltBuckets(tx, boltBufferSnapshotsBucket)
+	},
+}
+
+func createBoltBuckets(tx *bbolt.Tx, names ...[]byte) error {
+	for _, name := range names {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BoltRepository is a Repository in a bbolt database file, storing the protobuf
+// encoding of the state.
+type BoltRepository struct {
+	db *bbolt.DB
+}
+
+// OpenBoltRepository opens or creates the database at path and migrates it to the
+// current schema.
+func OpenBoltRepository(name string) (*BoltRepository, error) {
+	utils.CreateDirIfNotExists(path.Dir(name))
+	// The timeout fails instead of blocking when another zedex has the database open.
+	db, err := bbolt.Open(name, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", name, err)
+	}
+	r := &BoltRepository{db: db}
+	if err := r.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate %v: %w", name, err)
+	}
+	return r, nil
+}
+
+// SchemaVersion returns the number of migrations applied to the database.
+func (r *BoltRepository) SchemaVersion() (int, error) {
+	version := 0
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		version = boltSchemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+func boltSchemaVersion(tx *bbolt.Tx) int {
+	meta := tx.Bucket(boltMetaBucket)
+	if meta == nil {
+		return 0
+	}
+	v := meta.Get(boltSchemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func (r *BoltRepository) migrate() error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		version := boltSchemaVersion(tx)
+		if version > len(boltMigrations) {
+			return fmt.Errorf("schema version %v is newer than this zedex supports (%v)", version, len(boltMigrations))
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		for ; version < len(boltMigrations); version++ {
+			if err := boltMigrations[version](tx); err != nil {
+				return fmt.Errorf("migration %v: %w", version+1, err)
+			}
+		}
+		return meta.Put(boltSchemaVersionKey, boltKey(uint64(version)))
+	})
+}
+
+func (r *BoltRepository) Close() error {
+	return r.db.Close()
+}
+
+// boltKey encodes IDs big endian, so keys sort like the IDs and the keys of a channel
+// share its prefix.
+func boltKey(ids ...uint64) []byte {
+	key := make([]byte, 0, 8*len(ids))
+	for _, id := range ids {
+		key = binary.BigEndian.AppendUint64(key, id)
+	}
+	return key
+}
+
+func boltPut(tx *bbolt.Tx, bucket []byte, key []byte, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(key, b)
+}
+
+// boltPutWithId puts a value whose ID is handed out by a store, raising the sequence of
+// the bucket to the ID so it survives deleting the value.
+func boltPutWithId(tx *bbolt.Tx, bucket []byte, key []byte, id uint64, m proto.Message) error {
+	if err := boltPut(tx, bucket, key, m); err != nil {
+		return err
+	}
+	if b := tx.Bucket(bucket); id > b.Sequence() {
+		return b.SetSequence(id)
+	}
+	return nil
+}
+
+// boltSequence returns the sequence of a bucket, the highest ID put with boltPutWithId.
+func boltSequence(db *bbolt.DB, bucket []byte) (uint64, error) {
+	sequence := uint64(0)
+	err := db.View(func(tx *bbolt.Tx) error {
+		sequence = tx.Bucket(bucket).Sequence()
+		return nil
+	})
+	return sequence, err
+}
+
+// boltLoad decodes all values of a bucket, passing the first ID of their key along.
+func boltLoad[T proto.Message](db *bbolt.DB, bucket []byte, newT func() T, f func(id uint64, m T)) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if len(k) < 8 {
+				return fmt.Errorf("invalid key %x in %s", k, bucket)
+			}
+			m := newT()
+			if err := proto.Unmarshal(v, m); err != nil {
+				return fmt.Errorf("invalid value of %x in %s: %w", k, bucket, err)
+			}
+			f(binary.BigEndian.Uint64(k), m)
+			return nil
+		})
+	})
+}
+
+// boltDeletePrefix deletes all keys of a bucket starting with prefix.
+func boltDeletePrefix(tx *bbolt.Tx, bucket []byte, prefix []byte) error {
+	c := tx.Bucket(bucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BoltRepository) Channels() ([]*pb.Channel, error) {
+	channels := []*pb.Channel{}
+	err := boltLoad(r.db, boltChannelsBucket, func() *pb.Channel { return &pb.Channel{} }, func(_ uint64, c *pb.Channel) {
+		channels = append(channels, c)
+	})
+	return channels, err
+}
+
+func (r *BoltRepository) LastChannelId() (uint64, error) {
+	return boltSequence(r.db, boltChannelsBucket)
+}
+
+func (r *BoltRepository) PutChannel(channel *pb.Channel) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPutWithId(tx, boltChannelsBucket, boltKey(channel.Id), channel.Id, channel)
+	})
+}
+
+func (r *BoltRepository) DeleteChannels(channelIds ...uint64) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		for _, channelId := range channelIds {
+			if err := tx.Bucket(boltChannelsBucket).Delete(boltKey(channelId)); err != nil {
+				return err
+			}
+			if err := errors.Join(
+				boltDeletePrefix(tx, boltChannelMembersBucket, boltKey(channelId)),
+				boltDeletePrefix(tx, boltChannelMessagesBucket, boltKey(channelId)),
+				boltDeletePrefix(tx, boltBufferOperationBucket, boltKey(channelId)),
+				tx.Bucket(boltBufferSnapshotsBucket).Delete(boltKey(channelId)),
+				boltDeleteObserved(tx, boltObservedMessageBucket, channelId),
+				boltDeleteObserved(tx, boltObservedBufferBucket, channelId),
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) ChannelMembers() (map[uint64][]*pb.ChannelMember, error) {
+	members := map[uint64][]*pb.ChannelMember{}
+	err := boltLoad(r.db, boltChannelMembersBucket, func() *pb.ChannelMember { return &pb.ChannelMember{} }, func(channelId uint64, m *pb.ChannelMember) {
+		members[channelId] = append(members[channelId], m)
+	})
+	return members, err
+}
+
+func (r *BoltRepository) PutChannelMember(channelId uint64, member *pb.ChannelMember) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPut(tx, boltChannelMembersBucket, boltKey(channelId, member.UserId), member)
+	})
+}
+
+func (r *BoltRepository) DeleteChannelMember(channelId, userId uint64) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltChannelMembersBucket).Delete(boltKey(channelId, userId))
+	})
+}
+
+func (r *BoltRepository) ChannelMessages() (map[uint64][]*pb.ChannelMessage, error) {
+	messages := map[uint64][]*pb.ChannelMessage{}
+	err := boltLoad(r.db, boltChannelMessagesBucket, func() *pb.ChannelMessage { return &pb.ChannelMessage{} }, func(channelId uint64, m *pb.ChannelMessage) {
+		messages[channelId] = append(messages[channelId], m)
+	})
+	return messages, err
+}
+
+func (r *BoltRepository) LastChannelMessageId() (uint64, error) {
+	return boltSequence(r.db, boltChannelMessagesBucket)
+}
+
+func (r *BoltRepository) PutChannelMessage(channelId uint64, message *pb.ChannelMessage) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPutWithId(tx, boltChannelMessagesBucket, boltKey(channelId, message.Id), message.Id, message)
+	})
+}
+
+func (r *BoltRepository) DeleteChannelMessage(channelId, messageId uint64) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltChannelMessagesBucket).Delete(boltKey(channelId, messageId))
+	})
+}
+
+func (r *BoltRepository) ObservedChannelMessages() (map[uint64][]*pb.ChannelMessageId, error) {
+	observed := map[uint64][]*pb.ChannelMessageId{}
+	err := boltLoad(r.db, boltObservedMessageBucket, func() *pb.ChannelMessageId { return &pb.ChannelMessageId{} }, func(userId uint64, m *pb.ChannelMessageId) {
+		observed[userId] = append(observed[userId], m)
+	})
+	return observed, err
+}
+
+func (r *BoltRepository) PutObservedChannelMessage(userId uint64, observed *pb.ChannelMessageId) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPut(tx, boltObservedMessageBucket, boltKey(userId, observed.ChannelId), observed)
+	})
+}
+
+// boltDeleteObserved deletes what users have seen of a channel from a bucket keyed by
+// user first.
+func boltDeleteObserved(tx *bbolt.Tx, bucket []byte, channelId uint64) error {
+	c := tx.Bucket(bucket).Cursor()
+	channelKey := boltKey(channelId)
+	for k, _ := c.First(); k != nil; {
+		if len(k) == 16 && bytes.Equal(k[8:], channelKey) {
+			deleted := bytes.Clone(k)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			k, _ = c.Seek(deleted)
+			continue
+		}
+		k, _ = c.Next()
+	}
+	return nil
+}
+
+func (r *BoltRepository) ChannelBufferOperations() (map[uint64][]*pb.Operation, error) {
+	operations := map[uint64][]*pb.Operation{}
+	err := boltLoad(r.db, boltBufferOperationBucket, func() *pb.Operation { return &pb.Operation{} }, func(channelId uint64, o *pb.Operation) {
+		operations[channelId] = append(operations[channelId], o)
+	})
+	return operations, err
+}
+
+func (r *BoltRepository) AddChannelBufferOperations(channelId, seq uint64, operations []*pb.Operation) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		for i, o := range operations {
+			if err := boltPut(tx, boltBufferOperationBucket, boltKey(channelId, seq+uint64(i)), o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) ChannelBufferSnapshots() ([]*pb.JoinChannelBufferResponse, error) {
+	snapshots := []*pb.JoinChannelBufferResponse{}
+	err := boltLoad(r.db, boltBufferSnapshotsBucket, func() *pb.JoinChannelBufferResponse { return &pb.JoinChannelBufferResponse{} }, func(_ uint64, s *pb.JoinChannelBufferResponse) {
+		snapshots = append(snapshots, s)
+	})
+	return snapshots, err
+}
+
+func (r *BoltRepository) SnapshotChannelBuffer(snapshot *pb.JoinChannelBufferResponse) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		if err := boltPut(tx, boltBufferSnapshotsBucket, boltKey(snapshot.BufferId), snapshot); err != nil {
+			return err
+		}
+		return boltDeletePrefix(tx, boltBufferOperationBucket, boltKey(snapshot.BufferId))
+	})
+}
+
+func (r *BoltRepository) ObservedChannelBuffers() (map[uint64][]*pb.ChannelBufferVersion, error) {
+	observed := map[uint64][]*pb.ChannelBufferVersion{}
+	err := boltLoad(r.db, boltObservedBufferBucket, func() *pb.ChannelBufferVersion { return &pb.ChannelBufferVersion{} }, func(userId uint64, v *pb.ChannelBufferVersion) {
+		observed[userId] = append(observed[userId], v)
+	})
+	return observed, err
+}
+
+func (r *BoltRepository) PutObservedChannelBuffer(userId uint64, observed *pb.ChannelBufferVersion) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPut(tx, boltObservedBufferBucket, boltKey(userId, observed.ChannelId), observed)
+	})
+}
+
+// contactKey orders the users of a contact, so each contact has one key.
+func contactKey(userId, contactId uint64) (uint64, uint64) {
+	return min(userId, contactId), max(userId, contactId)
+}
+
+func (r *BoltRepository) Contacts() (map[uint64][]*pb.Contact, error) {
+	contacts := map[uint64][]*pb.Contact{}
+	err := boltLoad(r.db, boltContactsBucket, func() *pb.Contact { return &pb.Contact{} }, func(userId uint64, c *pb.Contact) {
+		contacts[userId] = append(contacts[userId], c)
+	})
+	return contacts, err
+}
+
+func (r *BoltRepository) PutContact(userId, contactId uint64) error {
+	a, b := contactKey(userId, contactId)
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPut(tx, boltContactsBucket, boltKey(a, b), &pb.Contact{UserId: b})
+	})
+}
+
+func (r *BoltRepository) DeleteContact(userId, contactId uint64) error {
+	a, b := contactKey(userId, contactId)
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltContactsBucket).Delete(boltKey(a, b))
+	})
+}
+
+func (r *BoltRepository) ContactRequests() (map[uint64][]*pb.IncomingContactRequest, error) {
+	requests := map[uint64][]*pb.IncomingContactRequest{}
+	err := boltLoad(r.db, boltContactRequestsBucket, func() *pb.IncomingContactRequest { return &pb.IncomingContactRequest{} }, func(responderId uint64, req *pb.IncomingContactRequest) {
+		requests[responderId] = append(requests[responderId], req)
+	})
+	return requests, err
+}
+
+func (r *BoltRepository) PutContactRequest(responderId, requesterId uint64) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPut(tx, boltContactRequestsBucket, boltKey(responderId, requesterId), &pb.IncomingContactRequest{RequesterId: requesterId})
+	})
+}
+
+func (r *BoltRepository) DeleteContactRequest(responderId, requesterId uint64) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltContactRequestsBucket).Delete(boltKey(responderId, requesterId))
+	})
+}
+
+func (r *BoltRepository) Notifications() (map[uint64][]*pb.Notification, error) {
+	notifications := map[uint64][]*pb.Notification{}
+	err := boltLoad(r.db, boltNotificationsBucket, func() *pb.Notification { return &pb.Notification{} }, func(userId uint64, n *pb.Notification) {
+		notifications[userId] = append(notifications[userId], n)
+	})
+	return notifications, err
+}
+
+func (r *BoltRepository) LastNotificationId() (uint64, error) {
+	return boltSequence(r.db, boltNotificationsBucket)
+}
+
+func (r *BoltRepository) PutNotification(userId uint64, notification *pb.Notification) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return boltPutWithId(tx, boltNotificationsBucket, boltKey(userId, notification.Id), notification.Id, notification)
+	})
+}
+
+func (r *BoltRepository) DeleteNotification(userId, notificationId uint64) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltNotificationsBucket).Delete(boltKey(userId, notificationId))
+	})
+}
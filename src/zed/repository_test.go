@@ -0,0 +1,163 @@
+package zed
+
+import (
+	"path"
+	"testing"
+
+	"zedex/zed/pb"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBoltRepository(t *testing.T) {
+	file := path.Join(t.TempDir(), "collab.db")
+	repo, err := OpenBoltRepository(file)
+	assert.Nil(t, err)
+	version, err := repo.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, len(boltMigrations), version)
+
+	channels, err := NewChannelStore(repo)
+	assert.Nil(t, err)
+	for _, name := range []string{"zed", "zedex"} {
+		_, err := channels.CreateChannel(name, nil, 1)
+		assert.Nil(t, err)
+	}
+	zed := uint64(1)
+	_, err = channels.CreateChannel("notes", &zed, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, channels.PutMember(zed, &pb.ChannelMember{UserId: 1, Role: pb.ChannelRole_Admin}))
+	assert.Nil(t, channels.PutMember(zed, &pb.ChannelMember{UserId: 1, Role: pb.ChannelRole_Member}))
+	for range 3 {
+		_, err := channels.AddMessage(zed, &pb.ChannelMessage{Body: "hello"})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, channels.PutMember(zed, &pb.ChannelMember{UserId: 2, Role: pb.ChannelRole_Member}))
+	assert.Nil(t, channels.ObserveMessage(2, zed, 2))
+	assert.Nil(t, channels.ObserveMessage(2, zed, 1))
+	for timestamp := uint32(1); timestamp <= 2; timestamp++ {
+		_, err := channels.AddBufferOperations(zed, []*pb.Operation{testEdit(8, timestamp, "hello")})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, channels.ObserveBuffer(2, zed, []*pb.VectorClockEntry{{ReplicaId: 8, Timestamp: 1}}))
+	contacts, err := NewContactStore(repo)
+	assert.Nil(t, err)
+	for _, responderId := range []uint64{1, 3} {
+		_, err := contacts.Request(2, responderId)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, contacts.Respond(1, 2, true))
+	notifications, err := NewNotificationStore(repo)
+	assert.Nil(t, err)
+	for messageId := uint64(1); messageId <= 2; messageId++ {
+		_, err := notifications.Add(2, NotificationChannelMessageMention, messageId, channelMessageMentionContent{SenderId: 1, ChannelId: zed})
+		assert.Nil(t, err)
+	}
+	_, err = notifications.MarkRead(2, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, repo.Close())
+
+	// The state survives a restart.
+	repo, err = OpenBoltRepository(file)
+	assert.Nil(t, err)
+	defer repo.Close()
+	reloaded, err := NewChannelStore(repo)
+	assert.Nil(t, err)
+	assert.Len(t, reloaded.Channels(), 3)
+	assert.Equal(t, []uint64{zed}, reloaded.Channels()[2].ParentPath)
+	created, err := reloaded.CreateChannel("docs", nil, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), created.Id)
+	assert.True(t, proto.Equal(&pb.ChannelMember{UserId: 1, Role: pb.ChannelRole_Member}, reloaded.Members(zed)[0]))
+	messages := reloaded.Messages(zed)
+	assert.Len(t, messages, 3)
+	assert.Equal(t, uint64(1), messages[0].Id)
+	assert.Equal(t, uint64(3), reloaded.LatestMessageIds(1)[0].MessageId)
+	added, err := reloaded.AddMessage(zed, &pb.ChannelMessage{Body: "again"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), added.Id)
+	assert.Equal(t, uint64(2), reloaded.ObservedMessageIds(2)[0].MessageId)
+	assert.Len(t, reloaded.BufferOperations(zed, nil), 2)
+	assert.Equal(t, uint32(2), reloaded.BufferVersion(zed)[0].Timestamp)
+	assert.Equal(t, uint32(1), reloaded.ObservedBufferVersions(2)[0].Version[0].Timestamp)
+	// Snapshots replace the operations of notes.
+	_, err = reloaded.AddBufferOperations(created.Id, []*pb.Operation{testRangeEdit(8, 1, nil, [][2]uint64{{0, 0}}, "hello")})
+	assert.Nil(t, err)
+	assert.Nil(t, reloaded.SnapshotBuffer(created.Id))
+	snapshotted, err := NewChannelStore(repo)
+	assert.Nil(t, err)
+	baseText, epoch := snapshotted.BufferSnapshot(created.Id)
+	assert.Equal(t, "hello", baseText)
+	assert.Equal(t, uint64(1), epoch)
+	assert.Empty(t, snapshotted.BufferOperations(created.Id, nil))
+	assert.Len(t, snapshotted.BufferOperations(zed, nil), 2)
+	reloadedContacts, err := NewContactStore(repo)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{2}, reloadedContacts.Contacts(1))
+	assert.Equal(t, []uint64{1}, reloadedContacts.Contacts(2))
+	assert.Equal(t, []uint64{2}, reloadedContacts.IncomingRequests(3))
+	assert.Nil(t, reloadedContacts.Remove(1, 2))
+	storedContacts, err := repo.Contacts()
+	assert.Nil(t, err)
+	assert.Empty(t, storedContacts[1])
+	reloadedNotifications, err := NewNotificationStore(repo)
+	assert.Nil(t, err)
+	page, _ := reloadedNotifications.Page(2, 0, 10)
+	assert.Len(t, page, 2)
+	assert.True(t, page[0].IsRead)
+	notification, err := reloadedNotifications.Add(2, NotificationContactRequest, 1, struct{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), notification.Id)
+	// The ID of a deleted notification isn't handed out again.
+	assert.Nil(t, reloadedNotifications.Delete(2, notification.Id))
+	reloadedNotifications, err = NewNotificationStore(repo)
+	assert.Nil(t, err)
+	notification, err = reloadedNotifications.Add(2, NotificationContactRequest, 1, struct{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), notification.Id)
+
+	// Deleting a channel deletes its members and messages.
+	assert.Nil(t, repo.DeleteChannels(zed))
+	members, err := repo.ChannelMembers()
+	assert.Nil(t, err)
+	assert.NotContains(t, members, zed)
+	allMessages, err := repo.ChannelMessages()
+	assert.Nil(t, err)
+	assert.Empty(t, allMessages)
+	observed, err := repo.ObservedChannelMessages()
+	assert.Nil(t, err)
+	assert.Empty(t, observed)
+	operations, err := repo.ChannelBufferOperations()
+	assert.Nil(t, err)
+	assert.Empty(t, operations)
+	observedBuffers, err := repo.ObservedChannelBuffers()
+	assert.Nil(t, err)
+	assert.Empty(t, observedBuffers)
+
+	// IDs of deleted channels and messages aren't handed out again.
+	assert.Nil(t, repo.DeleteChannels(created.Id))
+	restarted, err := NewChannelStore(repo)
+	assert.Nil(t, err)
+	recreated, err := restarted.CreateChannel("docs", nil, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, created.Id+1, recreated.Id)
+	message, err := restarted.AddMessage(recreated.Id, &pb.ChannelMessage{Body: "hello"})
+	assert.Nil(t, err)
+	assert.Equal(t, added.Id+1, message.Id)
+}
+
+func TestBoltRepositoryMigrations(t *testing.T) {
+	file := path.Join(t.TempDir(), "collab.db")
+	repo, err := OpenBoltRepository(file)
+	assert.Nil(t, err)
+	// Pretend a newer zedex wrote the database.
+	assert.Nil(t, repo.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltSchemaVersionKey, boltKey(uint64(len(boltMigrations)+1)))
+	}))
+	assert.Nil(t, repo.Close())
+
+	_, err = OpenBoltRepository(file)
+	assert.ErrorContains(t, err, "newer")
+}
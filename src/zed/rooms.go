@@ -0,0 +1,356 @@
+package zed
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+
+	"zedex/zed/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// room is a call, or the call of a channel, that users are in or are called to.
+type room struct {
+	room *pb.Room
+	// channelId is the channel of the room, 0 for calls.
+	channelId uint64
+}
+
+// RoomStore keeps the rooms users are in and the calls to join them. Rooms only live as
+// long as someone is in them, so they are kept in memory only.
+type RoomStore struct {
+	rooms map[uint64]*room
+	// channelRooms are the IDs of the rooms of channels, by channel ID.
+	channelRooms map[uint64]uint64
+	nextId       uint64
+	mtx          sync.Mutex
+}
+
+func NewRoomStore() *RoomStore {
+	return &RoomStore{
+		rooms:        map[uint64]*room{},
+		channelRooms: map[uint64]uint64{},
+		nextId:       1,
+	}
+}
+
+func (s *RoomStore) roomUnsafe(roomId uint64) (*room, error) {
+	r, ok := s.rooms[roomId]
+	if !ok {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "no room %v", roomId)
+	}
+	return r, nil
+}
+
+// roomOfUnsafe returns the room a user is in.
+func (s *RoomStore) roomOfUnsafe(userId uint64) (*room, bool) {
+	for _, r := range s.rooms {
+		if slices.ContainsFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == userId }) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (s *RoomStore) busyUnsafe(userId uint64) bool {
+	for _, r := range s.rooms {
+		if slices.ContainsFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == userId }) ||
+			slices.ContainsFunc(r.room.PendingParticipants, func(p *pb.PendingParticipant) bool { return p.UserId == userId }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *RoomStore) newRoomUnsafe(channelId uint64) *room {
+	r := &room{
+		room: &pb.Room{
+			Id:          s.nextId,
+			LivekitRoom: fmt.Sprintf("zedex-room-%d", s.nextId),
+		},
+		channelId: channelId,
+	}
+	s.nextId++
+	s.rooms[r.room.Id] = r
+	if channelId != 0 {
+		s.channelRooms[channelId] = r.room.Id
+	}
+	return r
+}
+
+// addParticipantUnsafe adds a user to a room with the lowest participant index free,
+// which Zed uses to pick the color of the user.
+func (r *room) addParticipantUnsafe(userId uint64, role pb.ChannelRole) {
+	index := uint32(0)
+	for slices.ContainsFunc(r.room.Participants, func(p *pb.Participant) bool { return p.ParticipantIndex == index }) {
+		index++
+	}
+	r.room.Participants = append(r.room.Participants, &pb.Participant{
+		UserId:           userId,
+		PeerId:           &pb.PeerId{Id: uint32(userId)},
+		Location:         &pb.ParticipantLocation{Variant: &pb.ParticipantLocation_External_{External: &pb.ParticipantLocation_External{}}},
+		ParticipantIndex: index,
+		Role:             role,
+	})
+	r.room.PendingParticipants = slices.DeleteFunc(r.room.PendingParticipants, func(p *pb.PendingParticipant) bool { return p.UserId == userId })
+}
+
+// Busy returns whether a user is in a room or is called to one.
+func (s *RoomStore) Busy(userId uint64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.busyUnsafe(userId)
+}
+
+// Room returns a room and the ID of its channel, 0 for calls.
+func (s *RoomStore) Room(roomId uint64) (*pb.Room, uint64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return proto.Clone(r.room).(*pb.Room), r.channelId, nil
+}
+
+// RoomOf returns the room a user is in and the ID of its channel, 0 for calls.
+func (s *RoomStore) RoomOf(userId uint64) (*pb.Room, uint64, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, ok := s.roomOfUnsafe(userId)
+	if !ok {
+		return nil, 0, false
+	}
+	return proto.Clone(r.room).(*pb.Room), r.channelId, true
+}
+
+// Create creates a call with a user in it.
+func (s *RoomStore) Create(userId uint64) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.roomOfUnsafe(userId); ok {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "already in a room")
+	}
+	r := s.newRoomUnsafe(0)
+	r.addParticipantUnsafe(userId, pb.ChannelRole_Member)
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// Join adds a user called to a call to it.
+func (s *RoomStore) Join(roomId, userId uint64) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(r.room.PendingParticipants, func(p *pb.PendingParticipant) bool { return p.UserId == userId }) {
+		return nil, rpcErrorf(pb.ErrorCode_Forbidden, "not called to room %v", roomId)
+	}
+	if _, ok := s.roomOfUnsafe(userId); ok {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "already in a room")
+	}
+	r.addParticipantUnsafe(userId, pb.ChannelRole_Member)
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// JoinChannel adds a user to the room of a channel with their role in the channel,
+// creating the room if nobody is in it.
+func (s *RoomStore) JoinChannel(channelId, userId uint64, role pb.ChannelRole) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.roomOfUnsafe(userId); ok {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "already in a room")
+	}
+	r, ok := s.rooms[s.channelRooms[channelId]]
+	if !ok {
+		r = s.newRoomUnsafe(channelId)
+	}
+	r.addParticipantUnsafe(userId, role)
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// Rejoin returns a room for a participant that reconnected to it.
+func (s *RoomStore) Rejoin(roomId, userId uint64) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == userId }) {
+		return nil, rpcErrorf(pb.ErrorCode_Forbidden, "not in room %v", roomId)
+	}
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// LeftRoom is the room a user left, and the users whose calls were canceled because
+// they were called by the user or nobody is left.
+type LeftRoom struct {
+	Room      *pb.Room
+	ChannelId uint64
+	Canceled  []uint64
+}
+
+// Leave removes a user from the room they are in, deleting the room when nobody is
+// left. It reports whether the user was in a room.
+func (s *RoomStore) Leave(userId uint64) (LeftRoom, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, ok := s.roomOfUnsafe(userId)
+	if !ok {
+		return LeftRoom{}, false
+	}
+	r.room.Participants = slices.DeleteFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == userId })
+	canceled := []uint64{}
+	r.room.PendingParticipants = slices.DeleteFunc(r.room.PendingParticipants, func(p *pb.PendingParticipant) bool {
+		if p.CallingUserId == userId || len(r.room.Participants) == 0 {
+			canceled = append(canceled, p.UserId)
+			return true
+		}
+		return false
+	})
+	if len(r.room.Participants) == 0 {
+		delete(s.rooms, r.room.Id)
+		delete(s.channelRooms, r.channelId)
+	}
+	return LeftRoom{Room: proto.Clone(r.room).(*pb.Room), ChannelId: r.channelId, Canceled: canceled}, true
+}
+
+// CloseChannel deletes the room of a channel with everyone in it or called to it, e.g.
+// as the channel was deleted. It returns the room as it was, and whether there was one.
+func (s *RoomStore) CloseChannel(channelId uint64) (*pb.Room, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, ok := s.rooms[s.channelRooms[channelId]]
+	if !ok {
+		return nil, false
+	}
+	delete(s.rooms, r.room.Id)
+	delete(s.channelRooms, channelId)
+	return proto.Clone(r.room).(*pb.Room), true
+}
+
+// Call calls a user that isn't busy to the room the caller is in.
+func (s *RoomStore) Call(roomId, callerId, calledId uint64, initialProjectId *uint64) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == callerId }) {
+		return nil, rpcErrorf(pb.ErrorCode_Forbidden, "not in room %v", roomId)
+	}
+	if s.busyUnsafe(calledId) {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "user %v is busy", calledId)
+	}
+	r.room.PendingParticipants = append(r.room.PendingParticipants, &pb.PendingParticipant{
+		UserId:           calledId,
+		CallingUserId:    callerId,
+		InitialProjectId: initialProjectId,
+	})
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// CancelCall cancels the call of a user to a room, by a participant of the room.
+func (s *RoomStore) CancelCall(roomId, callerId, calledId uint64) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == callerId }) {
+		return nil, rpcErrorf(pb.ErrorCode_Forbidden, "not in room %v", roomId)
+	}
+	return s.removePendingUnsafe(r, calledId)
+}
+
+// DeclineCall declines the call of a user to a room.
+func (s *RoomStore) DeclineCall(roomId, userId uint64) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	return s.removePendingUnsafe(r, userId)
+}
+
+func (s *RoomStore) removePendingUnsafe(r *room, userId uint64) (*pb.Room, error) {
+	pending := len(r.room.PendingParticipants)
+	r.room.PendingParticipants = slices.DeleteFunc(r.room.PendingParticipants, func(p *pb.PendingParticipant) bool { return p.UserId == userId })
+	if len(r.room.PendingParticipants) == pending {
+		return nil, rpcErrorf(pb.ErrorCode_Internal, "user %v isn't called to room %v", userId, r.room.Id)
+	}
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// Calls returns the IDs of the rooms a user is called to.
+func (s *RoomStore) Calls(userId uint64) []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	roomIds := []uint64{}
+	for id, r := range s.rooms {
+		if slices.ContainsFunc(r.room.PendingParticipants, func(p *pb.PendingParticipant) bool { return p.UserId == userId }) {
+			roomIds = append(roomIds, id)
+		}
+	}
+	slices.SortFunc(roomIds, cmp.Compare)
+	return roomIds
+}
+
+// UpdateLocation sets what a participant of a room is looking at.
+func (s *RoomStore) UpdateLocation(roomId, userId uint64, location *pb.ParticipantLocation) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == userId })
+	if i < 0 {
+		return nil, rpcErrorf(pb.ErrorCode_Forbidden, "not in room %v", roomId)
+	}
+	r.room.Participants[i].Location = proto.Clone(location).(*pb.ParticipantLocation)
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// SetRole sets the role of a participant of a room, e.g. when their role in the channel
+// of the room changed.
+func (s *RoomStore) SetRole(roomId, userId uint64, role pb.ChannelRole) (*pb.Room, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r, err := s.roomUnsafe(roomId)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(r.room.Participants, func(p *pb.Participant) bool { return p.UserId == userId })
+	if i < 0 {
+		return nil, rpcErrorf(pb.ErrorCode_Forbidden, "not in room %v", roomId)
+	}
+	r.room.Participants[i].Role = role
+	return proto.Clone(r.room).(*pb.Room), nil
+}
+
+// ChannelParticipants returns the users in the room of each of channelIds that has one.
+func (s *RoomStore) ChannelParticipants(channelIds []uint64) []*pb.ChannelParticipants {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	participants := []*pb.ChannelParticipants{}
+	for _, channelId := range channelIds {
+		r, ok := s.rooms[s.channelRooms[channelId]]
+		if !ok {
+			continue
+		}
+		userIds := []uint64{}
+		for _, p := range r.room.Participants {
+			userIds = append(userIds, p.UserId)
+		}
+		participants = append(participants, &pb.ChannelParticipants{ChannelId: channelId, ParticipantUserIds: userIds})
+	}
+	return participants
+}
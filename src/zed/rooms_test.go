@@ -0,0 +1,83 @@
+package zed
+
+import (
+	"testing"
+
+	"zedex/zed/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRooms(t *testing.T) {
+	rooms := NewRoomStore()
+	alice, bob, carol := uint64(1), uint64(2), uint64(3)
+
+	room, err := rooms.Create(alice)
+	assert.Nil(t, err)
+	assert.True(t, rooms.Busy(alice))
+	_, err = rooms.Create(alice)
+	assert.NotNil(t, err)
+	_, err = rooms.Join(room.Id, bob)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+
+	room, err = rooms.Call(room.Id, alice, bob, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, alice, room.PendingParticipants[0].CallingUserId)
+	assert.True(t, rooms.Busy(bob))
+	_, err = rooms.Call(room.Id, alice, bob, nil)
+	assert.NotNil(t, err)
+	room, err = rooms.Join(room.Id, bob)
+	assert.Nil(t, err)
+	assert.Empty(t, room.PendingParticipants)
+	assert.Equal(t, []uint32{0, 1}, []uint32{room.Participants[0].ParticipantIndex, room.Participants[1].ParticipantIndex})
+	_, err = rooms.Rejoin(room.Id, bob)
+	assert.Nil(t, err)
+	_, err = rooms.Rejoin(room.Id, carol)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+
+	location := &pb.ParticipantLocation{Variant: &pb.ParticipantLocation_SharedProject_{SharedProject: &pb.ParticipantLocation_SharedProject{Id: 5}}}
+	room, err = rooms.UpdateLocation(room.Id, bob, location)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), room.Participants[1].Location.GetSharedProject().Id)
+
+	// Leaving cancels the calls the user made, the last one out deletes the room.
+	_, err = rooms.Call(room.Id, bob, carol, nil)
+	assert.Nil(t, err)
+	left, ok := rooms.Leave(bob)
+	assert.True(t, ok)
+	assert.Equal(t, []uint64{carol}, left.Canceled)
+	assert.False(t, rooms.Busy(carol))
+	_, ok = rooms.Leave(alice)
+	assert.True(t, ok)
+	_, _, err = rooms.Room(room.Id)
+	assert.NotNil(t, err)
+
+	// Users in the room of a channel share it.
+	channelRoom, err := rooms.JoinChannel(7, alice, pb.ChannelRole_Admin)
+	assert.Nil(t, err)
+	joined, err := rooms.JoinChannel(7, carol, pb.ChannelRole_Guest)
+	assert.Nil(t, err)
+	assert.Equal(t, channelRoom.Id, joined.Id)
+	assert.Equal(t, pb.ChannelRole_Guest, joined.Participants[1].Role)
+	promoted, err := rooms.SetRole(channelRoom.Id, carol, pb.ChannelRole_Member)
+	assert.Nil(t, err)
+	assert.Equal(t, pb.ChannelRole_Member, promoted.Participants[1].Role)
+	_, channelId, ok := rooms.RoomOf(carol)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), channelId)
+	_, err = rooms.SetRole(channelRoom.Id, bob, pb.ChannelRole_Member)
+	assertRpcError(t, pb.ErrorCode_Forbidden, err)
+	assert.Equal(t, []*pb.ChannelParticipants{{ChannelId: 7, ParticipantUserIds: []uint64{alice, carol}}}, rooms.ChannelParticipants([]uint64{7, 8}))
+
+	// Closing the room of a channel removes everyone from it.
+	_, err = rooms.Call(channelRoom.Id, alice, bob, nil)
+	assert.Nil(t, err)
+	closed, ok := rooms.CloseChannel(7)
+	assert.True(t, ok)
+	assert.Len(t, closed.Participants, 2)
+	assert.Len(t, closed.PendingParticipants, 1)
+	assert.False(t, rooms.Busy(alice) || rooms.Busy(bob) || rooms.Busy(carol))
+	assert.Empty(t, rooms.ChannelParticipants([]uint64{7}))
+	_, ok = rooms.CloseChannel(7)
+	assert.False(t, ok)
+}
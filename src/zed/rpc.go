@@ -1,17 +1,20 @@
 package zed
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"zedex/utils"
 	"zedex/zed/pb"
 
-	"github.com/0x6flab/namegenerator"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/klauspost/compress/zstd"
@@ -23,27 +26,87 @@ import (
 const (
 	ZSTD_COMPRESSION_LEVEL = 4
 	WEBSOCKET_READ_LIMIT   = 1024 * 1024
+	// RECONNECT_TIMEOUT is how long a user who lost their connection stays in their room
+	// and keeps the calls to them, for Zed to reconnect and rejoin the room.
+	RECONNECT_TIMEOUT = 30 * time.Second
 )
 
+// rpcConn is the connection of a user. Messages to a user are sent from the goroutines
+// of other users too, e.g. chat messages, and websocket connections support only one
+// concurrent writer.
+type rpcConn struct {
+	*websocket.Conn
+	writeMtx sync.Mutex
+}
+
+func (c *rpcConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// RpcError is an error reported to Zed as the response to a request, with a code Zed
+// acts on, e.g. to tell why a channel could not be moved.
+type RpcError struct {
+	Code    pb.ErrorCode
+	Message string
+}
+
+func (e *RpcError) Error() string {
+	return e.Message
+}
+
+func rpcErrorf(code pb.ErrorCode, format string, args ...any) error {
+	return &RpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
 type RpcHandler struct {
-	sockets         utils.ConcurrentMap[int, *websocket.Conn]
-	users           utils.ConcurrentMap[uint64, *pb.User]
-	channels        utils.ConcurrentMap[uint64, *pb.Channel]
-	channelMembers  utils.ConcurrentMap[uint64, []*pb.ChannelMember]
-	channelMessages utils.ConcurrentMap[uint64, []*pb.ChannelMessage]
-	id              utils.ConcurrentCounter[uint32]
-	nameGenerator   namegenerator.NameGenerator
+	sockets   utils.ConcurrentMap[int, *rpcConn]
+	users     *UserStore
+	flags     *FlagStore
+	llmTokens *LLMTokens
+	usage     *UsageStore
+	plans     *PlanStore
+	channels  *ChannelStore
+	contacts  *ContactStore
+	// notifications are the notifications of users, Zed's notification panel.
+	notifications *NotificationStore
+	rooms         *RoomStore
+	// liveKit issues the tokens for the audio and screen sharing of rooms, if set.
+	liveKit *LiveKitTokens
+	// chatParticipants are the users that joined the chat of a channel, by channel ID.
+	chatParticipants utils.ConcurrentMap[uint64, []int]
+	// bufferCollaborators are the users that opened the notes of a channel, by channel ID.
+	bufferCollaborators utils.ConcurrentMap[uint64, []*pb.Collaborator]
+	// reconnecting are the timers taking users who lost their connection out of their
+	// room once reconnectTimeout passed, by user ID.
+	reconnecting     utils.ConcurrentMap[int, *time.Timer]
+	reconnectTimeout time.Duration
+	id               utils.ConcurrentCounter[uint32]
 }
 
-func NewRpcHandler() RpcHandler {
+func NewRpcHandler(users *UserStore, flags *FlagStore, llmTokens *LLMTokens, usage *UsageStore, plans *PlanStore) RpcHandler {
+	// Without a repository there is nothing to load, see WithChannels, WithContacts and
+	// WithNotifications for persistence.
+	channels, _ := NewChannelStore(nil)
+	contacts, _ := NewContactStore(nil)
+	notifications, _ := NewNotificationStore(nil)
 	return RpcHandler{
-		sockets:         utils.NewConcurrentMap[int, *websocket.Conn](),
-		users:           utils.NewConcurrentMap[uint64, *pb.User](),
-		channels:        utils.NewConcurrentMap[uint64, *pb.Channel](),
-		channelMembers:  utils.NewConcurrentMap[uint64, []*pb.ChannelMember](),
-		channelMessages: utils.NewConcurrentMap[uint64, []*pb.ChannelMessage](),
-		id:              utils.NewConcurrentCounter[uint32](),
-		nameGenerator:   namegenerator.NewGenerator(),
+		sockets:             utils.NewConcurrentMap[int, *rpcConn](),
+		users:               users,
+		flags:               flags,
+		llmTokens:           llmTokens,
+		usage:               usage,
+		plans:               plans,
+		channels:            channels,
+		contacts:            contacts,
+		notifications:       notifications,
+		rooms:               NewRoomStore(),
+		chatParticipants:    utils.NewConcurrentMap[uint64, []int](),
+		bufferCollaborators: utils.NewConcurrentMap[uint64, []*pb.Collaborator](),
+		reconnecting:        utils.NewConcurrentMap[int, *time.Timer](),
+		reconnectTimeout:    RECONNECT_TIMEOUT,
+		id:                  utils.NewConcurrentCounter[uint32](),
 	}
 }
 
@@ -68,12 +131,32 @@ func (pd *ProtoDispatcher) CompressMsg(b []byte) ([]byte, error) {
 	return encoder.EncodeAll(b, make([]byte, 0, len(b))), nil
 }
 
+// decompressMsg decodes the zstd compressed messages of Zed, passing uncompressed
+// messages through.
+func decompressMsg(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, zstdMagic) {
+		return b, nil
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(b, nil)
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
 func (pd *ProtoDispatcher) SendMessage(b []byte) error {
 	bb, err := pd.CompressMsg(b)
 	if err != nil {
 		return err
 	}
-	if err := pd.rpc.sockets.Get(pd.userId).WriteMessage(websocket.BinaryMessage, bb); err != nil {
+	conn := pd.rpc.sockets.Get(pd.userId)
+	if conn == nil {
+		return fmt.Errorf("user %v is not connected", pd.userId)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, bb); err != nil {
 		return err
 	}
 	return nil
@@ -88,6 +171,33 @@ func (pd *ProtoDispatcher) SendProtobuf(protobuf protoreflect.ProtoMessage) erro
 	return pd.SendMessage(b)
 }
 
+// SendError responds to a request with an error, internal unless it is an RpcError.
+func (pd *ProtoDispatcher) SendError(requestId uint32, err error) error {
+	rpcErr := &RpcError{Code: pb.ErrorCode_Internal, Message: err.Error()}
+	errors.As(err, &rpcErr)
+	envelope := pb.Envelope{
+		Id:           pd.NextId(),
+		RespondingTo: &requestId,
+		Payload: &pb.Envelope_Error{
+			Error: &pb.Error{
+				Message: rpcErr.Message,
+				Code:    rpcErr.Code,
+			},
+		},
+	}
+	return pd.SendProtobuf(&envelope)
+}
+
+// SendAck responds to a request that has no response of its own.
+func (pd *ProtoDispatcher) SendAck(requestId uint32) error {
+	envelope := pb.Envelope{
+		Id:           pd.NextId(),
+		RespondingTo: &requestId,
+		Payload:      &pb.Envelope_Ack{Ack: &pb.Ack{}},
+	}
+	return pd.SendProtobuf(&envelope)
+}
+
 func (pd *ProtoDispatcher) SendHello() error {
 	envelope := pb.Envelope{
 		Payload: &pb.Envelope_Hello{
@@ -100,6 +210,522 @@ func (pd *ProtoDispatcher) SendHello() error {
 	return pd.SendProtobuf(&envelope)
 }
 
+// SendContacts sends the user's contacts and the requests to become one.
+func (pd *ProtoDispatcher) SendContacts() error {
+	userId := uint64(pd.userId)
+	update := &pb.UpdateContacts{OutgoingRequests: pd.rpc.contacts.OutgoingRequests(userId)}
+	for _, contactId := range pd.rpc.contacts.Contacts(userId) {
+		update.Contacts = append(update.Contacts, pd.rpc.contact(contactId))
+	}
+	for _, requesterId := range pd.rpc.contacts.IncomingRequests(userId) {
+		update.IncomingRequests = append(update.IncomingRequests, &pb.IncomingContactRequest{RequesterId: requesterId})
+	}
+	envelope := pb.Envelope{
+		Id:      pd.NextId(),
+		Payload: &pb.Envelope_UpdateContacts{UpdateContacts: update},
+	}
+	return pd.SendProtobuf(&envelope)
+}
+
+// SendUserPlan tells Zed which plan the user is on and how much of it was used.
+func (pd *ProtoDispatcher) SendUserPlan(user UserRecord) error {
+	planDefinition := pd.rpc.plans.For(user)
+	plan, err := ParsePlan(planDefinition.ZedPlan)
+	if err != nil {
+		return err
+	}
+	usage, period := pd.rpc.usage.Usage(user.ID)
+	envelope := pb.Envelope{
+		Id: pd.NextId(),
+		Payload: &pb.Envelope_UpdateUserPlan{
+			UpdateUserPlan: &pb.UpdateUserPlan{
+				Plan:  plan.Proto(),
+				Usage: SubscriptionUsageProto(usage, planDefinition.Limits),
+				SubscriptionPeriod: &pb.SubscriptionPeriod{
+					StartedAt: uint64(period.Start.Unix()),
+					EndedAt:   uint64(period.End.Unix()),
+				},
+			},
+		},
+	}
+	return pd.SendProtobuf(&envelope)
+}
+
+// RefreshLlmToken asks the Zed instance of a user, if connected, to fetch a new LLM token,
+// e.g. because the claims of the user changed.
+func (rpc *RpcHandler) RefreshLlmToken(userId uint64) error {
+	if !rpc.sockets.Exists(int(userId)) {
+		return nil
+	}
+	pd := NewProtoDispatcher(rpc, int(userId))
+	envelope := pb.Envelope{
+		Id: pd.NextId(),
+		Payload: &pb.Envelope_RefreshLlmToken{
+			RefreshLlmToken: &pb.RefreshLlmToken{},
+		},
+	}
+	return pd.SendProtobuf(&envelope)
+}
+
+// UserPlanChanged sends the new plan of a user, if connected, and has Zed fetch a new
+// LLM token, as the token carries the plan.
+func (rpc *RpcHandler) UserPlanChanged(user UserRecord) error {
+	if !rpc.sockets.Exists(int(user.ID)) {
+		return nil
+	}
+	if err := NewProtoDispatcher(rpc, int(user.ID)).SendUserPlan(user); err != nil {
+		return err
+	}
+	return rpc.RefreshLlmToken(user.ID)
+}
+
+// UsageChanged sends the usage of a user, if connected, so Zed shows how much of the
+// plan is left.
+func (rpc *RpcHandler) UsageChanged(user UserRecord) error {
+	if !rpc.sockets.Exists(int(user.ID)) {
+		return nil
+	}
+	return NewProtoDispatcher(rpc, int(user.ID)).SendUserPlan(user)
+}
+
+// sendToUsers sends an envelope to the connected ones of userIds.
+func (rpc *RpcHandler) sendToUsers(userIds []int, envelope *pb.Envelope) {
+	for _, userId := range userIds {
+		if !rpc.sockets.Exists(userId) {
+			continue
+		}
+		pd := NewProtoDispatcher(rpc, userId)
+		e := proto.Clone(envelope).(*pb.Envelope)
+		e.Id = pd.NextId()
+		if err := pd.SendProtobuf(e); err != nil {
+			log.Errorf("failed to send to user %v: %v", userId, err)
+		}
+	}
+}
+
+func (rpc *RpcHandler) joinChat(channelId uint64, userId int) {
+	rpc.chatParticipants.Transaction(func(m map[uint64][]int) map[uint64][]int {
+		if !slices.Contains(m[channelId], userId) {
+			m[channelId] = append(m[channelId], userId)
+		}
+		return m
+	})
+}
+
+func (rpc *RpcHandler) leaveChat(channelId uint64, userId int) {
+	rpc.chatParticipants.Transaction(func(m map[uint64][]int) map[uint64][]int {
+		// Copy, readers may hold the current slice.
+		m[channelId] = slices.DeleteFunc(slices.Clone(m[channelId]), func(id int) bool { return id == userId })
+		if len(m[channelId]) == 0 {
+			delete(m, channelId)
+		}
+		return m
+	})
+}
+
+// disconnect forgets the connection of a user, unless the user reconnected already. The
+// user stays in their room until the reconnect timeout, like in Zed's collab server.
+func (rpc *RpcHandler) disconnect(userId int, conn *rpcConn) {
+	reconnected := false
+	rpc.sockets.Transaction(func(m map[int]*rpcConn) map[int]*rpcConn {
+		if m[userId] == conn {
+			delete(m, userId)
+		} else {
+			reconnected = true
+		}
+		return m
+	})
+	if reconnected {
+		return
+	}
+	for _, channelId := range rpc.chatParticipants.Keys() {
+		rpc.leaveChat(channelId, userId)
+	}
+	for _, channelId := range rpc.bufferCollaborators.Keys() {
+		if rpc.leaveBuffer(channelId, userId) {
+			rpc.bufferCollaboratorsChanged(channelId)
+		}
+	}
+	rpc.contactChanged(userId)
+	rpc.reconnecting.Transaction(func(m map[int]*time.Timer) map[int]*time.Timer {
+		if timer := m[userId]; timer != nil {
+			timer.Stop()
+		}
+		var timer *time.Timer
+		timer = time.AfterFunc(rpc.reconnectTimeout, func() {
+			expired := false
+			rpc.reconnecting.Transaction(func(m map[int]*time.Timer) map[int]*time.Timer {
+				if m[userId] == timer {
+					delete(m, userId)
+					expired = true
+				}
+				return m
+			})
+			if expired {
+				rpc.leaveRooms(userId)
+			}
+		})
+		m[userId] = timer
+		return m
+	})
+}
+
+// reconnected keeps a user who reconnected in time in their room.
+func (rpc *RpcHandler) reconnected(userId int) {
+	if timer := rpc.reconnecting.Pop(userId); timer != nil {
+		timer.Stop()
+	}
+}
+
+// leaveRooms takes a user who is gone out of their room and declines the calls to them.
+func (rpc *RpcHandler) leaveRooms(userId int) {
+	rpc.leaveRoom(userId)
+	for _, roomId := range rpc.rooms.Calls(uint64(userId)) {
+		if room, err := rpc.rooms.DeclineCall(roomId, uint64(userId)); err == nil {
+			rpc.roomUpdated(room)
+		}
+	}
+	rpc.contactChanged(userId)
+}
+
+// leaveRoom removes a user from the room they are in, canceling the calls they made,
+// and tells the others in the room and the channel.
+func (rpc *RpcHandler) leaveRoom(userId int) {
+	left, ok := rpc.rooms.Leave(uint64(userId))
+	if !ok {
+		return
+	}
+	for _, calledId := range left.Canceled {
+		rpc.sendToUsers([]int{int(calledId)}, &pb.Envelope{
+			Payload: &pb.Envelope_CallCanceled{CallCanceled: &pb.CallCanceled{RoomId: left.Room.Id}},
+		})
+		rpc.contactChanged(int(calledId))
+	}
+	rpc.roomUpdated(left.Room)
+	if left.ChannelId != 0 {
+		rpc.channelParticipantsChanged(left.ChannelId)
+	}
+	rpc.contactChanged(userId)
+}
+
+// closeChannelRoom removes everyone from the room of a deleted channel, canceling the
+// calls to it.
+func (rpc *RpcHandler) closeChannelRoom(channelId uint64) {
+	room, ok := rpc.rooms.CloseChannel(channelId)
+	if !ok {
+		return
+	}
+	for _, p := range room.PendingParticipants {
+		rpc.sendToUsers([]int{int(p.UserId)}, &pb.Envelope{
+			Payload: &pb.Envelope_CallCanceled{CallCanceled: &pb.CallCanceled{RoomId: room.Id}},
+		})
+		rpc.contactChanged(int(p.UserId))
+	}
+	participants := room.Participants
+	room.Participants = nil
+	room.PendingParticipants = nil
+	for _, p := range participants {
+		rpc.sendToUsers([]int{int(p.UserId)}, &pb.Envelope{
+			Payload: &pb.Envelope_RoomUpdated{RoomUpdated: &pb.RoomUpdated{Room: room}},
+		})
+		rpc.contactChanged(int(p.UserId))
+	}
+}
+
+// roomRoleChanged updates the role of a user in the room of a channel they are in after
+// their role in a channel changed or they were removed from one, which may be inherited
+// by the channel of the room. Users that lost access to the channel leave its room.
+func (rpc *RpcHandler) roomRoleChanged(userId int) {
+	room, channelId, ok := rpc.rooms.RoomOf(uint64(userId))
+	if !ok || channelId == 0 {
+		return
+	}
+	role, err := rpc.channels.RequireRole(uint64(userId), channelId)
+	if err != nil {
+		rpc.leaveRoom(userId)
+		return
+	}
+	i := slices.IndexFunc(room.Participants, func(p *pb.Participant) bool { return p.UserId == uint64(userId) })
+	if room.Participants[i].Role == role {
+		return
+	}
+	room, err = rpc.rooms.SetRole(room.Id, uint64(userId), role)
+	if err != nil {
+		// The user left the room meanwhile.
+		return
+	}
+	rpc.roomUpdated(room)
+	if rpc.liveKit != nil {
+		if err := rpc.liveKit.UpdatePermissions(room.LivekitRoom, uint64(userId), liveKitCanPublish(role)); err != nil {
+			log.Errorf("failed to update LiveKit permissions of user %v: %v", userId, err)
+		}
+	}
+}
+
+// liveKitConnectionInfo returns how a participant of a room connects to its audio and
+// screen sharing. Without LiveKit, or if the token can't be issued, Zed joins the room
+// without them.
+func (rpc *RpcHandler) liveKitConnectionInfo(room *pb.Room, userId int) *pb.LiveKitConnectionInfo {
+	if rpc.liveKit == nil {
+		return nil
+	}
+	info, err := rpc.liveKit.ConnectionInfo(room, uint64(userId))
+	if err != nil {
+		log.Errorf("failed to issue LiveKit token for user %v: %v", userId, err)
+		return nil
+	}
+	return info
+}
+
+// roomUpdated sends a room to its participants.
+func (rpc *RpcHandler) roomUpdated(room *pb.Room) {
+	userIds := []int{}
+	for _, p := range room.Participants {
+		userIds = append(userIds, int(p.UserId))
+	}
+	rpc.sendToUsers(userIds, &pb.Envelope{
+		Payload: &pb.Envelope_RoomUpdated{RoomUpdated: &pb.RoomUpdated{Room: room}},
+	})
+}
+
+// channelParticipantsChanged sends who is in the room of a channel to the users that
+// see the channel.
+func (rpc *RpcHandler) channelParticipantsChanged(channelId uint64) {
+	participants := rpc.rooms.ChannelParticipants([]uint64{channelId})
+	if len(participants) == 0 {
+		participants = []*pb.ChannelParticipants{{ChannelId: channelId}}
+	}
+	userIds := []int{}
+	for _, userId := range rpc.channels.Audience(channelId) {
+		userIds = append(userIds, int(userId))
+	}
+	rpc.sendToUsers(userIds, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateChannels{
+			UpdateChannels: &pb.UpdateChannels{ChannelParticipants: participants},
+		},
+	})
+}
+
+// joinChannelRoom moves a user to the room of a channel, with their role in it.
+func (rpc *RpcHandler) joinChannelRoom(pd *ProtoDispatcher, requestId uint32, channelId uint64) error {
+	role, err := rpc.channels.RequireRole(uint64(pd.userId), channelId)
+	if err != nil {
+		return err
+	}
+	rpc.leaveRoom(pd.userId)
+	room, err := rpc.rooms.JoinChannel(channelId, uint64(pd.userId), role)
+	if err != nil {
+		return err
+	}
+	resp := pb.Envelope{
+		Id:           pd.NextId(),
+		RespondingTo: &requestId,
+		Payload: &pb.Envelope_JoinRoomResponse{
+			JoinRoomResponse: &pb.JoinRoomResponse{
+				Room:                  room,
+				ChannelId:             &channelId,
+				LiveKitConnectionInfo: rpc.liveKitConnectionInfo(room, pd.userId),
+			},
+		},
+	}
+	if err := pd.SendProtobuf(&resp); err != nil {
+		return err
+	}
+	rpc.roomUpdated(room)
+	rpc.channelParticipantsChanged(channelId)
+	rpc.contactChanged(pd.userId)
+	return nil
+}
+
+// channelBufferFirstReplicaId is the first replica ID of collaborators, Zed reserves
+// those below it, e.g. for the local replica.
+const channelBufferFirstReplicaId = 8
+
+// joinBuffer adds a user to the collaborators of the notes of a channel, keeping the
+// replica of a user that joined already. It returns the user as a collaborator.
+func (rpc *RpcHandler) joinBuffer(channelId uint64, userId int) *pb.Collaborator {
+	var collaborator *pb.Collaborator
+	rpc.bufferCollaborators.Transaction(func(m map[uint64][]*pb.Collaborator) map[uint64][]*pb.Collaborator {
+		collaborators := m[channelId]
+		if i := slices.IndexFunc(collaborators, func(c *pb.Collaborator) bool { return c.UserId == uint64(userId) }); i >= 0 {
+			collaborator = collaborators[i]
+			return m
+		}
+		replicaId := uint32(channelBufferFirstReplicaId)
+		for slices.ContainsFunc(collaborators, func(c *pb.Collaborator) bool { return c.ReplicaId == replicaId }) {
+			replicaId++
+		}
+		collaborator = &pb.Collaborator{
+			PeerId:    &pb.PeerId{Id: uint32(userId)},
+			ReplicaId: replicaId,
+			UserId:    uint64(userId),
+		}
+		// Copy, readers may hold the current slice.
+		m[channelId] = append(slices.Clone(collaborators), collaborator)
+		return m
+	})
+	return collaborator
+}
+
+// leaveBuffer removes a user from the collaborators of the notes of a channel,
+// returning whether it was one. The last one to leave snapshots the notes, before
+// anyone can join again.
+func (rpc *RpcHandler) leaveBuffer(channelId uint64, userId int) bool {
+	left := false
+	rpc.bufferCollaborators.Transaction(func(m map[uint64][]*pb.Collaborator) map[uint64][]*pb.Collaborator {
+		collaborators := slices.DeleteFunc(slices.Clone(m[channelId]), func(c *pb.Collaborator) bool { return c.UserId == uint64(userId) })
+		left = len(collaborators) < len(m[channelId])
+		if len(collaborators) == 0 {
+			delete(m, channelId)
+			if err := rpc.channels.SnapshotBuffer(channelId); err != nil {
+				log.Errorf("failed to snapshot the notes of channel %v: %v", channelId, err)
+			}
+		} else {
+			m[channelId] = collaborators
+		}
+		return m
+	})
+	return left
+}
+
+// bufferCollaboratorIds returns the users collaborating on the notes of a channel.
+func (rpc *RpcHandler) bufferCollaboratorIds(channelId uint64) []int {
+	userIds := []int{}
+	for _, c := range rpc.bufferCollaborators.Get(channelId) {
+		userIds = append(userIds, int(c.UserId))
+	}
+	return userIds
+}
+
+// bufferCollaboratorsChanged sends the collaborators of the notes of a channel to them.
+func (rpc *RpcHandler) bufferCollaboratorsChanged(channelId uint64) {
+	rpc.sendToUsers(rpc.bufferCollaboratorIds(channelId), &pb.Envelope{
+		Payload: &pb.Envelope_UpdateChannelBufferCollaborators{
+			UpdateChannelBufferCollaborators: &pb.UpdateChannelBufferCollaborators{
+				ChannelId:     channelId,
+				Collaborators: rpc.bufferCollaborators.Get(channelId),
+			},
+		},
+	})
+}
+
+// contact returns a user as a contact, with whether the user is online and in a call.
+func (rpc *RpcHandler) contact(userId uint64) *pb.Contact {
+	return &pb.Contact{UserId: userId, Online: rpc.sockets.Exists(int(userId)), Busy: rpc.rooms.Busy(userId)}
+}
+
+// contactChanged sends the status of a user to the contacts of the user.
+func (rpc *RpcHandler) contactChanged(userId int) {
+	userIds := []int{}
+	for _, contactId := range rpc.contacts.Contacts(uint64(userId)) {
+		userIds = append(userIds, int(contactId))
+	}
+	rpc.sendToUsers(userIds, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateContacts{
+			UpdateContacts: &pb.UpdateContacts{Contacts: []*pb.Contact{rpc.contact(uint64(userId))}},
+		},
+	})
+}
+
+// contactsAdded sends two users that became contacts to each other, and drops the
+// request between them.
+func (rpc *RpcHandler) contactsAdded(requesterId, responderId uint64) {
+	rpc.respondToNotification(responderId, NotificationContactRequest, requesterId, true)
+	rpc.notify(requesterId, NotificationContactRequestAccepted, responderId, struct{}{})
+	rpc.sendToUsers([]int{int(requesterId)}, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateContacts{
+			UpdateContacts: &pb.UpdateContacts{
+				Contacts:               []*pb.Contact{rpc.contact(responderId)},
+				RemoveOutgoingRequests: []uint64{responderId},
+			},
+		},
+	})
+	rpc.sendToUsers([]int{int(responderId)}, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateContacts{
+			UpdateContacts: &pb.UpdateContacts{
+				Contacts:               []*pb.Contact{rpc.contact(requesterId)},
+				RemoveIncomingRequests: []uint64{requesterId},
+			},
+		},
+	})
+}
+
+// contactsRemoved drops the contact, or the request to become one, between two users
+// from both of them.
+func (rpc *RpcHandler) contactsRemoved(requesterId, responderId uint64) {
+	rpc.retractNotifications(NotificationContactRequest, requesterId, responderId)
+	rpc.sendToUsers([]int{int(requesterId)}, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateContacts{
+			UpdateContacts: &pb.UpdateContacts{
+				RemoveContacts:         []uint64{responderId},
+				RemoveOutgoingRequests: []uint64{responderId},
+			},
+		},
+	})
+	rpc.sendToUsers([]int{int(responderId)}, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateContacts{
+			UpdateContacts: &pb.UpdateContacts{
+				RemoveContacts:         []uint64{requesterId},
+				RemoveIncomingRequests: []uint64{requesterId},
+			},
+		},
+	})
+}
+
+// notify adds a notification for a user and sends it to them. Failing to notify doesn't
+// fail what the notification is about, so errors are only logged.
+func (rpc *RpcHandler) notify(userId uint64, kind string, entityId uint64, content any) {
+	notification, err := rpc.notifications.Add(userId, kind, entityId, content)
+	if err != nil {
+		log.Errorf("failed to notify user %v: %v", userId, err)
+		return
+	}
+	if notification == nil {
+		return
+	}
+	rpc.sendToUsers([]int{int(userId)}, &pb.Envelope{
+		Payload: &pb.Envelope_AddNotification{
+			AddNotification: &pb.AddNotification{Notification: notification},
+		},
+	})
+}
+
+// respondToNotification records the answer of a user to a notification, e.g. an invite,
+// and sends the answered notification to them.
+func (rpc *RpcHandler) respondToNotification(userId uint64, kind string, entityId uint64, accept bool) {
+	notification, err := rpc.notifications.Respond(userId, kind, entityId, accept)
+	if err != nil {
+		log.Errorf("failed to update notification of user %v: %v", userId, err)
+		return
+	}
+	if notification == nil {
+		return
+	}
+	rpc.sendToUsers([]int{int(userId)}, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateNotification{
+			UpdateNotification: &pb.UpdateNotification{Notification: notification},
+		},
+	})
+}
+
+// retractNotifications deletes the unanswered notifications about an entity that went
+// away, of all users or only of userIds, and tells the users.
+func (rpc *RpcHandler) retractNotifications(kind string, entityId uint64, userIds ...uint64) {
+	retracted, err := rpc.notifications.Retract(kind, entityId, userIds...)
+	if err != nil {
+		log.Errorf("failed to retract notifications: %v", err)
+	}
+	for userId, notificationIds := range retracted {
+		for _, notificationId := range notificationIds {
+			rpc.sendToUsers([]int{int(userId)}, &pb.Envelope{
+				Payload: &pb.Envelope_DeleteNotification{
+					DeleteNotification: &pb.DeleteNotification{NotificationId: notificationId},
+				},
+			})
+		}
+	}
+}
+
 func (rpc *RpcHandler) NextId() uint32 {
 	return rpc.id.Increment().Value()
 }
@@ -108,20 +734,28 @@ func (pd *ProtoDispatcher) NextId() uint32 {
 	return pd.rpc.NextId()
 }
 
-func (rpc *RpcHandler) handleMessages(pd *ProtoDispatcher) {
+func (rpc *RpcHandler) handleMessages(pd *ProtoDispatcher, conn *rpcConn) {
+	defer rpc.disconnect(pd.userId, conn)
 	for {
-		_, message, err := rpc.sockets.Get(pd.userId).ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Errorf("failed to receive message: %v", err)
 			return
 		}
-		rpc.handleMessage(pd, message)
+		if err := rpc.handleMessage(pd, message); err != nil {
+			log.Errorf("[user: %v] failed to handle message: %v", pd.userId, err)
+		}
 	}
 }
 
 func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error {
+	message, err := decompressMsg(message)
+	if err != nil {
+		log.Errorf("failed to decompress message: %v", err)
+		return err
+	}
 	var envelope pb.Envelope
-	err := proto.Unmarshal(message, &envelope)
+	err = proto.Unmarshal(message, &envelope)
 	if err != nil {
 		log.Errorf("failed to unmarshal message: %v", err)
 		return err
@@ -129,6 +763,17 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 
 	log.Debugf("[user: %v] incoming %#v", pd.userId, envelope.Payload)
 
+	if err := rpc.dispatch(pd, &envelope, message); err != nil {
+		if err := pd.SendError(envelope.Id, err); err != nil {
+			log.Errorf("[user: %v] failed to send error: %v", pd.userId, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// dispatch handles an envelope, its errors are sent to Zed as the response.
+func (rpc *RpcHandler) dispatch(pd *ProtoDispatcher, envelope *pb.Envelope, message []byte) error {
 	switch msg := envelope.Payload.(type) {
 	case *pb.Envelope_Hello:
 		resp := pb.Envelope{
@@ -136,19 +781,38 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_UpdateChannels{
 				UpdateChannels: &pb.UpdateChannels{
-					Channels: rpc.channels.Values(),
+					Channels:                    rpc.channels.VisibleChannels(uint64(pd.userId)),
+					ChannelInvitations:          rpc.channels.Invitations(uint64(pd.userId)),
+					LatestChannelMessageIds:     rpc.channels.LatestMessageIds(uint64(pd.userId)),
+					LatestChannelBufferVersions: rpc.channels.LatestBufferVersions(uint64(pd.userId)),
+					ChannelParticipants:         rpc.rooms.ChannelParticipants(rpc.channels.VisibleChannelIds(uint64(pd.userId))),
 				},
 			},
 		}
 		if err := pd.SendProtobuf(&resp); err != nil {
 			return err
 		}
+		observed := pb.Envelope{
+			Id: pd.NextId(),
+			Payload: &pb.Envelope_UpdateUserChannels{
+				UpdateUserChannels: &pb.UpdateUserChannels{
+					ObservedChannelMessageId:     rpc.channels.ObservedMessageIds(uint64(pd.userId)),
+					ObservedChannelBufferVersion: rpc.channels.ObservedBufferVersions(uint64(pd.userId)),
+					ChannelMemberships:           rpc.channels.Memberships(uint64(pd.userId)),
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&observed); err != nil {
+			return err
+		}
 
 	case *pb.Envelope_GetUsers:
 		gu := envelope.Payload.(*pb.Envelope_GetUsers)
 		ru := []*pb.User{}
 		for _, uid := range gu.GetUsers.UserIds {
-			ru = append(ru, rpc.users.Get(uid))
+			if u, ok := rpc.users.Get(uid); ok {
+				ru = append(ru, u.Proto())
+			}
 		}
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
@@ -164,15 +828,23 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 		}
 
 	case *pb.Envelope_GetPrivateUserInfo:
+		user, ok := rpc.users.Get(uint64(pd.userId))
+		if !ok {
+			return fmt.Errorf("unknown user %v", pd.userId)
+		}
+		info := &pb.GetPrivateUserInfoResponse{
+			MetricsId: user.MetricsID,
+			Staff:     user.Staff,
+			Flags:     rpc.flags.FlagsFor(user),
+		}
+		if user.AcceptedTosAt != nil {
+			info.AcceptedTosAt = proto.Uint64(uint64(user.AcceptedTosAt.Unix()))
+		}
 		resp := pb.Envelope{
+			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_GetPrivateUserInfoResponse{
-				GetPrivateUserInfoResponse: &pb.GetPrivateUserInfoResponse{
-					MetricsId:     "123",
-					Staff:         true,
-					Flags:         []string{"zed-pro", "notebooks", "debugger", "llm-closed-beta", "thread-auto-capture"},
-					AcceptedTosAt: proto.Uint64(1),
-				},
+				GetPrivateUserInfoResponse: info,
 			},
 		}
 		if err := pd.SendProtobuf(&resp); err != nil {
@@ -180,17 +852,33 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 		}
 
 	case *pb.Envelope_GetChannelMessagesById:
-		ids := msg.GetChannelMessagesById.MessageIds
-		msgs := []*pb.ChannelMessage{}
-		for _, id := range ids {
-			msgs = append(msgs, rpc.channelMessages.Get(id)...)
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_GetChannelMessagesResponse{
+				GetChannelMessagesResponse: &pb.GetChannelMessagesResponse{
+					Messages: rpc.channels.MessagesById(uint64(pd.userId), msg.GetChannelMessagesById.MessageIds),
+					Done:     true,
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_GetChannelMessages:
+		gcm := msg.GetChannelMessages
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), gcm.ChannelId); err != nil {
+			return err
 		}
+		messages, done := rpc.channels.MessagesBefore(gcm.ChannelId, gcm.BeforeMessageId, channelMessagesPerPage)
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_GetChannelMessagesResponse{
 				GetChannelMessagesResponse: &pb.GetChannelMessagesResponse{
-					Messages: msgs,
+					Messages: messages,
+					Done:     done,
 				},
 			},
 		}
@@ -200,19 +888,23 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 
 	case *pb.Envelope_SendChannelMessage:
 		scm := msg.SendChannelMessage
-		channelMsg := &pb.ChannelMessage{
-			Id:               uint64(time.Now().UnixNano()),
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), scm.ChannelId, channelChatRoles...); err != nil {
+			return err
+		}
+		channelMsg, err := rpc.channels.AddMessage(scm.ChannelId, &pb.ChannelMessage{
 			Body:             scm.Body,
 			Timestamp:        uint64(time.Now().Unix()),
+			SenderId:         uint64(pd.userId),
 			Nonce:            scm.Nonce,
 			Mentions:         scm.Mentions,
 			ReplyToMessageId: scm.ReplyToMessageId,
-		}
-
-		rpc.channelMessages.Transaction(func(m map[uint64][]*pb.ChannelMessage) map[uint64][]*pb.ChannelMessage {
-			m[scm.ChannelId] = append(m[scm.ChannelId], channelMsg)
-			return m
 		})
+		if err != nil {
+			return err
+		}
+		if err := rpc.channels.ObserveMessage(uint64(pd.userId), scm.ChannelId, channelMsg.Id); err != nil {
+			return err
+		}
 
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
@@ -226,34 +918,168 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 		if err := pd.SendProtobuf(&resp); err != nil {
 			return err
 		}
+		rpc.broadcastChannelMessage(scm.ChannelId, channelMsg)
+		rpc.notifyMentions(scm.ChannelId, channelMsg)
 
-	case *pb.Envelope_AckChannelMessage:
-		log.Debug("Envelope_AckChannelMessage")
-
-	case *pb.Envelope_LeaveChannelChat:
-		log.Debug("Envelope_LeaveChannelChat")
-
-	case *pb.Envelope_JoinChannelBuffer:
-		log.Debug("Envelope_JoinChannelBuffer")
-		resp := pb.Envelope{
+	case *pb.Envelope_UpdateChannelMessage:
+		ucm := msg.UpdateChannelMessage
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), ucm.ChannelId, channelChatRoles...); err != nil {
+			return err
+		}
+		message, err := rpc.channels.UpdateMessage(uint64(pd.userId), ucm.ChannelId, ucm.MessageId, ucm.Body, ucm.Mentions)
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.sendToUsers(rpc.chatParticipants.Get(ucm.ChannelId), &pb.Envelope{
+			Payload: &pb.Envelope_ChannelMessageUpdate{
+				ChannelMessageUpdate: &pb.ChannelMessageUpdate{
+					ChannelId: ucm.ChannelId,
+					Message:   message,
+				},
+			},
+		})
+		rpc.notifyMentions(ucm.ChannelId, message)
+
+	case *pb.Envelope_RemoveChannelMessage:
+		rcm := msg.RemoveChannelMessage
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), rcm.ChannelId); err != nil {
+			return err
+		}
+		if err := rpc.channels.RemoveMessage(uint64(pd.userId), rcm.ChannelId, rcm.MessageId); err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.sendToUsers(rpc.chatParticipants.Get(rcm.ChannelId), &pb.Envelope{
+			Payload: &pb.Envelope_RemoveChannelMessage{RemoveChannelMessage: rcm},
+		})
+		rpc.retractNotifications(NotificationChannelMessageMention, rcm.MessageId)
+
+	case *pb.Envelope_AckChannelMessage:
+		ack := msg.AckChannelMessage
+		if err := rpc.channels.ObserveMessage(uint64(pd.userId), ack.ChannelId, ack.MessageId); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_LeaveChannelChat:
+		rpc.leaveChat(msg.LeaveChannelChat.ChannelId, pd.userId)
+
+	case *pb.Envelope_JoinChannelBuffer:
+		channelId := msg.JoinChannelBuffer.ChannelId
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), channelId); err != nil {
+			return err
+		}
+		collaborator := rpc.joinBuffer(channelId, pd.userId)
+		baseText, epoch := rpc.channels.BufferSnapshot(channelId)
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_JoinChannelBufferResponse{
+				JoinChannelBufferResponse: &pb.JoinChannelBufferResponse{
+					BufferId:      channelId,
+					ReplicaId:     collaborator.ReplicaId,
+					BaseText:      baseText,
+					Operations:    rpc.channels.BufferOperations(channelId, nil),
+					Collaborators: rpc.bufferCollaborators.Get(channelId),
+					Epoch:         epoch,
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+		rpc.bufferCollaboratorsChanged(channelId)
+
+	case *pb.Envelope_UpdateChannelBuffer:
+		ucb := msg.UpdateChannelBuffer
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), ucb.ChannelId, channelEditRoles...); err != nil {
+			return err
+		}
+		collaborators := rpc.bufferCollaboratorIds(ucb.ChannelId)
+		if !slices.Contains(collaborators, pd.userId) {
+			return fmt.Errorf("user %v didn't join the notes of %v", pd.userId, ucb.ChannelId)
+		}
+		changed, err := rpc.channels.AddBufferOperations(ucb.ChannelId, ucb.Operations)
+		if err != nil {
+			return err
+		}
+		rpc.sendToUsers(slices.DeleteFunc(collaborators, func(id int) bool { return id == pd.userId }), &pb.Envelope{
+			Payload: &pb.Envelope_UpdateChannelBuffer{UpdateChannelBuffer: ucb},
+		})
+		if changed {
+			version := rpc.channels.BufferVersion(ucb.ChannelId)
+			if err := rpc.channels.ObserveBuffer(uint64(pd.userId), ucb.ChannelId, version); err != nil {
+				return err
+			}
+			rpc.broadcastBufferVersion(ucb.ChannelId, version)
+		}
+
+	case *pb.Envelope_AckBufferOperation:
+		abo := msg.AckBufferOperation
+		if err := rpc.channels.ObserveBuffer(uint64(pd.userId), abo.BufferId, abo.Version); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_LeaveChannelBuffer:
+		channelId := msg.LeaveChannelBuffer.ChannelId
+		left := rpc.leaveBuffer(channelId, pd.userId)
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		if left {
+			rpc.bufferCollaboratorsChanged(channelId)
+		}
+
+	case *pb.Envelope_RejoinChannelBuffers:
+		rejoined := []*pb.RejoinedChannelBuffer{}
+		for _, buffer := range msg.RejoinChannelBuffers.Buffers {
+			if _, err := rpc.channels.RequireRole(uint64(pd.userId), buffer.ChannelId); err != nil {
+				continue
+			}
+			// The notes were snapshotted since, Zed has to join them again.
+			if _, epoch := rpc.channels.BufferSnapshot(buffer.ChannelId); epoch != buffer.Epoch {
+				continue
+			}
+			rpc.joinBuffer(buffer.ChannelId, pd.userId)
+			rejoined = append(rejoined, &pb.RejoinedChannelBuffer{
+				ChannelId:     buffer.ChannelId,
+				Version:       rpc.channels.BufferVersion(buffer.ChannelId),
+				Operations:    rpc.channels.BufferOperations(buffer.ChannelId, buffer.Version),
+				Collaborators: rpc.bufferCollaborators.Get(buffer.ChannelId),
+			})
+		}
+		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
-			Payload: &pb.Envelope_JoinChannelBuffer{
-				JoinChannelBuffer: &pb.JoinChannelBuffer{
-					ChannelId: msg.JoinChannelBuffer.ChannelId,
+			Payload: &pb.Envelope_RejoinChannelBuffersResponse{
+				RejoinChannelBuffersResponse: &pb.RejoinChannelBuffersResponse{
+					Buffers: rejoined,
 				},
 			},
 		}
 		if err := pd.SendProtobuf(&resp); err != nil {
 			return err
 		}
+		for _, buffer := range rejoined {
+			rpc.bufferCollaboratorsChanged(buffer.ChannelId)
+		}
 
 	case *pb.Envelope_AcceptTermsOfService:
+		user, err := rpc.users.AcceptTermsOfService(uint64(pd.userId))
+		if err != nil {
+			return err
+		}
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_AcceptTermsOfServiceResponse{
-				AcceptTermsOfServiceResponse: &pb.AcceptTermsOfServiceResponse{},
+				AcceptTermsOfServiceResponse: &pb.AcceptTermsOfServiceResponse{
+					AcceptedTosAt: uint64(user.AcceptedTosAt.Unix()),
+				},
 			},
 		}
 		if err := pd.SendProtobuf(&resp); err != nil {
@@ -261,10 +1087,45 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 		}
 
 	case *pb.Envelope_GetNotifications:
-		log.Debug("Envelope_GetNotifications")
+		notifications, done := rpc.notifications.Page(uint64(pd.userId), msg.GetNotifications.GetBeforeId(), notificationsPerPage)
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_GetNotificationsResponse{
+				GetNotificationsResponse: &pb.GetNotificationsResponse{
+					Notifications: notifications,
+					Done:          done,
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_MarkNotificationRead:
+		if _, err := rpc.notifications.MarkRead(uint64(pd.userId), msg.MarkNotificationRead.NotificationId); err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_DeleteNotification:
+		if err := rpc.notifications.Delete(uint64(pd.userId), msg.DeleteNotification.NotificationId); err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
 
 	case *pb.Envelope_FuzzySearchUsers:
-		ru := rpc.users.Values()
+		query := strings.ToLower(msg.FuzzySearchUsers.Query)
+		ru := []*pb.User{}
+		for _, u := range rpc.users.Users() {
+			if strings.Contains(strings.ToLower(u.Login), query) || strings.Contains(strings.ToLower(u.Name), query) {
+				ru = append(ru, u.Proto())
+			}
+		}
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
@@ -279,12 +1140,20 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 		}
 
 	case *pb.Envelope_GetLlmToken:
+		user, ok := rpc.users.Get(uint64(pd.userId))
+		if !ok {
+			return fmt.Errorf("unknown user %v", pd.userId)
+		}
+		token, err := rpc.llmTokens.Issue(user)
+		if err != nil {
+			return err
+		}
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_GetLlmTokenResponse{
 				GetLlmTokenResponse: &pb.GetLlmTokenResponse{
-					Token: "abc123",
+					Token: token,
 				},
 			},
 		}
@@ -297,24 +1166,45 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 
 	case *pb.Envelope_CreateChannel:
 		ccr := msg.CreateChannel
-		channel := &pb.Channel{
-			Id:         *proto.Uint64(utils.StringToUInt64Hash(ccr.Name)),
-			Name:       ccr.Name,
-			Visibility: pb.ChannelVisibility_Public,
-		}
-
-		rpc.channels.Transaction(func(m map[uint64]*pb.Channel) map[uint64]*pb.Channel {
-			if _, ok := m[channel.Id]; !ok {
-				m[channel.Id] = channel
-			}
-			return m
+		var channel *pb.Channel
+		err := rpc.changeChannels(func() (changed []*pb.Channel, err error) {
+			// New channels are sent to the users that see them anyway.
+			channel, err = rpc.channels.CreateChannel(ccr.Name, ccr.ParentId, uint64(pd.userId))
+			return nil, err
 		})
+		if err != nil {
+			return err
+		}
 
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_CreateChannelResponse{
 				CreateChannelResponse: &pb.CreateChannelResponse{
+					Channel:  channel,
+					ParentId: ccr.ParentId,
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_RenameChannel:
+		rc := msg.RenameChannel
+		var channel *pb.Channel
+		err := rpc.changeChannels(func() (changed []*pb.Channel, err error) {
+			channel, err = rpc.channels.RenameChannel(uint64(pd.userId), rc.ChannelId, rc.Name)
+			return []*pb.Channel{channel}, err
+		})
+		if err != nil {
+			return err
+		}
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_RenameChannelResponse{
+				RenameChannelResponse: &pb.RenameChannelResponse{
 					Channel: channel,
 				},
 			},
@@ -323,14 +1213,79 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 			return err
 		}
 
+	case *pb.Envelope_MoveChannel:
+		mc := msg.MoveChannel
+		err := rpc.changeChannels(func() ([]*pb.Channel, error) {
+			return rpc.channels.MoveChannel(uint64(pd.userId), mc.ChannelId, mc.To)
+		})
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_ReorderChannel:
+		rc := msg.ReorderChannel
+		err := rpc.changeChannels(func() ([]*pb.Channel, error) {
+			return rpc.channels.ReorderChannel(uint64(pd.userId), rc.ChannelId, rc.Direction)
+		})
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_SetChannelVisibility:
+		scv := msg.SetChannelVisibility
+		err := rpc.changeChannels(func() ([]*pb.Channel, error) {
+			channel, err := rpc.channels.SetChannelVisibility(uint64(pd.userId), scv.ChannelId, scv.Visibility)
+			return []*pb.Channel{channel}, err
+		})
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_DeleteChannel:
+		var deleted []uint64
+		err := rpc.changeChannels(func() ([]*pb.Channel, error) {
+			var err error
+			deleted, err = rpc.channels.DeleteChannel(uint64(pd.userId), msg.DeleteChannel.ChannelId)
+			// The rooms are closed before the users that don't see the channels anymore
+			// would leave them one by one.
+			for _, channelId := range deleted {
+				rpc.closeChannelRoom(channelId)
+			}
+			return nil, err
+		})
+		if err != nil {
+			return err
+		}
+		for _, channelId := range deleted {
+			rpc.retractNotifications(NotificationChannelInvitation, channelId)
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+
 	case *pb.Envelope_JoinChannelChat:
 		jcc := msg.JoinChannelChat
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), jcc.ChannelId); err != nil {
+			return err
+		}
+		rpc.joinChat(jcc.ChannelId, pd.userId)
+		messages, done := rpc.channels.MessagesBefore(jcc.ChannelId, 0, channelMessagesPerPage)
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_JoinChannelChatResponse{
 				JoinChannelChatResponse: &pb.JoinChannelChatResponse{
-					Messages: rpc.channelMessages.Get(jcc.ChannelId),
+					Messages: messages,
+					Done:     done,
 				},
 			},
 		}
@@ -340,12 +1295,30 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 
 	case *pb.Envelope_GetChannelMembers:
 		gcm := msg.GetChannelMembers
+		if _, err := rpc.channels.RequireRole(uint64(pd.userId), gcm.ChannelId); err != nil {
+			return err
+		}
+		query := strings.ToLower(gcm.Query)
+		members := []*pb.ChannelMember{}
+		users := []*pb.User{}
+		for _, m := range rpc.channels.AllMembers(gcm.ChannelId) {
+			if gcm.Limit > 0 && uint64(len(members)) >= gcm.Limit {
+				break
+			}
+			u, ok := rpc.users.Get(m.UserId)
+			if !ok || !strings.Contains(strings.ToLower(u.Login), query) && !strings.Contains(strings.ToLower(u.Name), query) {
+				continue
+			}
+			members = append(members, m)
+			users = append(users, u.Proto())
+		}
 		resp := pb.Envelope{
 			Id:           pd.NextId(),
 			RespondingTo: &envelope.Id,
 			Payload: &pb.Envelope_GetChannelMembersResponse{
 				GetChannelMembersResponse: &pb.GetChannelMembersResponse{
-					Members: rpc.channelMembers.Get(gcm.ChannelId),
+					Members: members,
+					Users:   users,
 				},
 			},
 		}
@@ -355,28 +1328,399 @@ func (rpc *RpcHandler) handleMessage(pd *ProtoDispatcher, message []byte) error
 
 	case *pb.Envelope_InviteChannelMember:
 		req := msg.InviteChannelMember
-		rpc.channelMembers.Transaction(func(m map[uint64][]*pb.ChannelMember) map[uint64][]*pb.ChannelMember {
-			m[req.UserId] = append(m[req.UserId], &pb.ChannelMember{UserId: req.UserId, Kind: pb.ChannelMember_Member, Role: pb.ChannelRole_Admin})
-			return m
+		channel, err := rpc.channels.InviteMember(uint64(pd.userId), req.ChannelId, req.UserId, req.Role)
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.sendToUsers([]int{int(req.UserId)}, &pb.Envelope{
+			Payload: &pb.Envelope_UpdateChannels{
+				UpdateChannels: &pb.UpdateChannels{ChannelInvitations: []*pb.Channel{channel}},
+			},
+		})
+		rpc.notify(req.UserId, NotificationChannelInvitation, channel.Id, channelInvitationContent{
+			ChannelName: channel.Name,
+			InviterId:   uint64(pd.userId),
+		})
+
+	case *pb.Envelope_RespondToChannelInvite:
+		req := msg.RespondToChannelInvite
+		err := rpc.changeChannels(func() ([]*pb.Channel, error) {
+			return nil, rpc.channels.RespondToInvite(uint64(pd.userId), req.ChannelId, req.Accept)
+		})
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.membershipsChanged(pd.userId, req.ChannelId)
+		rpc.respondToNotification(uint64(pd.userId), NotificationChannelInvitation, req.ChannelId, req.Accept)
+
+	case *pb.Envelope_RemoveChannelMember:
+		req := msg.RemoveChannelMember
+		err := rpc.changeChannels(func() ([]*pb.Channel, error) {
+			return nil, rpc.channels.RemoveMember(uint64(pd.userId), req.ChannelId, req.UserId)
 		})
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.membershipsChanged(int(req.UserId), req.ChannelId)
+		rpc.roomRoleChanged(int(req.UserId))
+		// Removing an invitee revokes the invite.
+		rpc.retractNotifications(NotificationChannelInvitation, req.ChannelId, req.UserId)
+
+	case *pb.Envelope_SetChannelMemberRole:
+		req := msg.SetChannelMemberRole
+		var member *pb.ChannelMember
+		err := rpc.changeChannels(func() (changed []*pb.Channel, err error) {
+			member, err = rpc.channels.SetMemberRole(uint64(pd.userId), req.ChannelId, req.UserId, req.Role)
+			return nil, err
+		})
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		if member.Kind == pb.ChannelMember_Member {
+			rpc.membershipsChanged(int(req.UserId), req.ChannelId)
+			rpc.roomRoleChanged(int(req.UserId))
+		}
+
+	case *pb.Envelope_RequestContact:
+		req := msg.RequestContact
+		requesterId := uint64(pd.userId)
+		accepted, err := rpc.contacts.Request(requesterId, req.ResponderId)
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		if accepted {
+			// The responder asked first, so the request accepts theirs.
+			rpc.contactsAdded(req.ResponderId, requesterId)
+			break
+		}
+		rpc.sendToUsers([]int{pd.userId}, &pb.Envelope{
+			Payload: &pb.Envelope_UpdateContacts{
+				UpdateContacts: &pb.UpdateContacts{OutgoingRequests: []uint64{req.ResponderId}},
+			},
+		})
+		rpc.sendToUsers([]int{int(req.ResponderId)}, &pb.Envelope{
+			Payload: &pb.Envelope_UpdateContacts{
+				UpdateContacts: &pb.UpdateContacts{
+					IncomingRequests: []*pb.IncomingContactRequest{{RequesterId: requesterId}},
+				},
+			},
+		})
+		rpc.notify(req.ResponderId, NotificationContactRequest, requesterId, struct{}{})
+
+	case *pb.Envelope_RespondToContactRequest:
+		req := msg.RespondToContactRequest
+		responderId := uint64(pd.userId)
+		// Dismissing only hides the notification, the request stays.
+		if req.Response == pb.ContactRequestResponse_Dismiss {
+			return pd.SendAck(envelope.Id)
+		}
+		accept := req.Response == pb.ContactRequestResponse_Accept
+		if err := rpc.contacts.Respond(responderId, req.RequesterId, accept); err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		if accept {
+			rpc.contactsAdded(req.RequesterId, responderId)
+		} else {
+			rpc.respondToNotification(responderId, NotificationContactRequest, req.RequesterId, false)
+			rpc.contactsRemoved(req.RequesterId, responderId)
+		}
+
+	case *pb.Envelope_RemoveContact:
+		req := msg.RemoveContact
+		userId := uint64(pd.userId)
+		if err := rpc.contacts.Remove(userId, req.UserId); err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.contactsRemoved(userId, req.UserId)
 
 	case *pb.Envelope_JoinChannel:
-		// jc := envelope.Payload.(*pb.Envelope_JoinChannel).JoinChannel
-		// resp := pb.Envelope{
-		// 	RespondingTo: &envelope.Id,
-		// 	Payload: &pb.Envelope_JoinChannelChatResponse{
-		// 		JoinChannelChatResponse: &pb.JoinChannelChatResponse{},
-		// 	},
-		// }
-		// if err := rpc.SendProtobuf(connId, &resp); err != nil {
-		// 	return err
-		// }
+		return rpc.joinChannelRoom(pd, envelope.Id, msg.JoinChannel.ChannelId)
+
+	case *pb.Envelope_CreateRoom:
+		room, err := rpc.rooms.Create(uint64(pd.userId))
+		if err != nil {
+			return err
+		}
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_CreateRoomResponse{
+				CreateRoomResponse: &pb.CreateRoomResponse{
+					Room:                  room,
+					LiveKitConnectionInfo: rpc.liveKitConnectionInfo(room, pd.userId),
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+		rpc.contactChanged(pd.userId)
+
+	case *pb.Envelope_JoinRoom:
+		roomId := msg.JoinRoom.Id
+		_, channelId, err := rpc.rooms.Room(roomId)
+		if err != nil {
+			return err
+		}
+		// Calls into the room of a channel are answered by joining the channel.
+		if channelId != 0 {
+			return rpc.joinChannelRoom(pd, envelope.Id, channelId)
+		}
+		room, err := rpc.rooms.Join(roomId, uint64(pd.userId))
+		if err != nil {
+			return err
+		}
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_JoinRoomResponse{
+				JoinRoomResponse: &pb.JoinRoomResponse{
+					Room:                  room,
+					LiveKitConnectionInfo: rpc.liveKitConnectionInfo(room, pd.userId),
+				},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+		rpc.roomUpdated(room)
+		rpc.contactChanged(pd.userId)
+
+	case *pb.Envelope_RejoinRoom:
+		// Zed rejoins the room it was in after reconnecting, zedex has no projects to
+		// reshare or rejoin.
+		room, err := rpc.rooms.Rejoin(msg.RejoinRoom.Id, uint64(pd.userId))
+		if err != nil {
+			return err
+		}
+		resp := pb.Envelope{
+			Id:           pd.NextId(),
+			RespondingTo: &envelope.Id,
+			Payload: &pb.Envelope_RejoinRoomResponse{
+				RejoinRoomResponse: &pb.RejoinRoomResponse{Room: room},
+			},
+		}
+		if err := pd.SendProtobuf(&resp); err != nil {
+			return err
+		}
+		rpc.roomUpdated(room)
+		rpc.contactChanged(pd.userId)
+
+	case *pb.Envelope_LeaveRoom:
+		rpc.leaveRoom(pd.userId)
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+
+	case *pb.Envelope_Call:
+		req := msg.Call
+		if !slices.Contains(rpc.contacts.Contacts(uint64(pd.userId)), req.CalledUserId) {
+			return rpcErrorf(pb.ErrorCode_Forbidden, "user %v is not a contact", req.CalledUserId)
+		}
+		if !rpc.sockets.Exists(int(req.CalledUserId)) {
+			return rpcErrorf(pb.ErrorCode_Internal, "user %v is offline", req.CalledUserId)
+		}
+		room, err := rpc.rooms.Call(req.RoomId, uint64(pd.userId), req.CalledUserId, req.InitialProjectId)
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		incoming := &pb.IncomingCall{RoomId: room.Id, CallingUserId: uint64(pd.userId)}
+		for _, p := range room.Participants {
+			incoming.ParticipantUserIds = append(incoming.ParticipantUserIds, p.UserId)
+		}
+		rpc.sendToUsers([]int{int(req.CalledUserId)}, &pb.Envelope{
+			Payload: &pb.Envelope_IncomingCall{IncomingCall: incoming},
+		})
+		rpc.roomUpdated(room)
+		rpc.contactChanged(int(req.CalledUserId))
+
+	case *pb.Envelope_CancelCall:
+		req := msg.CancelCall
+		room, err := rpc.rooms.CancelCall(req.RoomId, uint64(pd.userId), req.CalledUserId)
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.sendToUsers([]int{int(req.CalledUserId)}, &pb.Envelope{
+			Payload: &pb.Envelope_CallCanceled{CallCanceled: &pb.CallCanceled{RoomId: req.RoomId}},
+		})
+		rpc.roomUpdated(room)
+		rpc.contactChanged(int(req.CalledUserId))
+
+	case *pb.Envelope_DeclineCall:
+		room, err := rpc.rooms.DeclineCall(msg.DeclineCall.RoomId, uint64(pd.userId))
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.roomUpdated(room)
+		rpc.contactChanged(pd.userId)
+
+	case *pb.Envelope_UpdateParticipantLocation:
+		req := msg.UpdateParticipantLocation
+		room, err := rpc.rooms.UpdateLocation(req.RoomId, uint64(pd.userId), req.Location)
+		if err != nil {
+			return err
+		}
+		if err := pd.SendAck(envelope.Id); err != nil {
+			return err
+		}
+		rpc.roomUpdated(room)
+
+	case *pb.Envelope_Ack:
+		// Zed acknowledges the requests zedex sends, e.g. IncomingCall.
 	default:
 		log.Infof("Received unmapped WebSocket message base64: %v", base64.StdEncoding.EncodeToString(message))
 	}
 	return nil
 }
 
+// changeChannels applies a change of channels or memberships, and sends each connected
+// user what changed for them: channels that appeared, the visible ones of changed and
+// those that disappeared, whose chat and notes the user leaves. Zed applies moves and deletions
+// only through these updates, so the user that made the change gets them too.
+func (rpc *RpcHandler) changeChannels(change func() (changed []*pb.Channel, err error)) error {
+	userIds := rpc.sockets.Keys()
+	before := make(map[int][]uint64, len(userIds))
+	for _, userId := range userIds {
+		before[userId] = rpc.channels.VisibleChannelIds(uint64(userId))
+	}
+	changed, err := change()
+	if err != nil {
+		return err
+	}
+	for _, userId := range userIds {
+		update := rpc.channels.ChannelUpdate(uint64(userId), before[userId], changed)
+		if update == nil {
+			continue
+		}
+		for _, channelId := range update.DeleteChannels {
+			rpc.leaveChat(channelId, userId)
+			if rpc.leaveBuffer(channelId, userId) {
+				rpc.bufferCollaboratorsChanged(channelId)
+			}
+		}
+		if len(update.DeleteChannels) > 0 {
+			// Leaves the room of a channel the user no longer sees.
+			rpc.roomRoleChanged(userId)
+		}
+		rpc.sendToUsers([]int{userId}, &pb.Envelope{
+			Payload: &pb.Envelope_UpdateChannels{UpdateChannels: update},
+		})
+	}
+	return nil
+}
+
+// membershipsChanged sends a user, if connected, the roles in channels and drops an
+// answered or withdrawn invite to channelId.
+func (rpc *RpcHandler) membershipsChanged(userId int, channelId uint64) {
+	rpc.sendToUsers([]int{userId}, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateUserChannels{
+			UpdateUserChannels: &pb.UpdateUserChannels{
+				ChannelMemberships: rpc.channels.Memberships(uint64(userId)),
+			},
+		},
+	})
+	if !slices.ContainsFunc(rpc.channels.Invitations(uint64(userId)), func(c *pb.Channel) bool { return c.Id == channelId }) {
+		rpc.sendToUsers([]int{userId}, &pb.Envelope{
+			Payload: &pb.Envelope_UpdateChannels{
+				UpdateChannels: &pb.UpdateChannels{RemoveChannelInvitations: []uint64{channelId}},
+			},
+		})
+	}
+}
+
+// broadcastBufferVersion tells the users that see a channel but don't collaborate on
+// its notes that the notes changed.
+func (rpc *RpcHandler) broadcastBufferVersion(channelId uint64, version []*pb.VectorClockEntry) {
+	_, epoch := rpc.channels.BufferSnapshot(channelId)
+	collaborators := rpc.bufferCollaboratorIds(channelId)
+	others := []int{}
+	for _, userId := range rpc.channels.Audience(channelId) {
+		if id := int(userId); !slices.Contains(collaborators, id) {
+			others = append(others, id)
+		}
+	}
+	rpc.sendToUsers(others, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateChannels{
+			UpdateChannels: &pb.UpdateChannels{
+				LatestChannelBufferVersions: []*pb.ChannelBufferVersion{{ChannelId: channelId, Version: version, Epoch: epoch}},
+			},
+		},
+	})
+}
+
+// broadcastChannelMessage sends a new chat message to the other users in the chat of
+// the channel, and tells everyone else that sees the channel there is a new message.
+func (rpc *RpcHandler) broadcastChannelMessage(channelId uint64, message *pb.ChannelMessage) {
+	participants := rpc.chatParticipants.Get(channelId)
+	sender := int(message.SenderId)
+	rpc.sendToUsers(slices.DeleteFunc(slices.Clone(participants), func(id int) bool { return id == sender }), &pb.Envelope{
+		Payload: &pb.Envelope_ChannelMessageSent{
+			ChannelMessageSent: &pb.ChannelMessageSent{
+				ChannelId: channelId,
+				Message:   message,
+			},
+		},
+	})
+	others := []int{}
+	for _, userId := range rpc.channels.Audience(channelId) {
+		if id := int(userId); id != sender && !slices.Contains(participants, id) {
+			others = append(others, id)
+		}
+	}
+	rpc.sendToUsers(others, &pb.Envelope{
+		Payload: &pb.Envelope_UpdateChannels{
+			UpdateChannels: &pb.UpdateChannels{
+				LatestChannelMessageIds: []*pb.ChannelMessageId{{ChannelId: channelId, MessageId: message.Id}},
+			},
+		},
+	})
+}
+
+// notifyMentions notifies the users mentioned in a chat message that see the channel,
+// once per message, also when it is edited.
+func (rpc *RpcHandler) notifyMentions(channelId uint64, message *pb.ChannelMessage) {
+	audience := rpc.channels.Audience(channelId)
+	for _, mention := range message.Mentions {
+		if mention.UserId == message.SenderId || !slices.Contains(audience, mention.UserId) {
+			continue
+		}
+		rpc.notify(mention.UserId, NotificationChannelMessageMention, message.Id, channelMessageMentionContent{
+			SenderId:  message.SenderId,
+			ChannelId: channelId,
+		})
+	}
+}
+
 func (rpc *RpcHandler) generateWebSocketKey() string {
 	key := make([]byte, 16)
 	if _, err := rand.Read(key); err != nil {
@@ -393,21 +1737,13 @@ func (rpc *RpcHandler) HandleRequest(c *gin.Context) {
 	c.Request.Header.Add("Sec-WebSocket-Version", "13")
 	c.Request.Header.Add("Sec-WebSocket-Key", rpc.generateWebSocketKey())
 
-	auth := c.Request.Header.Get("Authorization")
-	if len(strings.Split(auth, " ")) != 2 {
-		log.Error("failed to get stuff from auth header")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get stuff from auth header"})
-		return
-	}
-
-	// NOTE: The other part of the map ([1]) is the decrypted data from the crypto challenge.
-	connIdStr := strings.Split(auth, " ")[0]
-	userId, err := strconv.Atoi(connIdStr)
+	user, err := rpc.users.Authenticate(c.Request.Header.Get("Authorization"))
 	if err != nil {
 		log.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials, sign in again"})
 		return
 	}
+	userId := int(user.ID)
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -415,23 +1751,23 @@ func (rpc *RpcHandler) HandleRequest(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to upgrade connection"})
 		return
 	}
-	rpc.sockets.Set(userId, conn)
-	rpc.sockets.Get(userId).SetReadLimit(WEBSOCKET_READ_LIMIT)
+	conn.SetReadLimit(WEBSOCKET_READ_LIMIT)
+	rc := &rpcConn{Conn: conn}
+	rpc.sockets.Set(userId, rc)
+	rpc.reconnected(userId)
 
-	// TODO: Transaction
-	if !rpc.users.Exists(uint64(userId)) {
-		u := &pb.User{
-			Id:          uint64(userId),
-			GithubLogin: rpc.nameGenerator.Generate(),
-		}
-		rpc.users.Set(uint64(userId), u)
-		log.Debugf("added a user, current users: %v", len(rpc.users.Map()))
-	}
 	pd := NewProtoDispatcher(rpc, userId)
-	go rpc.handleMessages(pd)
+	go rpc.handleMessages(pd, rc)
 	if err := pd.SendHello(); err != nil {
 		log.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err := pd.SendUserPlan(user); err != nil {
+		log.Error(err)
+	}
+	if err := pd.SendContacts(); err != nil {
+		log.Error(err)
+	}
+	rpc.contactChanged(userId)
 }
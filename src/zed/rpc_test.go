@@ -0,0 +1,520 @@
+package zed
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"zedex/zed/pb"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+type testRpcServer struct {
+	*httptest.Server
+	users *UserStore
+}
+
+func newTestRpcServer(t *testing.T) *testRpcServer {
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), NewLLMTokens([]byte("secret")), newTestUsageStore(t), newTestPlanStore(t, UsageLimits{}), 8080)
+	// Users who lost their connection are taken out of their room a second later.
+	api.WithReconnectTimeout(time.Second)
+	server := httptest.NewServer(api.Router())
+	t.Cleanup(server.Close)
+	return &testRpcServer{Server: server, users: users}
+}
+
+// testRpcClient talks to zedex like Zed does, with zstd compressed protobuf envelopes.
+type testRpcClient struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	user   UserRecord
+	nextId uint32
+	// pending are the envelopes receive skipped, for later calls.
+	pending []*pb.Envelope
+}
+
+// connect signs login in and opens its collab connection.
+func (s *testRpcServer) connect(t *testing.T, login string) *testRpcClient {
+	user, err := s.users.Resolve("test:"+login, UserProfile{Login: login})
+	assert.Nil(t, err)
+	token, err := s.users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/handle-rpc"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {fmt.Sprintf("%d %s", user.ID, token)}})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testRpcClient{t: t, conn: conn, user: user}
+	c.receive(func(e *pb.Envelope) bool { return e.GetHello() != nil })
+	return c
+}
+
+// send sends an envelope, returning its ID.
+func (c *testRpcClient) send(envelope *pb.Envelope) uint32 {
+	c.nextId++
+	envelope.Id = c.nextId
+	b, err := proto.Marshal(envelope)
+	assert.Nil(c.t, err)
+	encoder, err := zstd.NewWriter(nil)
+	assert.Nil(c.t, err)
+	assert.Nil(c.t, c.conn.WriteMessage(websocket.BinaryMessage, encoder.EncodeAll(b, nil)))
+	return envelope.Id
+}
+
+// request sends an envelope and waits for the response.
+func (c *testRpcClient) request(envelope *pb.Envelope) *pb.Envelope {
+	id := c.send(envelope)
+	return c.receive(func(e *pb.Envelope) bool { return e.RespondingTo != nil && *e.RespondingTo == id })
+}
+
+// receive waits for an envelope matching f, keeping others for later calls.
+func (c *testRpcClient) receive(f func(*pb.Envelope) bool) *pb.Envelope {
+	c.t.Helper()
+	for i, envelope := range c.pending {
+		if f(envelope) {
+			c.pending = slices.Delete(c.pending, i, i+1)
+			return envelope
+		}
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if !assert.Nil(c.t, err, "no matching message received") {
+			c.t.FailNow()
+		}
+		message, err = decompressMsg(message)
+		assert.Nil(c.t, err)
+		var envelope pb.Envelope
+		assert.Nil(c.t, proto.Unmarshal(message, &envelope))
+		if f(&envelope) {
+			return &envelope
+		}
+		c.pending = append(c.pending, &envelope)
+	}
+}
+
+// addMember has admin invite c to a channel with a role, and c accept.
+func (c *testRpcClient) addMember(admin *testRpcClient, channelId uint64, role pb.ChannelRole) {
+	admin.request(&pb.Envelope{Payload: &pb.Envelope_InviteChannelMember{InviteChannelMember: &pb.InviteChannelMember{ChannelId: channelId, UserId: c.user.ID, Role: role}}})
+	c.request(&pb.Envelope{Payload: &pb.Envelope_RespondToChannelInvite{RespondToChannelInvite: &pb.RespondToChannelInvite{ChannelId: channelId, Accept: true}}})
+}
+
+func TestChannelChat(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	carol := server.connect(t, "carol")
+
+	created := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}})
+	channelId := created.GetCreateChannelResponse().Channel.Id
+	bob.addMember(alice, channelId, pb.ChannelRole_Member)
+	carol.addMember(alice, channelId, pb.ChannelRole_Member)
+	for _, c := range []*testRpcClient{alice, bob} {
+		c.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannelChat{JoinChannelChat: &pb.JoinChannelChat{ChannelId: channelId}}})
+	}
+
+	sent := alice.request(&pb.Envelope{Payload: &pb.Envelope_SendChannelMessage{SendChannelMessage: &pb.SendChannelMessage{ChannelId: channelId, Body: "hi"}}})
+	message := sent.GetSendChannelMessageResponse().Message
+	assert.Equal(t, alice.user.ID, message.SenderId)
+
+	// Bob is in the chat and gets the message, Carol only learns there is a new one.
+	received := bob.receive(func(e *pb.Envelope) bool { return e.GetChannelMessageSent() != nil }).GetChannelMessageSent()
+	assert.Equal(t, channelId, received.ChannelId)
+	assert.Equal(t, "hi", received.Message.Body)
+	assert.Equal(t, alice.user.ID, received.Message.SenderId)
+	update := carol.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetLatestChannelMessageIds()) > 0 }).GetUpdateChannels()
+	assert.Equal(t, []*pb.ChannelMessageId{{ChannelId: channelId, MessageId: message.Id}}, update.LatestChannelMessageIds)
+
+	// The latest and the observed messages tell Zed what is unread.
+	bob.send(&pb.Envelope{Payload: &pb.Envelope_AckChannelMessage{AckChannelMessage: &pb.AckChannelMessage{ChannelId: channelId, MessageId: message.Id}}})
+	observed := map[*testRpcClient]*pb.UpdateUserChannels{}
+	for _, c := range []*testRpcClient{bob, carol} {
+		hello := c.request(&pb.Envelope{Payload: &pb.Envelope_Hello{Hello: &pb.Hello{}}})
+		assert.Equal(t, message.Id, hello.GetUpdateChannels().LatestChannelMessageIds[0].MessageId)
+		observed[c] = c.receive(func(e *pb.Envelope) bool { return e.GetUpdateUserChannels() != nil && e.Id > hello.Id }).GetUpdateUserChannels()
+	}
+	assert.Equal(t, message.Id, observed[bob].ObservedChannelMessageId[0].MessageId)
+	assert.Empty(t, observed[carol].ObservedChannelMessageId)
+
+	// After leaving, Bob is only told about new messages.
+	bob.send(&pb.Envelope{Payload: &pb.Envelope_LeaveChannelChat{LeaveChannelChat: &pb.LeaveChannelChat{ChannelId: channelId}}})
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_Hello{Hello: &pb.Hello{}}})
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_SendChannelMessage{SendChannelMessage: &pb.SendChannelMessage{ChannelId: channelId, Body: "bye"}}})
+	next := bob.receive(func(e *pb.Envelope) bool {
+		return e.GetChannelMessageSent() != nil || len(e.GetUpdateChannels().GetLatestChannelMessageIds()) > 0
+	})
+	assert.NotNil(t, next.GetUpdateChannels())
+}
+
+func TestChannelManagement(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	created := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "docs", ParentId: &zed.Id}}}).GetCreateChannelResponse()
+	assert.Equal(t, zed.Id, *created.ParentId)
+	assert.Equal(t, []uint64{zed.Id}, created.Channel.ParentPath)
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	update := bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetChannels()) > 0 }).GetUpdateChannels()
+	assert.Len(t, update.Channels, 2)
+
+	// Only admins change channels, Zed is told why not.
+	refused := bob.request(&pb.Envelope{Payload: &pb.Envelope_RenameChannel{RenameChannel: &pb.RenameChannel{ChannelId: zed.Id, Name: "bob"}}})
+	assert.Equal(t, pb.ErrorCode_Forbidden, refused.GetError().Code)
+
+	renamed := alice.request(&pb.Envelope{Payload: &pb.Envelope_RenameChannel{RenameChannel: &pb.RenameChannel{ChannelId: zed.Id, Name: "zed-industries"}}})
+	assert.Equal(t, "zed-industries", renamed.GetRenameChannelResponse().Channel.Name)
+	update = bob.receive(func(e *pb.Envelope) bool {
+		channels := e.GetUpdateChannels().GetChannels()
+		return len(channels) > 0 && channels[0].Name == "zed-industries"
+	}).GetUpdateChannels()
+	assert.Equal(t, zed.Id, update.Channels[0].Id)
+
+	// Deleting a channel closes the rooms of its subtree and retracts the invites to it.
+	carol := server.connect(t, "carol")
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_InviteChannelMember{InviteChannelMember: &pb.InviteChannelMember{ChannelId: created.Channel.Id, UserId: carol.user.ID, Role: pb.ChannelRole_Member}}})
+	invite := carol.receive(func(e *pb.Envelope) bool { return e.GetAddNotification() != nil }).GetAddNotification().Notification
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: created.Channel.Id}}})
+
+	deleted := alice.request(&pb.Envelope{Payload: &pb.Envelope_DeleteChannel{DeleteChannel: &pb.DeleteChannel{ChannelId: zed.Id}}})
+	assert.NotNil(t, deleted.GetAck())
+	update = bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetDeleteChannels()) > 0 }).GetUpdateChannels()
+	assert.ElementsMatch(t, []uint64{zed.Id, created.Channel.Id}, update.DeleteChannels)
+	closed := alice.receive(func(e *pb.Envelope) bool {
+		return e.GetRoomUpdated() != nil && len(e.GetRoomUpdated().Room.Participants) == 0
+	})
+	assert.NotNil(t, closed)
+	retracted := carol.receive(func(e *pb.Envelope) bool { return e.GetDeleteNotification() != nil }).GetDeleteNotification()
+	assert.Equal(t, invite.Id, retracted.NotificationId)
+}
+
+func TestChannelMembership(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	refused := bob.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannelChat{JoinChannelChat: &pb.JoinChannelChat{ChannelId: zed.Id}}})
+	assert.Equal(t, pb.ErrorCode_Forbidden, refused.GetError().Code)
+
+	// Invitees see the invite, not the channel, until they accept.
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_InviteChannelMember{InviteChannelMember: &pb.InviteChannelMember{ChannelId: zed.Id, UserId: bob.user.ID, Role: pb.ChannelRole_Member}}})
+	invite := bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetChannelInvitations()) > 0 }).GetUpdateChannels()
+	assert.Equal(t, zed.Id, invite.ChannelInvitations[0].Id)
+	members := alice.request(&pb.Envelope{Payload: &pb.Envelope_GetChannelMembers{GetChannelMembers: &pb.GetChannelMembers{ChannelId: zed.Id}}}).GetGetChannelMembersResponse()
+	assert.Len(t, members.Members, 2)
+	assert.Equal(t, pb.ChannelMember_Invitee, members.Members[1].Kind)
+	assert.Equal(t, "bob", members.Users[1].GithubLogin)
+
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_RespondToChannelInvite{RespondToChannelInvite: &pb.RespondToChannelInvite{ChannelId: zed.Id, Accept: true}}})
+	update := bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetChannels()) > 0 }).GetUpdateChannels()
+	assert.Equal(t, zed.Id, update.Channels[0].Id)
+	memberships := bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateUserChannels().GetChannelMemberships()) > 0 }).GetUpdateUserChannels()
+	assert.Equal(t, pb.ChannelRole_Member, memberships.ChannelMemberships[0].Role)
+	bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetRemoveChannelInvitations()) > 0 })
+
+	// Guests only see public channels.
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_SetChannelMemberRole{SetChannelMemberRole: &pb.SetChannelMemberRole{ChannelId: zed.Id, UserId: bob.user.ID, Role: pb.ChannelRole_Guest}}})
+	update = bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetDeleteChannels()) > 0 }).GetUpdateChannels()
+	assert.Equal(t, []uint64{zed.Id}, update.DeleteChannels)
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_SetChannelVisibility{SetChannelVisibility: &pb.SetChannelVisibility{ChannelId: zed.Id, Visibility: pb.ChannelVisibility_Public}}})
+	bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetChannels()) > 0 })
+	refused = bob.request(&pb.Envelope{Payload: &pb.Envelope_SendChannelMessage{SendChannelMessage: &pb.SendChannelMessage{ChannelId: zed.Id, Body: "hi"}}})
+	assert.Equal(t, pb.ErrorCode_Forbidden, refused.GetError().Code)
+
+	// The last admin can't leave, members can.
+	refused = alice.request(&pb.Envelope{Payload: &pb.Envelope_RemoveChannelMember{RemoveChannelMember: &pb.RemoveChannelMember{ChannelId: zed.Id, UserId: alice.user.ID}}})
+	assert.Equal(t, pb.ErrorCode_Forbidden, refused.GetError().Code)
+	left := bob.request(&pb.Envelope{Payload: &pb.Envelope_RemoveChannelMember{RemoveChannelMember: &pb.RemoveChannelMember{ChannelId: zed.Id, UserId: bob.user.ID}}})
+	assert.NotNil(t, left.GetAck())
+	bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetDeleteChannels()) > 0 })
+}
+
+func TestChannelNotes(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	carol := server.connect(t, "carol")
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	carol.addMember(alice, zed.Id, pb.ChannelRole_Member)
+
+	join := &pb.Envelope{Payload: &pb.Envelope_JoinChannelBuffer{JoinChannelBuffer: &pb.JoinChannelBuffer{ChannelId: zed.Id}}}
+	joined := alice.request(join).GetJoinChannelBufferResponse()
+	assert.Equal(t, zed.Id, joined.BufferId)
+	alice.send(&pb.Envelope{Payload: &pb.Envelope_UpdateChannelBuffer{UpdateChannelBuffer: &pb.UpdateChannelBuffer{
+		ChannelId:  zed.Id,
+		Operations: []*pb.Operation{testRangeEdit(joined.ReplicaId, 1, nil, [][2]uint64{{0, 0}}, "notes")},
+	}}})
+
+	// Collaborators get the operations, the others learn the notes changed.
+	update := carol.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateChannels().GetLatestChannelBufferVersions()) > 0 }).GetUpdateChannels()
+	assert.Equal(t, uint32(1), update.LatestChannelBufferVersions[0].Version[0].Timestamp)
+	bobJoined := bob.request(join).GetJoinChannelBufferResponse()
+	assert.NotEqual(t, joined.ReplicaId, bobJoined.ReplicaId)
+	assert.Len(t, bobJoined.Operations, 1)
+	assert.Len(t, bobJoined.Collaborators, 2)
+	collaborators := alice.receive(func(e *pb.Envelope) bool {
+		return len(e.GetUpdateChannelBufferCollaborators().GetCollaborators()) == 2
+	}).GetUpdateChannelBufferCollaborators()
+	assert.Equal(t, zed.Id, collaborators.ChannelId)
+	alice.send(&pb.Envelope{Payload: &pb.Envelope_UpdateChannelBuffer{UpdateChannelBuffer: &pb.UpdateChannelBuffer{
+		ChannelId:  zed.Id,
+		Operations: []*pb.Operation{testRangeEdit(joined.ReplicaId, 2, map[uint32]uint32{joined.ReplicaId: 1}, [][2]uint64{{5, 5}}, " and more")},
+	}}})
+	relayed := bob.receive(func(e *pb.Envelope) bool { return e.GetUpdateChannelBuffer() != nil }).GetUpdateChannelBuffer()
+	assert.Equal(t, " and more", relayed.Operations[0].GetEdit().NewText[0])
+
+	// Rejoining returns what was missed.
+	assert.NotNil(t, bob.request(&pb.Envelope{Payload: &pb.Envelope_LeaveChannelBuffer{LeaveChannelBuffer: &pb.LeaveChannelBuffer{ChannelId: zed.Id}}}).GetAck())
+	alice.receive(func(e *pb.Envelope) bool {
+		return len(e.GetUpdateChannelBufferCollaborators().GetCollaborators()) == 1
+	})
+	rejoined := bob.request(&pb.Envelope{Payload: &pb.Envelope_RejoinChannelBuffers{RejoinChannelBuffers: &pb.RejoinChannelBuffers{
+		Buffers: []*pb.ChannelBufferVersion{{ChannelId: zed.Id, Version: []*pb.VectorClockEntry{{ReplicaId: joined.ReplicaId, Timestamp: 1}}}},
+	}}}).GetRejoinChannelBuffersResponse()
+	assert.Len(t, rejoined.Buffers[0].Operations, 1)
+	assert.Equal(t, uint32(2), rejoined.Buffers[0].Version[0].Timestamp)
+
+	// The last collaborator to leave snapshots the notes.
+	for _, c := range []*testRpcClient{alice, bob} {
+		c.request(&pb.Envelope{Payload: &pb.Envelope_LeaveChannelBuffer{LeaveChannelBuffer: &pb.LeaveChannelBuffer{ChannelId: zed.Id}}})
+	}
+	carolJoined := carol.request(join).GetJoinChannelBufferResponse()
+	assert.Equal(t, "notes and more", carolJoined.BaseText)
+	assert.Equal(t, uint64(1), carolJoined.Epoch)
+	assert.Empty(t, carolJoined.Operations)
+	rejoined = bob.request(&pb.Envelope{Payload: &pb.Envelope_RejoinChannelBuffers{RejoinChannelBuffers: &pb.RejoinChannelBuffers{
+		Buffers: []*pb.ChannelBufferVersion{{ChannelId: zed.Id, Version: []*pb.VectorClockEntry{{ReplicaId: joined.ReplicaId, Timestamp: 2}}}},
+	}}}).GetRejoinChannelBuffersResponse()
+	assert.Empty(t, rejoined.Buffers)
+}
+
+func TestChannelMessageEditing(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	for _, c := range []*testRpcClient{alice, bob} {
+		joined := c.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannelChat{JoinChannelChat: &pb.JoinChannelChat{ChannelId: zed.Id}}}).GetJoinChannelChatResponse()
+		assert.True(t, joined.Done)
+	}
+
+	sent := bob.request(&pb.Envelope{Payload: &pb.Envelope_SendChannelMessage{SendChannelMessage: &pb.SendChannelMessage{ChannelId: zed.Id, Body: "helo"}}})
+	message := sent.GetSendChannelMessageResponse().Message
+	updated := bob.request(&pb.Envelope{Payload: &pb.Envelope_UpdateChannelMessage{UpdateChannelMessage: &pb.UpdateChannelMessage{ChannelId: zed.Id, MessageId: message.Id, Body: "hello"}}})
+	assert.NotNil(t, updated.GetAck())
+	update := alice.receive(func(e *pb.Envelope) bool { return e.GetChannelMessageUpdate() != nil }).GetChannelMessageUpdate()
+	assert.Equal(t, "hello", update.Message.Body)
+	assert.Equal(t, bob.user.ID, update.Message.SenderId)
+
+	fetched := alice.request(&pb.Envelope{Payload: &pb.Envelope_GetChannelMessagesById{GetChannelMessagesById: &pb.GetChannelMessagesById{MessageIds: []uint64{message.Id}}}})
+	assert.Equal(t, "hello", fetched.GetGetChannelMessagesResponse().Messages[0].Body)
+
+	removed := alice.request(&pb.Envelope{Payload: &pb.Envelope_RemoveChannelMessage{RemoveChannelMessage: &pb.RemoveChannelMessage{ChannelId: zed.Id, MessageId: message.Id}}})
+	assert.NotNil(t, removed.GetAck())
+	removal := bob.receive(func(e *pb.Envelope) bool { return e.GetRemoveChannelMessage() != nil }).GetRemoveChannelMessage()
+	assert.Equal(t, message.Id, removal.MessageId)
+	history := bob.request(&pb.Envelope{Payload: &pb.Envelope_GetChannelMessages{GetChannelMessages: &pb.GetChannelMessages{ChannelId: zed.Id}}}).GetGetChannelMessagesResponse()
+	assert.Empty(t, history.Messages)
+	assert.True(t, history.Done)
+}
+
+func TestContactPresence(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+
+	requested := alice.request(&pb.Envelope{Payload: &pb.Envelope_RequestContact{RequestContact: &pb.RequestContact{ResponderId: bob.user.ID}}})
+	assert.NotNil(t, requested.GetAck())
+	incoming := bob.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateContacts().GetIncomingRequests()) > 0 }).GetUpdateContacts()
+	assert.Equal(t, alice.user.ID, incoming.IncomingRequests[0].RequesterId)
+
+	accepted := bob.request(&pb.Envelope{Payload: &pb.Envelope_RespondToContactRequest{RespondToContactRequest: &pb.RespondToContactRequest{RequesterId: alice.user.ID, Response: pb.ContactRequestResponse_Accept}}})
+	assert.NotNil(t, accepted.GetAck())
+	added := alice.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateContacts().GetContacts()) > 0 }).GetUpdateContacts()
+	assert.Equal(t, []uint64{bob.user.ID}, added.RemoveOutgoingRequests)
+	assert.Equal(t, bob.user.ID, added.Contacts[0].UserId)
+	assert.True(t, added.Contacts[0].Online)
+
+	// Contacts see each other go offline and come back.
+	bob.conn.Close()
+	offline := alice.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateContacts().GetContacts()) > 0 }).GetUpdateContacts()
+	assert.False(t, offline.Contacts[0].Online)
+	bob = server.connect(t, "bob")
+	contacts := bob.receive(func(e *pb.Envelope) bool { return e.GetUpdateContacts() != nil }).GetUpdateContacts()
+	assert.Equal(t, alice.user.ID, contacts.Contacts[0].UserId)
+	assert.True(t, contacts.Contacts[0].Online)
+	online := alice.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateContacts().GetContacts()) > 0 }).GetUpdateContacts()
+	assert.True(t, online.Contacts[0].Online)
+
+	removed := bob.request(&pb.Envelope{Payload: &pb.Envelope_RemoveContact{RemoveContact: &pb.RemoveContact{UserId: alice.user.ID}}})
+	assert.NotNil(t, removed.GetAck())
+	removal := alice.receive(func(e *pb.Envelope) bool { return len(e.GetUpdateContacts().GetRemoveContacts()) > 0 }).GetUpdateContacts()
+	assert.Equal(t, []uint64{bob.user.ID}, removal.RemoveContacts)
+}
+
+func TestNotificationDelivery(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	invite := bob.receive(func(e *pb.Envelope) bool { return e.GetAddNotification() != nil }).GetAddNotification().Notification
+	assert.Equal(t, NotificationChannelInvitation, invite.Kind)
+	assert.Equal(t, zed.Id, invite.GetEntityId())
+	answered := bob.receive(func(e *pb.Envelope) bool { return e.GetUpdateNotification() != nil }).GetUpdateNotification().Notification
+	assert.Equal(t, invite.Id, answered.Id)
+	assert.True(t, answered.GetResponse())
+	page := bob.request(&pb.Envelope{Payload: &pb.Envelope_GetNotifications{GetNotifications: &pb.GetNotifications{}}}).GetGetNotificationsResponse()
+	assert.Len(t, page.Notifications, 1)
+	assert.True(t, page.Done)
+
+	// Mentions notify the mentioned user, until the message is removed.
+	sent := bob.request(&pb.Envelope{Payload: &pb.Envelope_SendChannelMessage{SendChannelMessage: &pb.SendChannelMessage{
+		ChannelId: zed.Id,
+		Body:      "hi @alice",
+		Mentions:  []*pb.ChatMention{{Range: &pb.Range{Start: 3, End: 9}, UserId: alice.user.ID}},
+	}}}).GetSendChannelMessageResponse().Message
+	mention := alice.receive(func(e *pb.Envelope) bool { return e.GetAddNotification() != nil }).GetAddNotification().Notification
+	assert.Equal(t, NotificationChannelMessageMention, mention.Kind)
+	assert.Equal(t, sent.Id, mention.GetEntityId())
+	read := alice.request(&pb.Envelope{Payload: &pb.Envelope_MarkNotificationRead{MarkNotificationRead: &pb.MarkNotificationRead{NotificationId: mention.Id}}})
+	assert.NotNil(t, read.GetAck())
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_RemoveChannelMessage{RemoveChannelMessage: &pb.RemoveChannelMessage{ChannelId: zed.Id, MessageId: sent.Id}}})
+	deleted := alice.receive(func(e *pb.Envelope) bool { return e.GetDeleteNotification() != nil }).GetDeleteNotification()
+	assert.Equal(t, mention.Id, deleted.NotificationId)
+
+	// Contact requests are answered in the notification.
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_RequestContact{RequestContact: &pb.RequestContact{ResponderId: bob.user.ID}}})
+	request := bob.receive(func(e *pb.Envelope) bool { return e.GetAddNotification() != nil }).GetAddNotification().Notification
+	assert.Equal(t, NotificationContactRequest, request.Kind)
+	assert.Equal(t, alice.user.ID, request.GetEntityId())
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_RespondToContactRequest{RespondToContactRequest: &pb.RespondToContactRequest{RequesterId: alice.user.ID, Response: pb.ContactRequestResponse_Accept}}})
+	accepted := alice.receive(func(e *pb.Envelope) bool { return e.GetAddNotification() != nil }).GetAddNotification().Notification
+	assert.Equal(t, NotificationContactRequestAccepted, accepted.Kind)
+	assert.Equal(t, bob.user.ID, accepted.GetEntityId())
+}
+
+func TestCalls(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_RequestContact{RequestContact: &pb.RequestContact{ResponderId: bob.user.ID}}})
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_RespondToContactRequest{RespondToContactRequest: &pb.RespondToContactRequest{RequesterId: alice.user.ID, Response: pb.ContactRequestResponse_Accept}}})
+
+	room := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateRoom{CreateRoom: &pb.CreateRoom{}}}).GetCreateRoomResponse().Room
+	called := alice.request(&pb.Envelope{Payload: &pb.Envelope_Call{Call: &pb.Call{RoomId: room.Id, CalledUserId: bob.user.ID}}})
+	assert.NotNil(t, called.GetAck())
+	incoming := bob.receive(func(e *pb.Envelope) bool { return e.GetIncomingCall() != nil }).GetIncomingCall()
+	assert.Equal(t, alice.user.ID, incoming.CallingUserId)
+	assert.Equal(t, []uint64{alice.user.ID}, incoming.ParticipantUserIds)
+	busy := alice.receive(func(e *pb.Envelope) bool {
+		contacts := e.GetUpdateContacts().GetContacts()
+		return len(contacts) > 0 && contacts[0].Busy
+	})
+	assert.Equal(t, bob.user.ID, busy.GetUpdateContacts().Contacts[0].UserId)
+
+	joined := bob.request(&pb.Envelope{Payload: &pb.Envelope_JoinRoom{JoinRoom: &pb.JoinRoom{Id: room.Id}}}).GetJoinRoomResponse()
+	assert.Len(t, joined.Room.Participants, 2)
+	assert.Nil(t, joined.ChannelId)
+	updated := alice.receive(func(e *pb.Envelope) bool { return len(e.GetRoomUpdated().GetRoom().GetParticipants()) == 2 }).GetRoomUpdated()
+	assert.Empty(t, updated.Room.PendingParticipants)
+	left := bob.request(&pb.Envelope{Payload: &pb.Envelope_LeaveRoom{LeaveRoom: &pb.LeaveRoom{}}})
+	assert.NotNil(t, left.GetAck())
+	alice.receive(func(e *pb.Envelope) bool { return len(e.GetRoomUpdated().GetRoom().GetParticipants()) == 1 })
+
+	// Joining the room of a channel leaves the call, the channel sees who is in it.
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	channelRoom := alice.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: zed.Id}}}).GetJoinRoomResponse()
+	assert.Equal(t, zed.Id, channelRoom.GetChannelId())
+	assert.NotEqual(t, room.Id, channelRoom.Room.Id)
+	participants := bob.receive(func(e *pb.Envelope) bool {
+		return len(e.GetUpdateChannels().GetChannelParticipants()) > 0
+	}).GetUpdateChannels().ChannelParticipants[0]
+	assert.Equal(t, []uint64{alice.user.ID}, participants.ParticipantUserIds)
+	rejoined := bob.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: zed.Id}}}).GetJoinRoomResponse()
+	assert.Equal(t, channelRoom.Room.Id, rejoined.Room.Id)
+	assert.Equal(t, pb.ChannelRole_Member, rejoined.Room.Participants[1].Role)
+
+	// Role changes apply to the room, users that lost access to the channel leave it.
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_SetChannelVisibility{SetChannelVisibility: &pb.SetChannelVisibility{ChannelId: zed.Id, Visibility: pb.ChannelVisibility_Public}}})
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_SetChannelMemberRole{SetChannelMemberRole: &pb.SetChannelMemberRole{ChannelId: zed.Id, UserId: bob.user.ID, Role: pb.ChannelRole_Guest}}})
+	demoted := alice.receive(func(e *pb.Envelope) bool {
+		participants := e.GetRoomUpdated().GetRoom().GetParticipants()
+		return len(participants) == 2 && participants[1].Role == pb.ChannelRole_Guest
+	}).GetRoomUpdated()
+	assert.Equal(t, bob.user.ID, demoted.Room.Participants[1].UserId)
+	bob.receive(func(e *pb.Envelope) bool {
+		participants := e.GetRoomUpdated().GetRoom().GetParticipants()
+		return len(participants) == 2 && participants[1].Role == pb.ChannelRole_Guest
+	})
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_SetChannelMemberRole{SetChannelMemberRole: &pb.SetChannelMemberRole{ChannelId: zed.Id, UserId: bob.user.ID, Role: pb.ChannelRole_Banned}}})
+	alice.receive(func(e *pb.Envelope) bool { return len(e.GetRoomUpdated().GetRoom().GetParticipants()) == 1 })
+}
+
+func TestRemovedMemberLeavesRoom(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	docs := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "docs", ParentId: &zed.Id}}}).GetCreateChannelResponse().Channel
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	alice.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: docs.Id}}})
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: docs.Id}}})
+	alice.receive(func(e *pb.Envelope) bool { return len(e.GetRoomUpdated().GetRoom().GetParticipants()) == 2 })
+
+	// Removing a member of a parent channel takes them out of the rooms of its subtree.
+	removed := alice.request(&pb.Envelope{Payload: &pb.Envelope_RemoveChannelMember{RemoveChannelMember: &pb.RemoveChannelMember{ChannelId: zed.Id, UserId: bob.user.ID}}})
+	assert.NotNil(t, removed.GetAck())
+	updated := alice.receive(func(e *pb.Envelope) bool { return len(e.GetRoomUpdated().GetRoom().GetParticipants()) == 1 }).GetRoomUpdated()
+	assert.Equal(t, alice.user.ID, updated.Room.Participants[0].UserId)
+	participants := alice.receive(func(e *pb.Envelope) bool {
+		participants := e.GetUpdateChannels().GetChannelParticipants()
+		return len(participants) > 0 && len(participants[0].ParticipantUserIds) == 1
+	}).GetUpdateChannels().ChannelParticipants[0]
+	assert.Equal(t, docs.Id, participants.ChannelId)
+}
+
+func TestRejoinRoom(t *testing.T) {
+	server := newTestRpcServer(t)
+	alice := server.connect(t, "alice")
+	bob := server.connect(t, "bob")
+	zed := alice.request(&pb.Envelope{Payload: &pb.Envelope_CreateChannel{CreateChannel: &pb.CreateChannel{Name: "zed"}}}).GetCreateChannelResponse().Channel
+	bob.addMember(alice, zed.Id, pb.ChannelRole_Member)
+	room := alice.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: zed.Id}}}).GetJoinRoomResponse().Room
+	alice.receive(func(e *pb.Envelope) bool { return e.GetRoomUpdated() != nil })
+	bob.request(&pb.Envelope{Payload: &pb.Envelope_JoinChannel{JoinChannel: &pb.JoinChannel{ChannelId: zed.Id}}})
+
+	// Users who reconnect in time are still in their room.
+	bob.conn.Close()
+	bob = server.connect(t, "bob")
+	rejoined := bob.request(&pb.Envelope{Payload: &pb.Envelope_RejoinRoom{RejoinRoom: &pb.RejoinRoom{Id: room.Id}}}).GetRejoinRoomResponse()
+	assert.Len(t, rejoined.Room.Participants, 2)
+
+	// Others leave it once the reconnect timeout passed.
+	bob.conn.Close()
+	updated := alice.receive(func(e *pb.Envelope) bool {
+		return e.GetRoomUpdated() != nil && len(e.GetRoomUpdated().Room.Participants) == 1
+	}).GetRoomUpdated()
+	assert.Equal(t, alice.user.ID, updated.Room.Participants[0].UserId)
+	bob = server.connect(t, "bob")
+	refused := bob.request(&pb.Envelope{Payload: &pb.Envelope_RejoinRoom{RejoinRoom: &pb.RejoinRoom{Id: room.Id}}})
+	assert.Equal(t, pb.ErrorCode_Forbidden, refused.GetError().Code)
+}
@@ -0,0 +1,58 @@
+package zed
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SemanticVersion is a major.minor.patch version as used by Zed releases and the
+// extension wasm API.
+type SemanticVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseSemanticVersion parses versions like "0.190.5" or "v0.190.5". Missing minor or
+// patch components default to 0, and anything after a "-" or "+" is ignored.
+func ParseSemanticVersion(s string) (SemanticVersion, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i != -1 {
+		s = s[:i]
+	}
+	if s == "" {
+		return SemanticVersion{}, fmt.Errorf("empty version")
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return SemanticVersion{}, fmt.Errorf("invalid version %q", s)
+	}
+	nums := [3]int{}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return SemanticVersion{}, fmt.Errorf("invalid version %q", s)
+		}
+		nums[i] = n
+	}
+	return SemanticVersion{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than o.
+func (v SemanticVersion) Compare(o SemanticVersion) int {
+	for _, d := range [...]int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v SemanticVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
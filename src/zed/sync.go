@@ -0,0 +1,263 @@
+package zed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SYNC_JITTER      = 0.1
+	SYNC_MIN_BACKOFF = time.Minute
+)
+
+// SyncStatus describes the state of the background sync, as served by the sync-status
+// endpoint.
+type SyncStatus struct {
+	Running             bool       `json:"running"`
+	Interval            string     `json:"interval"`
+	LastStartedAt       *time.Time `json:"last_started_at"`
+	LastFinishedAt      *time.Time `json:"last_finished_at"`
+	LastSucceededAt     *time.Time `json:"last_succeeded_at"`
+	LastError           string     `json:"last_error"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextRunAt           *time.Time `json:"next_run_at"`
+	Extensions          int        `json:"extensions"`
+	ExtensionsUpdated   int        `json:"extensions_updated"`
+	LatestRelease       string     `json:"latest_release"`
+}
+
+// Syncer periodically refreshes the local mirror (extension index, extension archives,
+// latest release and its notes, and optionally remote server binaries) from zed.dev.
+//
+// Every file is swapped in atomically and archives are written before the index that
+// references them, so requests served while a sync runs always see consistent data.
+type Syncer struct {
+	zed                   Client
+	interval              time.Duration
+	concurrency           int
+	remoteServerPlatforms []Platform
+
+	status SyncStatus
+	mtx    sync.Mutex
+}
+
+func NewSyncer(zedClient Client, interval time.Duration) *Syncer {
+	return &Syncer{
+		zed:         zedClient,
+		interval:    interval,
+		concurrency: 20,
+		status:      SyncStatus{Interval: interval.String()},
+	}
+}
+
+func (s *Syncer) WithConcurrency(concurrency int) *Syncer {
+	if concurrency < 1 {
+		log.Fatal("must set sync concurrency to at least 1")
+	}
+	s.concurrency = concurrency
+	return s
+}
+
+// WithRemoteServerPlatforms makes every sync also mirror the remote server binaries of
+// the latest release for the given platforms.
+func (s *Syncer) WithRemoteServerPlatforms(platforms []Platform) *Syncer {
+	s.remoteServerPlatforms = platforms
+	return s
+}
+
+func (s *Syncer) Status() SyncStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.status
+}
+
+// Run syncs immediately and then once per interval until ctx is cancelled. Each delay
+// is jittered, and failed syncs are retried with exponential backoff capped at the
+// interval.
+func (s *Syncer) Run(ctx context.Context) {
+	for {
+		failures := 0
+		if err := s.SyncOnce(); err != nil {
+			log.Errorf("(sync) %v", err)
+			failures = s.Status().ConsecutiveFailures
+		}
+
+		delay := nextSyncDelay(s.interval, failures, rand.Float64())
+		next := time.Now().Add(delay)
+		s.mtx.Lock()
+		s.status.NextRunAt = &next
+		s.mtx.Unlock()
+		log.Infof("(sync) next sync at %v", next.Format(time.RFC3339))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// nextSyncDelay returns the interval jittered by +/- SYNC_JITTER, or after failures an
+// exponential backoff starting at SYNC_MIN_BACKOFF. r must be in [0, 1).
+func nextSyncDelay(interval time.Duration, failures int, r float64) time.Duration {
+	delay := interval
+	if failures > 0 {
+		backoff := SYNC_MIN_BACKOFF << min(failures-1, 16)
+		delay = min(backoff, interval)
+	}
+	jitter := time.Duration((r*2 - 1) * SYNC_JITTER * float64(delay))
+	return delay + jitter
+}
+
+// SyncOnce runs a single sync.
+func (s *Syncer) SyncOnce() error {
+	s.mtx.Lock()
+	if s.status.Running {
+		s.mtx.Unlock()
+		return fmt.Errorf("a sync is already running")
+	}
+	started := time.Now()
+	s.status.Running = true
+	s.status.LastStartedAt = &started
+	s.mtx.Unlock()
+
+	log.Info("(sync) starting")
+	extensions, updated, syncErr := s.syncExtensions()
+	release, err := s.syncLatestRelease()
+	syncErr = errors.Join(syncErr, err)
+	if release.Version != "" {
+		syncErr = errors.Join(syncErr, s.syncRemoteServers(release.Version))
+	}
+
+	finished := time.Now()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status.Running = false
+	s.status.LastFinishedAt = &finished
+	if extensions > 0 {
+		s.status.Extensions = extensions
+	}
+	s.status.ExtensionsUpdated = updated
+	if release.Version != "" {
+		s.status.LatestRelease = release.Version
+	}
+	if syncErr != nil {
+		s.status.LastError = syncErr.Error()
+		s.status.ConsecutiveFailures++
+		return syncErr
+	}
+	s.status.LastError = ""
+	s.status.ConsecutiveFailures = 0
+	s.status.LastSucceededAt = &finished
+	log.Infof("(sync) finished in %v, %v extensions updated", finished.Sub(started).Round(time.Millisecond), updated)
+	return nil
+}
+
+// syncExtensions downloads every extension that is new, changed its version or whose
+// archive is missing, and then writes the new index. Extensions that fail to download
+// keep their previous index entry, so they are retried on the next sync.
+func (s *Syncer) syncExtensions() (int, int, error) {
+	upstream, err := s.zed.GetExtensionsIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	local, err := s.zed.LoadExtensionIndex(path.Join(s.zed.extensionsLocalDir, "extensions.json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, 0, err
+	}
+	localByID := map[string]Extension{}
+	for _, ext := range local {
+		localByID[ext.ID] = ext
+	}
+
+	index := make(Extensions, len(upstream))
+	failed := make([]bool, len(upstream))
+	updated := 0
+	var mtx sync.Mutex
+	var archiveErr error
+	swg := sizedwaitgroup.New(s.concurrency)
+	for i, ext := range upstream {
+		index[i] = ext
+		old, exists := localByID[ext.ID]
+		archive := path.Join(s.zed.extensionsLocalDir, ext.ID+".tar.gz")
+		if _, err := os.Stat(archive); exists && err == nil && old.Version == ext.Version {
+			continue
+		}
+
+		swg.Add()
+		go func() {
+			defer swg.Done()
+			bytes, err := s.zed.DownloadExtensionArchiveDefault(ext)
+			if err == nil {
+				err = s.zed.StoreExtensionArchive(ext, bytes)
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				archiveErr = errors.Join(archiveErr, fmt.Errorf("extension %v: %w", ext.ID, err))
+				failed[i] = true
+				if exists {
+					index[i] = old
+				}
+				return
+			}
+			updated++
+			log.Debugf("(sync) extension %v updated to %v", ext.ID, ext.Version)
+		}()
+	}
+	swg.Wait()
+
+	kept := Extensions{}
+	for i, ext := range index {
+		if _, exists := localByID[ext.ID]; failed[i] && !exists {
+			continue
+		}
+		kept = append(kept, ext)
+	}
+	if err := s.zed.StoreExtensionIndex(kept); err != nil {
+		return 0, 0, err
+	}
+	return kept.Len(), updated, archiveErr
+}
+
+func (s *Syncer) syncLatestRelease() (Version, error) {
+	release, err := s.zed.GetLatestZedVersion()
+	if err != nil {
+		return Version{}, err
+	}
+	releaseNotes, err := s.zed.GetReleaseNotes(release.Version)
+	if err != nil {
+		return Version{}, err
+	}
+	if err := s.zed.StoreLatestRelease(release, releaseNotes); err != nil {
+		return Version{}, err
+	}
+	return release, nil
+}
+
+func (s *Syncer) syncRemoteServers(version string) error {
+	var syncErr error
+	for _, p := range s.remoteServerPlatforms {
+		if _, err := os.Stat(s.zed.remoteServerPath(version, p)); err == nil {
+			continue
+		}
+		bytes, _, err := s.zed.DownloadRemoteServer(version, p)
+		if err == nil {
+			err = s.zed.StoreRemoteServer(version, p, bytes)
+		}
+		if err != nil {
+			syncErr = errors.Join(syncErr, fmt.Errorf("remote server %v %v: %w", version, p, err))
+		}
+	}
+	return syncErr
+}
@@ -0,0 +1,85 @@
+package zed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"zedex/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextSyncDelay(t *testing.T) {
+	interval := 6 * time.Hour
+	assert.Equal(t, interval, nextSyncDelay(interval, 0, 0.5))
+	assert.Equal(t, interval-36*time.Minute, nextSyncDelay(interval, 0, 0))
+	assert.Equal(t, time.Minute, nextSyncDelay(interval, 1, 0.5))
+	assert.Equal(t, 4*time.Minute, nextSyncDelay(interval, 3, 0.5))
+	assert.Equal(t, interval, nextSyncDelay(interval, 100, 0.5))
+}
+
+func TestSyncOnce(t *testing.T) {
+	index := Extensions{
+		{ID: "html", Version: "0.1.0"},
+		{ID: "broken", Version: "1.0.0"},
+	}
+	downloads := utils.NewConcurrentMap[string, int]()
+	upstream := http.NewServeMux()
+	upstream.HandleFunc("/extensions", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(index.AsWrapped())
+	})
+	upstream.HandleFunc("/extensions/{id}/download", func(w http.ResponseWriter, r *http.Request) {
+		downloads.Transaction(func(m map[string]int) map[string]int {
+			m[r.PathValue("id")]++
+			return m
+		})
+		if r.PathValue("id") == "broken" {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte("archive " + r.PathValue("id")))
+	})
+	upstream.HandleFunc("/api/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Version{Version: "0.190.0", URL: "https://example.com/zed"})
+	})
+	upstream.HandleFunc("/api/release_notes/v2/stable/0.190.0", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ReleaseNotes{Title: "0.190.0"})
+	})
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	zc := NewZedClient(1)
+	zc.host, zc.apiHost = server.URL, server.URL
+	zc.WithExtensionsLocalDir(t.TempDir())
+	syncer := NewSyncer(zc, time.Hour)
+
+	assert.NotNil(t, syncer.SyncOnce())
+	status := syncer.Status()
+	assert.Equal(t, 1, status.ConsecutiveFailures)
+	assert.Equal(t, 1, status.Extensions)
+	assert.Equal(t, "0.190.0", status.LatestRelease)
+
+	// The broken extension is left out of the index until it downloads.
+	local, err := zc.LoadExtensionIndex(path.Join(zc.extensionsLocalDir, "extensions.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, local.Len())
+	archive, err := os.ReadFile(path.Join(zc.extensionsLocalDir, "html.tar.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "archive html", string(archive))
+
+	// Unchanged extensions are not downloaded again.
+	index = index[:1]
+	assert.Nil(t, syncer.SyncOnce())
+	assert.Equal(t, 1, downloads.Get("html"))
+	assert.Equal(t, 0, syncer.Status().ConsecutiveFailures)
+
+	index[0].Version = "0.2.0"
+	assert.Nil(t, syncer.SyncOnce())
+	assert.Equal(t, 2, downloads.Get("html"))
+	assert.Equal(t, 1, syncer.Status().ExtensionsUpdated)
+}
@@ -0,0 +1,203 @@
+package zed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"zedex/utils"
+	"zedex/zed/pb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	USAGE_EDIT_PREDICTIONS = "edit_predictions"
+
+	// USAGE_SAVE_DELAY batches the writes of the usage file, as Zed requests edit
+	// predictions while typing.
+	USAGE_SAVE_DELAY = 5 * time.Second
+
+	EDIT_PREDICTIONS_USAGE_AMOUNT_HEADER = "x-zed-edit-predictions-usage-amount"
+	EDIT_PREDICTIONS_USAGE_LIMIT_HEADER  = "x-zed-edit-predictions-usage-limit"
+	// SUBSCRIPTION_LIMIT_RESOURCE_HEADER names the resource whose limit was reached on a
+	// 403 response.
+	SUBSCRIPTION_LIMIT_RESOURCE_HEADER = "x-zed-subscription-limit-resource"
+)
+
+var ErrUsageLimitReached = errors.New("usage limit reached")
+
+// UsageLimits are the number of requests a user may make per period, 0 is unlimited.
+// zedex doesn't serve model requests, so they are always unlimited.
+type UsageLimits struct {
+	EditPredictions int `json:"edit_predictions"`
+}
+
+// Usage is what a user used in a period.
+type Usage struct {
+	EditPredictions int `json:"edit_predictions"`
+}
+
+func (u *Usage) counter(resource string) *int {
+	switch resource {
+	case USAGE_EDIT_PREDICTIONS:
+		return &u.EditPredictions
+	}
+	return nil
+}
+
+// UsagePeriod is a calendar month (UTC), usage is reset at the start of each period.
+type UsagePeriod struct {
+	Start time.Time
+	End   time.Time
+}
+
+func UsagePeriodFor(t time.Time) UsagePeriod {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return UsagePeriod{Start: start, End: start.AddDate(0, 1, 0)}
+}
+
+func (p UsagePeriod) Key() string {
+	return p.Start.Format("2006-01")
+}
+
+// UsageStore counts the requests of each user per period, persisted as a JSON file
+// mapping periods to user IDs to usage.
+type UsageStore struct {
+	path        string
+	periods     map[string]map[uint64]*Usage
+	savePending bool
+	now         func() time.Time
+	mtx         sync.Mutex
+}
+
+func NewUsageStore(path string) (*UsageStore, error) {
+	s := &UsageStore{path: path, periods: map[string]map[uint64]*Usage{}, now: time.Now}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.periods); err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", path, err)
+	}
+	return s, nil
+}
+
+// Flush writes the usage to disk.
+func (s *UsageStore) Flush() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.savePending = false
+	b, err := json.MarshalIndent(s.periods, "", "\t")
+	if err != nil {
+		return err
+	}
+	utils.CreateDirIfNotExists(path.Dir(s.path))
+	return utils.WriteFileAtomic(s.path, b, 0o644)
+}
+
+func (s *UsageStore) scheduleSaveUnsafe() {
+	if s.savePending {
+		return
+	}
+	s.savePending = true
+	time.AfterFunc(USAGE_SAVE_DELAY, func() {
+		if err := s.Flush(); err != nil {
+			log.Errorf("failed to save usage: %v", err)
+		}
+	})
+}
+
+func (s *UsageStore) usageUnsafe(userID uint64, period UsagePeriod) *Usage {
+	users, ok := s.periods[period.Key()]
+	if !ok {
+		users = map[uint64]*Usage{}
+		s.periods[period.Key()] = users
+	}
+	u, ok := users[userID]
+	if !ok {
+		u = &Usage{}
+		users[userID] = u
+	}
+	return u
+}
+
+// Consume counts a request of a user against a limit (0 is unlimited). If the limit was
+// already reached, the request is not counted and ErrUsageLimitReached is returned.
+func (s *UsageStore) Consume(userID uint64, resource string, limit int) (Usage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u := s.usageUnsafe(userID, UsagePeriodFor(s.now()))
+	counter := u.counter(resource)
+	if counter == nil {
+		return Usage{}, fmt.Errorf("unknown resource %q", resource)
+	}
+	if limit > 0 && *counter >= limit {
+		return *u, ErrUsageLimitReached
+	}
+	*counter++
+	s.scheduleSaveUnsafe()
+	return *u, nil
+}
+
+// Refund uncounts a request of a user that failed after it was consumed.
+func (s *UsageStore) Refund(userID uint64, resource string) (Usage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u := s.usageUnsafe(userID, UsagePeriodFor(s.now()))
+	counter := u.counter(resource)
+	if counter == nil {
+		return Usage{}, fmt.Errorf("unknown resource %q", resource)
+	}
+	if *counter > 0 {
+		*counter--
+		s.scheduleSaveUnsafe()
+	}
+	return *u, nil
+}
+
+// Usage returns the usage of a user in the current period.
+func (s *UsageStore) Usage(userID uint64) (Usage, UsagePeriod) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	period := UsagePeriodFor(s.now())
+	if u, ok := s.periods[period.Key()][userID]; ok {
+		return *u, period
+	}
+	return Usage{}, period
+}
+
+// UsageLimitHeader formats a limit like the usage limit headers Zed reads.
+func UsageLimitHeader(limit int) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(limit)
+}
+
+func usageLimitProto(limit int) *pb.UsageLimit {
+	if limit <= 0 {
+		return &pb.UsageLimit{Variant: &pb.UsageLimit_Unlimited_{Unlimited: &pb.UsageLimit_Unlimited{}}}
+	}
+	return &pb.UsageLimit{Variant: &pb.UsageLimit_Limited_{Limited: &pb.UsageLimit_Limited{Limit: uint32(limit)}}}
+}
+
+// SubscriptionUsageProto is the usage as sent to Zed in UpdateUserPlan. zedex doesn't
+// serve model requests, so none are ever used.
+func SubscriptionUsageProto(usage Usage, limits UsageLimits) *pb.SubscriptionUsage {
+	return &pb.SubscriptionUsage{
+		ModelRequestsUsageAmount:   0,
+		ModelRequestsUsageLimit:    usageLimitProto(0),
+		EditPredictionsUsageAmount: uint32(usage.EditPredictions),
+		EditPredictionsUsageLimit:  usageLimitProto(limits.EditPredictions),
+	}
+}
@@ -0,0 +1,170 @@
+package zed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"zedex/zed/pb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUsageStore(t *testing.T) *UsageStore {
+	usage, err := NewUsageStore(path.Join(t.TempDir(), "usage.json"))
+	assert.Nil(t, err)
+	return usage
+}
+
+func TestUsageStore(t *testing.T) {
+	file := path.Join(t.TempDir(), "usage.json")
+	usage, err := NewUsageStore(file)
+	assert.Nil(t, err)
+	now := time.Date(2025, 1, 31, 23, 0, 0, 0, time.UTC)
+	usage.now = func() time.Time { return now }
+
+	for range 2 {
+		_, err := usage.Consume(1, USAGE_EDIT_PREDICTIONS, 2)
+		assert.Nil(t, err)
+	}
+	used, err := usage.Consume(1, USAGE_EDIT_PREDICTIONS, 2)
+	assert.ErrorIs(t, err, ErrUsageLimitReached)
+	assert.Equal(t, 2, used.EditPredictions)
+	_, err = usage.Consume(2, USAGE_EDIT_PREDICTIONS, 2)
+	assert.Nil(t, err)
+	_, err = usage.Consume(1, "unknown", 0)
+	assert.NotNil(t, err)
+	used, err = usage.Refund(2, USAGE_EDIT_PREDICTIONS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, used.EditPredictions)
+	used, err = usage.Refund(2, USAGE_EDIT_PREDICTIONS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, used.EditPredictions)
+
+	used, period := usage.Usage(1)
+	assert.Equal(t, Usage{EditPredictions: 2}, used)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), period.Start)
+	assert.Equal(t, time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC), period.End)
+
+	// Usage survives a restart.
+	assert.Nil(t, usage.Flush())
+	usage, err = NewUsageStore(file)
+	assert.Nil(t, err)
+	usage.now = func() time.Time { return now }
+	used, _ = usage.Usage(1)
+	assert.Equal(t, Usage{EditPredictions: 2}, used)
+
+	// And is reset in the next period.
+	now = now.Add(time.Hour)
+	used, _ = usage.Usage(1)
+	assert.Equal(t, Usage{}, used)
+	_, err = usage.Consume(1, USAGE_EDIT_PREDICTIONS, 2)
+	assert.Nil(t, err)
+}
+
+func TestUsageLimitJSON(t *testing.T) {
+	b, err := json.Marshal(UsageData{Used: 3, Limit: NewUsageLimit(0)})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"used": 3, "limit": "unlimited"}`, string(b))
+	b, err = json.Marshal(UsageData{Used: 3, Limit: NewUsageLimit(50)})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"used": 3, "limit": {"limited": 50}}`, string(b))
+
+	var data UsageData
+	assert.Nil(t, json.Unmarshal(b, &data))
+	assert.Equal(t, NewUsageLimit(50), data.Limit)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"limit": "some"}`), &data))
+}
+
+func TestEditPredictionLimit(t *testing.T) {
+	// Predictions fail upstream.
+	llm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer llm.Close()
+	t.Setenv("OPENAI_COMPATIBLE_HOST", llm.URL)
+	t.Setenv("OPENAI_COMPATIBLE_API_KEY", "secret")
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	user, err := users.Resolve("device:a", UserProfile{})
+	assert.Nil(t, err)
+	accessToken, err := users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	tokens := NewLLMTokens([]byte("secret"))
+	llmToken, err := tokens.Issue(user)
+	assert.Nil(t, err)
+	usage := newTestUsageStore(t)
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), tokens, usage, newTestPlanStore(t, UsageLimits{EditPredictions: 1}), 8080)
+	router := api.Router()
+	predict := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/predict_edits/v2", strings.NewReader(`{"input_excerpt": "<|editable_region_start|>a<|editable_region_end|>"}`))
+		req.Header.Set("Authorization", "Bearer "+llmToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Failed predictions don't count.
+	assert.Equal(t, 500, predict().Code)
+	used, _ := usage.Usage(user.ID)
+	assert.Equal(t, 0, used.EditPredictions)
+
+	_, err = usage.Consume(user.ID, USAGE_EDIT_PREDICTIONS, 1)
+	assert.Nil(t, err)
+
+	w := predict()
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, USAGE_EDIT_PREDICTIONS, w.Header().Get(SUBSCRIPTION_LIMIT_RESOURCE_HEADER))
+	assert.Equal(t, "1", w.Header().Get(EDIT_PREDICTIONS_USAGE_AMOUNT_HEADER))
+	assert.Equal(t, "1", w.Header().Get(EDIT_PREDICTIONS_USAGE_LIMIT_HEADER))
+
+	req := httptest.NewRequest("GET", "/client/users/me", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("%d %s", user.ID, accessToken))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var me GetAuthenticatedUserResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &me))
+	assert.Equal(t, uint32(1), me.Plan.Usage.EditPredictions.Used)
+	assert.Equal(t, NewUsageLimit(1), me.Plan.Usage.EditPredictions.Limit)
+	assert.Equal(t, NewUsageLimit(0), me.Plan.Usage.ModelRequests.Limit)
+	assert.NotNil(t, me.Plan.SubscriptionPeriod)
+}
+
+func TestUsagePushed(t *testing.T) {
+	llm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"choices": [{"message": {"content": "<|editable_region_start|>b<|editable_region_end|>"}}]}`)
+	}))
+	defer llm.Close()
+	t.Setenv("OPENAI_COMPATIBLE_HOST", llm.URL)
+	t.Setenv("OPENAI_COMPATIBLE_API_KEY", "secret")
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	tokens := NewLLMTokens([]byte("secret"))
+	api := NewAPI(true, true, true, true, true, NewZedClient(1), users, newTestFlagStore(t), tokens, newTestUsageStore(t), newTestPlanStore(t, UsageLimits{EditPredictions: 2}), 8080)
+	server := &testRpcServer{Server: httptest.NewServer(api.Router()), users: users}
+	defer server.Close()
+	alice := server.connect(t, "alice")
+	alice.receive(func(e *pb.Envelope) bool { return e.GetUpdateUserPlan() != nil })
+
+	llmToken, err := tokens.Issue(alice.user)
+	assert.Nil(t, err)
+	req, err := http.NewRequest("POST", server.URL+"/predict_edits/v2", strings.NewReader(`{"input_excerpt": "<|editable_region_start|>a<|editable_region_end|>"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+llmToken)
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Zed learns about the prediction without signing in again.
+	usage := alice.receive(func(e *pb.Envelope) bool { return e.GetUpdateUserPlan() != nil }).GetUpdateUserPlan().Usage
+	assert.Equal(t, uint32(1), usage.EditPredictionsUsageAmount)
+	assert.Equal(t, uint32(2), usage.EditPredictionsUsageLimit.GetLimited().Limit)
+}
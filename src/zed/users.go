@@ -0,0 +1,421 @@
+package zed
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zedex/utils"
+	"zedex/zed/pb"
+
+	"github.com/0x6flab/namegenerator"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const MAX_ACCESS_TOKENS = 10
+
+// UserRecord is a user of zedex. Users are identified by one or more stable identities
+// (e.g. "device:<id>"), and keep their numeric ID and profile across sign-ins and
+// restarts.
+type UserRecord struct {
+	ID         uint64    `json:"id"`
+	Login      string    `json:"login"`
+	Name       string    `json:"name,omitempty"`
+	AvatarURL  string    `json:"avatar_url,omitempty"`
+	MetricsID  string    `json:"metrics_id"`
+	Identities []string  `json:"identities"`
+	Groups     []string  `json:"groups,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	Staff         bool       `json:"staff,omitempty"`
+	AcceptedTosAt *time.Time `json:"accepted_tos_at,omitempty"`
+	// Plan is the name of the users plan, the free plan if empty.
+	Plan string `json:"plan,omitempty"`
+
+	AccessTokens []AccessToken `json:"access_tokens,omitempty"`
+}
+
+// AccessToken is the SHA-256 hash of a token handed to Zed at sign-in, or to the browser
+// that signed in for session tokens.
+type AccessToken struct {
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	// Session tokens only sign the browser in to the account pages, not to the API.
+	Session bool `json:"session,omitempty"`
+}
+
+// clone copies the record, so callers can't modify the stored slices.
+func (u *UserRecord) clone() UserRecord {
+	c := *u
+	c.Identities = slices.Clone(u.Identities)
+	c.Groups = slices.Clone(u.Groups)
+	if u.AcceptedTosAt != nil {
+		acceptedTosAt := *u.AcceptedTosAt
+		c.AcceptedTosAt = &acceptedTosAt
+	}
+	c.AccessTokens = slices.Clone(u.AccessTokens)
+	return c
+}
+
+func (u UserRecord) Proto() *pb.User {
+	user := &pb.User{
+		Id:          u.ID,
+		GithubLogin: u.Login,
+		AvatarUrl:   u.AvatarURL,
+	}
+	if u.Name != "" {
+		user.Name = &u.Name
+	}
+	return user
+}
+
+// UserProfile is what an identity provider knows about a user. Empty fields are
+// generated or left unchanged, a nil Groups leaves the groups unchanged.
+type UserProfile struct {
+	Login     string
+	Name      string
+	AvatarURL string
+	Groups    []string
+}
+
+type usersFile struct {
+	NextID uint64        `json:"next_id"`
+	Users  []*UserRecord `json:"users"`
+}
+
+// UserStore is the user registry, persisted as a JSON file.
+type UserStore struct {
+	path          string
+	users         map[uint64]*UserRecord
+	nextID        uint64
+	nameGenerator namegenerator.NameGenerator
+	checkIdentity func(identity string) error
+	modTime       time.Time
+	mtx           sync.Mutex
+}
+
+// NewUserStore loads the registry from path, which is created on the first write.
+func NewUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:          path,
+		users:         map[uint64]*UserRecord{},
+		nextID:        1,
+		nameGenerator: namegenerator.NewGenerator(),
+	}
+
+	if err := s.loadUnsafe(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadUnsafe rereads the registry if it was modified since it was last read, e.g. by
+// `zedex users`.
+func (s *UserStore) loadUnsafe() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var f usersFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("failed to read %v: %w", s.path, err)
+	}
+	s.users = map[uint64]*UserRecord{}
+	for _, u := range f.Users {
+		s.users[u.ID] = u
+	}
+	s.nextID = max(f.NextID, 1)
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// reloadUnsafe is loadUnsafe for operations that can continue with the users read
+// last.
+func (s *UserStore) reloadUnsafe() {
+	if err := s.loadUnsafe(); err != nil {
+		log.Errorf("failed to reload users: %v", err)
+	}
+}
+
+// WithIdentityCheck makes Authenticate reject users with an identity check rejects, e.g.
+// because the account was removed from the identity provider.
+func (s *UserStore) WithIdentityCheck(check func(identity string) error) *UserStore {
+	s.checkIdentity = check
+	return s
+}
+
+func (s *UserStore) saveUnsafe() error {
+	f := usersFile{NextID: s.nextID, Users: []*UserRecord{}}
+	for _, u := range s.users {
+		f.Users = append(f.Users, u)
+	}
+	sort.Slice(f.Users, func(i, j int) bool { return f.Users[i].ID < f.Users[j].ID })
+
+	b, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+	utils.CreateDirIfNotExists(path.Dir(s.path))
+	if err := utils.WriteFileAtomic(s.path, b, 0o600); err != nil {
+		return err
+	}
+	// Force a reread, the modification time may not change within the same tick.
+	s.modTime = time.Time{}
+	return nil
+}
+
+func (s *UserStore) byIdentityUnsafe(identity string) *UserRecord {
+	for _, u := range s.users {
+		if slices.Contains(u.Identities, identity) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *UserStore) loginTakenUnsafe(login string, except uint64) bool {
+	for _, u := range s.users {
+		if u.ID != except && strings.EqualFold(u.Login, login) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueLoginUnsafe returns login, or login with a numeric suffix if it is taken. An
+// empty login is replaced by a generated name.
+func (s *UserStore) uniqueLoginUnsafe(login string, except uint64) string {
+	if login == "" {
+		login = s.nameGenerator.Generate()
+	}
+	unique := login
+	for i := 2; s.loginTakenUnsafe(unique, except); i++ {
+		unique = fmt.Sprintf("%s-%d", login, i)
+	}
+	return unique
+}
+
+// Resolve returns the user with the given identity, creating it if it does not exist.
+// Non-empty profile fields overwrite the stored profile.
+func (s *UserStore) Resolve(identity string, profile UserProfile) (UserRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+
+	u := s.byIdentityUnsafe(identity)
+	if u == nil {
+		u = &UserRecord{
+			ID:         s.nextID,
+			Login:      s.uniqueLoginUnsafe(profile.Login, 0),
+			MetricsID:  uuid.New().String(),
+			Identities: []string{identity},
+			CreatedAt:  time.Now().UTC(),
+		}
+		s.users[u.ID] = u
+		s.nextID++
+	} else if profile.Login != "" && !strings.EqualFold(profile.Login, u.Login) {
+		u.Login = s.uniqueLoginUnsafe(profile.Login, u.ID)
+	}
+	if profile.Name != "" {
+		u.Name = profile.Name
+	}
+	if profile.AvatarURL != "" {
+		u.AvatarURL = profile.AvatarURL
+	}
+	if profile.Groups != nil {
+		u.Groups = slices.Clone(profile.Groups)
+	}
+
+	if err := s.saveUnsafe(); err != nil {
+		return UserRecord{}, err
+	}
+	return u.clone(), nil
+}
+
+func (s *UserStore) Get(id uint64) (UserRecord, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+	u, ok := s.users[id]
+	if !ok {
+		return UserRecord{}, false
+	}
+	return u.clone(), true
+}
+
+func (s *UserStore) GetByLogin(login string) (UserRecord, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Login, login) {
+			return u.clone(), true
+		}
+	}
+	return UserRecord{}, false
+}
+
+// Update applies f to a user and stores the result.
+func (s *UserStore) Update(id uint64, f func(u *UserRecord)) (UserRecord, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+	u, ok := s.users[id]
+	if !ok {
+		return UserRecord{}, fmt.Errorf("unknown user %v", id)
+	}
+	f(u)
+	if err := s.saveUnsafe(); err != nil {
+		return UserRecord{}, err
+	}
+	return u.clone(), nil
+}
+
+// AcceptTermsOfService records when a user accepted the terms of service, keeping the
+// time of the first acceptance.
+func (s *UserStore) AcceptTermsOfService(id uint64) (UserRecord, error) {
+	return s.Update(id, func(u *UserRecord) {
+		if u.AcceptedTosAt == nil {
+			now := time.Now().UTC().Truncate(time.Second)
+			u.AcceptedTosAt = &now
+		}
+	})
+}
+
+// Lookup finds a user by ID or login.
+func (s *UserStore) Lookup(idOrLogin string) (UserRecord, bool) {
+	if id, err := strconv.ParseUint(idOrLogin, 10, 64); err == nil {
+		if u, ok := s.Get(id); ok {
+			return u, true
+		}
+	}
+	return s.GetByLogin(idOrLogin)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueAccessToken creates a random access token for a user and stores its hash. Only
+// the MAX_ACCESS_TOKENS most recent tokens of a user stay valid.
+func (s *UserStore) IssueAccessToken(id uint64) (string, error) {
+	return s.issueToken(id, false)
+}
+
+// IssueSessionToken creates a random session token for the browser a user signed in
+// with, which AuthenticateSession accepts but Authenticate doesn't.
+func (s *UserStore) IssueSessionToken(id uint64) (string, error) {
+	return s.issueToken(id, true)
+}
+
+func (s *UserStore) issueToken(id uint64, session bool) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+	u, ok := s.users[id]
+	if !ok {
+		return "", fmt.Errorf("unknown user %v", id)
+	}
+	u.AccessTokens = append(u.AccessTokens, AccessToken{Hash: hashToken(token), CreatedAt: time.Now().UTC(), Session: session})
+	// Browsers signing in don't push out the tokens of Zed, or the other way around.
+	kept := 0
+	for i := len(u.AccessTokens) - 1; i >= 0; i-- {
+		if u.AccessTokens[i].Session != session {
+			continue
+		}
+		if kept++; kept > MAX_ACCESS_TOKENS {
+			u.AccessTokens = slices.Delete(u.AccessTokens, i, i+1)
+		}
+	}
+	if err := s.saveUnsafe(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Authenticate verifies an "<user id> <access token>" Authorization header, as sent
+// by Zed, and returns the user.
+func (s *UserStore) Authenticate(authorization string) (UserRecord, error) {
+	return s.authenticate(authorization, false)
+}
+
+// AuthenticateSession verifies an "<user id> <session token>" session cookie and
+// returns the user.
+func (s *UserStore) AuthenticateSession(session string) (UserRecord, error) {
+	return s.authenticate(session, true)
+}
+
+func (s *UserStore) authenticate(authorization string, session bool) (UserRecord, error) {
+	idStr, token, ok := strings.Cut(authorization, " ")
+	if !ok || token == "" {
+		return UserRecord{}, fmt.Errorf("malformed authorization header")
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return UserRecord{}, fmt.Errorf("malformed user id: %w", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+	u, ok := s.users[id]
+	if !ok {
+		return UserRecord{}, fmt.Errorf("unknown user %v", id)
+	}
+	hash := []byte(hashToken(token))
+	if !slices.ContainsFunc(u.AccessTokens, func(t AccessToken) bool {
+		return subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 && t.Session == session
+	}) {
+		return UserRecord{}, fmt.Errorf("invalid access token for user %v", id)
+	}
+	if s.checkIdentity != nil {
+		for _, identity := range u.Identities {
+			if err := s.checkIdentity(identity); err != nil {
+				return UserRecord{}, err
+			}
+		}
+	}
+	return u.clone(), nil
+}
+
+// Users returns all users ordered by ID.
+func (s *UserStore) Users() []UserRecord {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reloadUnsafe()
+	users := []UserRecord{}
+	for _, u := range s.users {
+		users = append(users, u.clone())
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
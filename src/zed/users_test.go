@@ -0,0 +1,96 @@
+package zed
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserStore(t *testing.T) {
+	file := path.Join(t.TempDir(), "users.json")
+	users, err := NewUserStore(file)
+	assert.Nil(t, err)
+
+	anonymous, err := users.Resolve("device:a", UserProfile{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), anonymous.ID)
+	assert.NotEmpty(t, anonymous.Login)
+
+	again, err := users.Resolve("device:a", UserProfile{})
+	assert.Nil(t, err)
+	assert.Equal(t, anonymous, again)
+
+	jane, err := users.Resolve("device:b", UserProfile{Login: "jane", Name: "Jane"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), jane.ID)
+	otherJane, err := users.Resolve("device:c", UserProfile{Login: "Jane"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Jane-2", otherJane.Login)
+
+	// Users survive a restart.
+	users, err = NewUserStore(file)
+	assert.Nil(t, err)
+	reloaded, ok := users.Get(jane.ID)
+	assert.True(t, ok)
+	assert.Equal(t, jane, reloaded)
+	reloaded, ok = users.GetByLogin("JANE")
+	assert.True(t, ok)
+	assert.Equal(t, jane.ID, reloaded.ID)
+
+	next, err := users.Resolve("device:d", UserProfile{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), next.ID)
+	assert.Len(t, users.Users(), 4)
+}
+
+func TestAccessTokens(t *testing.T) {
+	users, err := NewUserStore(path.Join(t.TempDir(), "users.json"))
+	assert.Nil(t, err)
+	user, err := users.Resolve("device:a", UserProfile{})
+	assert.Nil(t, err)
+
+	token, err := users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	authenticated, err := users.Authenticate(fmt.Sprintf("%d %s", user.ID, token))
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, authenticated.ID)
+	assert.NotContains(t, fmt.Sprint(authenticated.AccessTokens), token)
+
+	for _, header := range []string{"", "1", fmt.Sprintf("%d a", user.ID), fmt.Sprintf("2 %s", token), "x " + token} {
+		_, err := users.Authenticate(header)
+		assert.NotNil(t, err, header)
+	}
+
+	// Only the most recent tokens stay valid.
+	for i := 0; i < MAX_ACCESS_TOKENS; i++ {
+		_, err := users.IssueAccessToken(user.ID)
+		assert.Nil(t, err)
+	}
+	_, err = users.Authenticate(fmt.Sprintf("%d %s", user.ID, token))
+	assert.NotNil(t, err)
+
+	// Session tokens only sign browsers in, and don't push out the tokens of Zed.
+	token, err = users.IssueAccessToken(user.ID)
+	assert.Nil(t, err)
+	session, err := users.IssueSessionToken(user.ID)
+	assert.Nil(t, err)
+	for i := 0; i < MAX_ACCESS_TOKENS; i++ {
+		_, err := users.IssueSessionToken(user.ID)
+		assert.Nil(t, err)
+	}
+	_, err = users.Authenticate(fmt.Sprintf("%d %s", user.ID, token))
+	assert.Nil(t, err)
+	_, err = users.AuthenticateSession(fmt.Sprintf("%d %s", user.ID, token))
+	assert.NotNil(t, err)
+	_, err = users.AuthenticateSession(fmt.Sprintf("%d %s", user.ID, session))
+	assert.NotNil(t, err)
+	session, err = users.IssueSessionToken(user.ID)
+	assert.Nil(t, err)
+	_, err = users.Authenticate(fmt.Sprintf("%d %s", user.ID, session))
+	assert.NotNil(t, err)
+	authenticated, err = users.AuthenticateSession(fmt.Sprintf("%d %s", user.ID, session))
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, authenticated.ID)
+}